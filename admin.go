@@ -0,0 +1,88 @@
+//go:build ignore
+
+// admin manages the server roles of users without the admin API, e.g. to
+// promote the first admin. Run it where the server keeps disgord.db.
+//
+//	go run admin.go list                  list admins and moderators
+//	go run admin.go grant USERNAME [ROLE] make the user an admin, or ROLE
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"disgord/ent"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	client, err := ent.Open(dialect.SQLite, "file:disgord.db?cache=shared&_fk=1")
+	if err != nil {
+		log.Fatalf("failed opening connection to sqlite: %v", err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	args := os.Args[1:]
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		err = list(ctx, client)
+	case len(args) == 2 && args[0] == "grant":
+		err = grant(ctx, client, args[1], user.RoleAdmin)
+	case len(args) == 3 && args[0] == "grant":
+		err = grant(ctx, client, args[1], user.Role(args[2]))
+	default:
+		err = errors.New("usage: go run admin.go [list | grant USERNAME [admin | moderator | member]]")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func list(ctx context.Context, client *ent.Client) error {
+	users, err := client.User.
+		Query().
+		Where(user.RoleIn(user.RoleAdmin, user.RoleModerator)).
+		Order(user.ByUsername()).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		fmt.Println(user.Username, user.Role)
+	}
+
+	return nil
+}
+
+func grant(ctx context.Context, client *ent.Client, username string, role user.Role) error {
+	if err := user.RoleValidator(role); err != nil {
+		return err
+	}
+
+	n, err := client.User.
+		Update().
+		Where(
+			user.Username(username),
+			user.Bot(false),
+		).
+		SetRole(role).
+		Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("cannot find user %s", username)
+	}
+
+	return nil
+}
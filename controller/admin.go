@@ -0,0 +1,328 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/session"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAllUsersAsAdmin godoc
+//
+//	@Tags		admin
+//	@Summary	list all users with their email addresses
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	controller.Profile
+//	@Failure	401
+//	@Failure	403	"moderator only"
+//	@Router		/admin/users [get]
+func (*Controller) GetAllUsersAsAdmin(c *gin.Context) {
+	users, err := client.User.
+		Query().
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	profiles := make([]Profile, 0, len(users))
+	for _, user := range users {
+		profiles = append(profiles, newProfile(user))
+	}
+
+	c.JSON(http.StatusOK, profiles)
+}
+
+// UpdateUserRole godoc
+//
+//	@Tags		admin
+//	@Summary	change the server role of a user
+//	@Param		uri				path	controller.UpdateUserRole.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Param		body			body	controller.UpdateUserRole.Body	true	"Request body"
+//	@Security	BearerAuth
+//	@Success	200	{object}	controller.Profile
+//	@Failure	401
+//	@Failure	403	"admin only"
+//	@Failure	404	"cannot find user"
+//	@Failure	409	"cannot change your own role"
+//	@Router		/admin/users/{id}/role [put]
+func (*Controller) UpdateUserRole(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Role user.Role `json:"role" binding:"required,oneof=admin moderator member" enums:"admin,moderator,member"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	if !authorize(c, user.RoleAdmin) {
+		return
+	}
+
+	// Keeps at least one admin around.
+	if uri.ID == getCurrentUserID(c) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "cannot change your own role",
+		})
+		return
+	}
+
+	user, err := client.User.
+		UpdateOneID(uri.ID).
+		Where(user.Bot(false)).
+		SetRole(body.Role).
+		Save(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newProfile(user))
+}
+
+// SignOutUser godoc
+//
+//	@Description	Every session of the user is revoked and disconnected from the WebSocket. The user can sign in again.
+//	@Tags			admin
+//	@Summary		force a user to sign out of every device
+//	@Param			uri				path	controller.SignOutUser.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"cannot moderate the user"
+//	@Failure		404	"cannot find user"
+//	@Router			/admin/users/{id}/sign-out [post]
+func (*Controller) SignOutUser(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	target, ok := getModeratedUser(c, tx, uri.ID)
+	if !ok {
+		return
+	}
+
+	if err := signOutEverywhere(tx, target.ID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	disconnect(target.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteUser godoc
+//
+//	@Description	The chatrooms of the user are transferred, archived or deleted, as the server is configured to.
+//	@Tags			admin
+//	@Summary		delete a user and all related data
+//	@Param			uri				path	controller.DeleteUser.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"admin only"
+//	@Failure		404	"cannot find user"
+//	@Router			/admin/users/{id} [delete]
+func (*Controller) DeleteUser(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	if !authorize(c, user.RoleAdmin) {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	target, ok := getModeratedUser(c, tx, uri.ID)
+	if !ok {
+		return
+	}
+
+	// Bots of the user are deleted along with it.
+	botIDs, err := target.
+		QueryBots().
+		IDs(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	released, err := releaseChatrooms(tx, append(botIDs, target.ID)...)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = tx.User.
+		DeleteOne(target).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	disconnect(target.ID)
+	for _, botID := range botIDs {
+		disconnect(botID)
+	}
+	released.notify()
+
+	c.Status(http.StatusNoContent)
+}
+
+// ForceDeleteChatroom godoc
+//
+//	@Tags		admin
+//	@Summary	delete any chatroom and all chats in it
+//	@Param		uri				path	controller.ForceDeleteChatroom.Uri	true	"path"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"moderator only"
+//	@Failure	404	"cannot find chatroom"
+//	@Router		/admin/chatrooms/{id} [delete]
+func (*Controller) ForceDeleteChatroom(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	chatroom, err := client.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	err = client.Chatroom.
+		DeleteOne(chatroom).
+		Exec(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	kickAllClientsFromRoom(uri.ID)
+	roomListUpdated(chatroom.GuildID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// getModeratedUser returns the user if the current user may moderate them,
+// and responds with 403 or 404 otherwise.
+func getModeratedUser(c *gin.Context, tx *ent.Tx, userID int) (*ent.User, bool) {
+	currentUser, err := getCurrentUser(c)
+	if err != nil {
+		c.Status(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	target, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return nil, false
+	}
+
+	if target.ID == currentUser.ID || !outranks(currentUser.Role, target.Role) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot moderate the user",
+		})
+		return nil, false
+	}
+
+	return target, true
+}
+
+// refuseSuspended responds with 403 if the user is suspended.
+func refuseSuspended(c *gin.Context, user *ent.User) bool {
+	if !user.Suspended {
+		return false
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{
+		"message": "user suspended",
+	})
+	return true
+}
+
+// signOutEverywhere revokes every session of the user.
+func signOutEverywhere(tx *ent.Tx, userID int) error {
+	_, err := tx.Session.
+		Delete().
+		Where(session.UserID(userID)).
+		Exec(ctx)
+	return err
+}
@@ -1,13 +1,19 @@
 package controller
 
 import (
-	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"hash/fnv"
 	"log"
 	"net/http"
-	"os"
 	"time"
 
+	"disgord/ent"
+	"disgord/ent/refreshtoken"
+	"disgord/ent/securityevent"
+	"disgord/ent/session"
 	"disgord/ent/user"
 
 	"github.com/gin-gonic/gin"
@@ -70,20 +76,29 @@ type Token struct {
 	AccessToken string `json:"accessToken" binding:"required"`
 }
 
+type Challenge struct {
+	ChallengeToken string `json:"challengeToken" binding:"required"`
+}
+
 // SignIn godoc
 //
 //	@Description	Set "Authorization" header with the "Bearer ${accessToken}" to authenticate requests.
+//	@Description	If the user enabled two-factor authentication, exchange the challenge token at /auth/sign-in/2fa instead.
 //	@Tags			auth
 //	@Summary		sign in and receive an access token
 //	@Param			body	body		controller.SignIn.Body	true	"Request body"
 //	@Success		200		{object}	controller.Token
+//	@Success		202		{object}	controller.Challenge	"two-factor authentication required"
 //	@Failure		401		"invalid username or password"
+//	@Failure		403		"user suspended"
 //	@Failure		404		"user not found"
+//	@Failure		429		"too many failed attempts, retry later"
 //	@Router			/auth/sign-in [post]
 func (*Controller) SignIn(c *gin.Context) {
 	type Body struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
+		Username   string `json:"username" binding:"required"`
+		Password   string `json:"password" binding:"required"`
+		DeviceName string `json:"deviceName"`
 	}
 
 	var body Body
@@ -99,6 +114,12 @@ func (*Controller) SignIn(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
+	keys := []string{ipKey(c.ClientIP()), usernameKey(body.Username)}
+	if wait := limiter.Wait(keys...); wait > 0 {
+		retryLater(c, wait)
+		return
+	}
+
 	user, err := tx.User.
 		Query().
 		Where(user.Username(body.Username)).
@@ -110,23 +131,37 @@ func (*Controller) SignIn(c *gin.Context) {
 		return
 	}
 
-	if !verifyPassword(user.Password, body.Password) {
+	// Bots have a random password nobody knows, and sign in only with
+	// personal access tokens.
+	if user.Bot || !verifyPassword(user.Password, body.Password) {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"message": "invalid username or password",
 		})
 		return
 	}
 
-	accessToken, refreshToken, err := issueToken(user.ID)
-	if err != nil {
-		c.Status(http.StatusInternalServerError)
-		log.Println(err)
+	limiter.Release(ipKey(c.ClientIP()))
+	limiter.Reset(usernameKey(body.Username))
+
+	if refuseSuspended(c, user) {
 		return
 	}
 
-	_, err = user.Update().
-		SetRefreshToken(refreshToken).
-		Save(ctx)
+	if user.TotpEnabled {
+		challengeToken, err := issueChallengeToken(user.ID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		c.JSON(http.StatusAccepted, Challenge{
+			ChallengeToken: challengeToken,
+		})
+		return
+	}
+
+	accessToken, refreshToken, err := createSession(tx, c, user.ID, body.DeviceName)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
@@ -149,14 +184,16 @@ func (*Controller) SignIn(c *gin.Context) {
 
 // Refresh godoc
 //
-//	@Tags		auth
-//	@Summary	refresh an access token
-//	@Success	200	{object}	controller.Token
-//	@Failure	401
-//	@Failure	404	"cannot find user"
-//	@Router		/auth/refresh [post]
+//	@Description	Each refresh token can be exchanged only once.
+//	@Description	If an already exchanged refresh token is presented, the whole session is revoked.
+//	@Tags			auth
+//	@Summary		refresh an access token
+//	@Success		200	{object}	controller.Token
+//	@Failure		401	"refresh token reused, session revoked"
+//	@Failure		403	"user suspended"
+//	@Router			/auth/refresh [post]
 func (*Controller) Refresh(c *gin.Context) {
-	userID, err := extractUserID(c.Request, cookieExtractor)
+	claims, err := extractClaims(c.Request, cookieExtractor)
 	if err != nil {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -170,29 +207,84 @@ func (*Controller) Refresh(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	user, err := tx.User.Get(ctx, userID)
+	refreshToken, _ := c.Cookie("refreshToken")
+
+	token, err := tx.RefreshToken.
+		Query().
+		Where(
+			refreshtoken.Token(hashToken(refreshToken)),
+			refreshtoken.SessionID(claims.SessionID),
+		).
+		Only(ctx)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"message": "cannot find user",
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	if token.RotatedAt != nil {
+		// The token has already been exchanged for a new one, so someone is
+		// replaying a stolen copy. Revoke the whole token family.
+		err = tx.Session.
+			DeleteOneID(claims.SessionID).
+			Exec(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		err = newSecurityEvent(tx, c, claims.UserID, securityevent.TypeRefreshTokenReuse).
+			SetSessionID(claims.SessionID).
+			Exec(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		disconnectSession(claims.SessionID)
+
+		c.SetSameSite(http.SameSiteNoneMode)
+		c.SetCookie("refreshToken", "", -1, "/", "", true, true)
+
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "refresh token reused, session revoked",
 		})
 		return
 	}
 
-	refreshToken, _ := c.Cookie("refreshToken")
-	if user.RefreshToken != refreshToken {
+	// Checked after reuse, so that a replayed token of a suspended user
+	// revokes the token family all the same.
+	user, err := tx.User.Get(ctx, claims.UserID)
+	if err != nil {
 		c.Status(http.StatusUnauthorized)
 		return
 	}
 
-	accessToken, refreshToken, err := issueToken(userID)
+	if refuseSuspended(c, user) {
+		return
+	}
+
+	_, err = token.Update().
+		SetRotatedAt(time.Now()).
+		Save(ctx)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	_, err = user.Update().
-		SetRefreshToken(refreshToken).
+	_, err = tx.Session.
+		UpdateOneID(claims.SessionID).
+		SetUserAgent(c.Request.UserAgent()).
+		SetIPAddress(c.ClientIP()).
+		SetLastUsedAt(time.Now()).
 		Save(ctx)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
@@ -200,6 +292,13 @@ func (*Controller) Refresh(c *gin.Context) {
 		return
 	}
 
+	accessToken, refreshToken, err := issueSessionToken(tx, claims.UserID, claims.SessionID, token)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
@@ -217,24 +316,27 @@ func (*Controller) Refresh(c *gin.Context) {
 // SignOut godoc
 //
 //	@Tags		auth
-//	@Summary	sign out and revoke the refresh token
+//	@Summary	sign out and revoke the current session
 //	@Success	200
 //	@Router		/auth/sign-out [post]
 func (*Controller) SignOut(c *gin.Context) {
-	userID, err := extractUserID(
+	claims, err := extractClaims(
 		c.Request,
 		&request.MultiExtractor{
-			request.OAuth2Extractor,
+			request.AuthorizationHeaderExtractor,
 			cookieExtractor,
 		},
 	)
 	if err == nil {
-		client.User.
-			UpdateOneID(userID).
-			ClearRefreshToken().
-			Save(ctx)
-
-		disconnect(userID)
+		client.Session.
+			Delete().
+			Where(
+				session.ID(claims.SessionID),
+				session.UserID(claims.UserID),
+			).
+			Exec(ctx)
+
+		disconnectSession(claims.SessionID)
 	}
 
 	c.SetSameSite(http.SameSiteNoneMode)
@@ -243,61 +345,115 @@ func (*Controller) SignOut(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
-var key *ecdsa.PrivateKey
-
-func init() {
-	b, err := os.ReadFile("disgord.pem")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	key, err = jwt.ParseECPrivateKeyFromPEM(b)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 type Claims struct {
-	UserID int `json:"userId"`
+	UserID    int `json:"userId"`
+	SessionID int `json:"sessionId"`
 	jwt.RegisteredClaims
 }
 
+// JWTAuthMiddleware authenticates the requests with an access token, or with a
+// personal access token, which also limits the routes to its scopes. Requests
+// of suspended users are refused even if the token is still valid.
 func (*Controller) JWTAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID, err := extractUserID(c.Request, request.OAuth2Extractor)
+		currentUser, err := authenticate(c)
 		if err != nil {
 			c.Status(http.StatusUnauthorized)
 			c.Abort()
 			return
 		}
 
-		c.Set("userID", userID)
+		if refuseSuspended(c, currentUser) {
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
 }
 
+// authenticate returns the user of the access token or personal access token
+// of the request, and sets the user and session of the request. Access tokens
+// of revoked sessions are refused.
+func authenticate(c *gin.Context) (*ent.User, error) {
+	token, _ := request.AuthorizationHeaderExtractor.ExtractToken(c.Request)
+	if isPersonalAccessToken(token) {
+		personalAccessToken, err := authenticatePersonalAccessToken(token)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Set("userID", personalAccessToken.UserID)
+		c.Set("sessionID", personalAccessTokenSessionID(personalAccessToken.ID))
+		c.Set("scopes", personalAccessToken.Scopes)
+	} else {
+		claims, err := extractClaims(c.Request, request.AuthorizationHeaderExtractor)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = client.Session.
+			Query().
+			Where(
+				session.ID(claims.SessionID),
+				session.UserID(claims.UserID),
+			).
+			Only(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
+	}
+
+	return getCurrentUser(c)
+}
+
 func getCurrentUserID(c *gin.Context) int {
 	userID, _ := c.Get("userID")
 	return userID.(int)
 }
 
-func issueToken(userID int) (string, string, error) {
+func getCurrentSessionID(c *gin.Context) int {
+	sessionID, _ := c.Get("sessionID")
+	return sessionID.(int)
+}
+
+// getOptionalUserID returns the ID of the user signed in on a public route, or 0
+// if the request is not signed in or would be refused on a private route.
+func getOptionalUserID(c *gin.Context) int {
+	if c.GetHeader("Authorization") == "" {
+		return 0
+	}
+
+	currentUser, err := authenticate(c)
+	if err != nil || currentUser.Suspended {
+		return 0
+	}
+
+	return currentUser.ID
+}
+
+func issueToken(userID, sessionID int) (string, string, error) {
 	claims := Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Minute * 30))
-	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	accessToken, err := signToken(claims)
 	if err != nil {
 		return "", "", err
 	}
 
-	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * 14))
-	refreshToken, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	// Unique ID keeps every refresh token distinct within the token family.
+	claims.ID = randomToken(16)
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(refreshTokenLifetime))
+	refreshToken, err := signToken(claims)
 	if err != nil {
 		return "", "", err
 	}
@@ -305,6 +461,109 @@ func issueToken(userID int) (string, string, error) {
 	return accessToken, refreshToken, nil
 }
 
+// refreshTokenLifetime is how long a refresh token can be exchanged for a new
+// token pair.
+const refreshTokenLifetime = time.Hour * 24 * 14
+
+// scheduleRefreshTokenPruning deletes the rotated refresh tokens in the
+// background once they expire, since an expired token cannot be replayed
+// anyway. The tokens of revoked token families are deleted along with their
+// sessions.
+func scheduleRefreshTokenPruning() {
+	go func() {
+		for {
+			_, err := client.RefreshToken.
+				Delete().
+				Where(
+					refreshtoken.RotatedAtNotNil(),
+					refreshtoken.CreatedAtLT(time.Now().Add(-refreshTokenLifetime)),
+				).
+				Exec(ctx)
+			if err != nil {
+				log.Println(err)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// issueSessionToken issues a token pair for the session and records the refresh
+// token in the token family of the session, as a child of parent if any.
+func issueSessionToken(tx *ent.Tx, userID, sessionID int, parent *ent.RefreshToken) (string, string, error) {
+	accessToken, refreshToken, err := issueToken(userID, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshTokenCreate := tx.RefreshToken.
+		Create().
+		SetSessionID(sessionID).
+		SetToken(hashToken(refreshToken))
+	if parent != nil {
+		refreshTokenCreate = refreshTokenCreate.SetParentID(parent.ID)
+	}
+
+	if err := refreshTokenCreate.Exec(ctx); err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// createSession signs the user in on a new device.
+func createSession(tx *ent.Tx, c *gin.Context, userID int, deviceName string) (string, string, error) {
+	if deviceName == "" {
+		deviceName = c.Request.UserAgent()
+	}
+
+	session, err := tx.Session.
+		Create().
+		SetUserID(userID).
+		SetDeviceName(deviceName).
+		SetUserAgent(c.Request.UserAgent()).
+		SetIPAddress(c.ClientIP()).
+		Save(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	return issueSessionToken(tx, userID, session.ID, nil)
+}
+
+// challengeAudience marks the token proving the password was verified while
+// the second factor is still pending. It is never accepted as an access token.
+const challengeAudience = "sign-in-challenge"
+
+func issueChallengeToken(userID int) (string, error) {
+	claims := Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{challengeAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 5)),
+		},
+	}
+
+	return signToken(claims)
+}
+
+func parseChallengeToken(challengeToken string) (int, error) {
+	token, err := jwt.ParseWithClaims(
+		challengeToken,
+		&Claims{},
+		verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Name}),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience(challengeAudience),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return token.Claims.(*Claims).UserID, nil
+}
+
 func hashPassword(password string) string {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -319,6 +578,23 @@ func verifyPassword(hash, password string) bool {
 	return err == nil
 }
 
+// randomToken returns a URL-safe random string made of n random bytes.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken digests a refresh token before it is stored, so that a leaked
+// database does not leak usable tokens.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 var cookieExtractor = &CookieExtractor{}
 
 type CookieExtractor struct {
@@ -334,11 +610,11 @@ func (e *CookieExtractor) ExtractToken(req *http.Request) (string, error) {
 	return cookie.Value, nil
 }
 
-func extractUserID(req *http.Request, extractor request.Extractor) (int, error) {
+func extractClaims(req *http.Request, extractor request.Extractor) (*Claims, error) {
 	token, err := request.ParseFromRequest(
 		req,
 		extractor,
-		func(*jwt.Token) (interface{}, error) { return key.Public(), nil },
+		verificationKey,
 		request.WithClaims(&Claims{}),
 		request.WithParser(jwt.NewParser(
 			jwt.WithValidMethods([]string{jwt.SigningMethodES256.Name}),
@@ -346,8 +622,13 @@ func extractUserID(req *http.Request, extractor request.Extractor) (int, error)
 		)),
 	)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return token.Claims.(*Claims).UserID, nil
+	claims := token.Claims.(*Claims)
+	if len(claims.Audience) != 0 {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+
+	return claims, nil
 }
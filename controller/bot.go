@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateBot godoc
+//
+//	@Description	Bots cannot sign in with a password. Create personal access tokens for the bot at /users/me/bots/{id}/tokens.
+//	@Description	If displayName is not provided, it will be set to the username.
+//	@Tags			bot
+//	@Summary		create a bot owned by the current user
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateBot.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.User
+//	@Failure		401
+//	@Failure		409	"username already exists"
+//	@Router			/users/me/bots [post]
+func (*Controller) CreateBot(c *gin.Context) {
+	type Body struct {
+		Username    string `json:"username" binding:"required"`
+		DisplayName string `json:"displayName"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userCreate := client.User.
+		Create().
+		SetUsername(body.Username).
+		SetPassword(hashPassword(randomToken(32))).
+		SetBot(true).
+		SetOwnerID(getCurrentUserID(c)).
+		SetProfileColorIndex(generateProfileColorIndex(body.Username, 4))
+	if body.DisplayName != "" {
+		userCreate = userCreate.SetDisplayName(body.DisplayName)
+	} else {
+		userCreate = userCreate.SetDisplayName(body.Username)
+	}
+
+	bot, err := userCreate.Save(ctx)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "username already exists",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, bot)
+}
+
+// GetMyBots godoc
+//
+//	@Tags		bot
+//	@Summary	list bots owned by the current user
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.User
+//	@Failure	401
+//	@Router		/users/me/bots [get]
+func (*Controller) GetMyBots(c *gin.Context) {
+	bots, err := client.User.
+		Query().
+		Where(user.OwnerID(getCurrentUserID(c))).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, bots)
+}
+
+// DeleteBot godoc
+//
+//	@Description	The chatrooms of the bot are transferred, archived or deleted, as the server is configured to.
+//	@Tags			bot
+//	@Summary		delete a bot owned by the current user
+//	@Param			uri				path	controller.DeleteBot.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		404	"cannot find bot"
+//	@Router			/users/me/bots/{id} [delete]
+func (*Controller) DeleteBot(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	exists, err := tx.User.
+		Query().
+		Where(
+			user.ID(uri.ID),
+			user.OwnerID(getCurrentUserID(c)),
+		).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find bot",
+		})
+		return
+	}
+
+	released, err := releaseChatrooms(tx, uri.ID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = tx.User.
+		DeleteOneID(uri.ID).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	disconnect(uri.ID)
+	released.notify()
+
+	c.Status(http.StatusNoContent)
+}
+
+// CreateBotToken godoc
+//
+//	@Description	The token is shown only once. See /users/me/tokens for the scopes.
+//	@Tags			bot
+//	@Summary		create a personal access token for a bot owned by the current user
+//	@Param			uri				path	controller.CreateBotToken.Uri		true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.PersonalAccessTokenBody	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	controller.NewPersonalAccessToken
+//	@Failure		401
+//	@Failure		404	"cannot find bot"
+//	@Router			/users/me/bots/{id}/tokens [post]
+func (*Controller) CreateBotToken(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	bot, ok := getMyBot(c, uri.ID)
+	if !ok {
+		return
+	}
+
+	createPersonalAccessToken(c, bot.ID)
+}
+
+// GetBotTokens godoc
+//
+//	@Tags		bot
+//	@Summary	list personal access tokens of a bot owned by the current user
+//	@Param		uri				path	controller.GetBotTokens.Uri	true	"path"
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.PersonalAccessToken
+//	@Failure	401
+//	@Failure	404	"cannot find bot"
+//	@Router		/users/me/bots/{id}/tokens [get]
+func (*Controller) GetBotTokens(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	bot, ok := getMyBot(c, uri.ID)
+	if !ok {
+		return
+	}
+
+	getPersonalAccessTokens(c, bot.ID)
+}
+
+// DeleteBotToken godoc
+//
+//	@Tags		bot
+//	@Summary	revoke a personal access token of a bot owned by the current user
+//	@Param		uri				path	controller.DeleteBotToken.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	404	"cannot find bot or token"
+//	@Router		/users/me/bots/{id}/tokens/{tokenId} [delete]
+func (*Controller) DeleteBotToken(c *gin.Context) {
+	type Uri struct {
+		ID      int `uri:"id" binding:"required"`
+		TokenID int `uri:"tokenId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	bot, ok := getMyBot(c, uri.ID)
+	if !ok {
+		return
+	}
+
+	deletePersonalAccessToken(c, bot.ID, uri.TokenID)
+}
+
+// getMyBot responds with 404 unless the bot is owned by the current user.
+func getMyBot(c *gin.Context, botID int) (*ent.User, bool) {
+	bot, err := client.User.
+		Query().
+		Where(
+			user.ID(botID),
+			user.OwnerID(getCurrentUserID(c)),
+		).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find bot",
+		})
+		return nil, false
+	}
+
+	return bot, true
+}
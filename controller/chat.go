@@ -3,6 +3,7 @@ package controller
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"disgord/ent"
 	"disgord/ent/chat"
@@ -15,6 +16,12 @@ import (
 // GetAllChats godoc
 //
 //	@Description	It supports latest-first paging by offset and limit, and returns in oldest-first order.
+//	@Description	Chats sent by the users the current user blocked are left out.
+//	@Description	Without parentId, thread replies are left out, and each chat comes with the reply count and last activity of its thread.
+//	@Description	Each chat comes with the count of each emoji reacted with, and whether the current user reacted with it.
+//	@Description	With parentId, the replies in the thread of the chat are listed.
+//	@Description	Deleted chats that others replied to are kept as tombstones, with deletedAt and without the content.
+//	@Description	Only chats in the chatrooms the current user can see are listed.
 //	@Tags			chat
 //	@Summary		list all chats with the given query
 //	@Param			q				query	controller.GetAllChats.Query	true	"query"
@@ -22,11 +29,13 @@ import (
 //	@Security		BearerAuth
 //	@Success		200	{array}	controller.GetAllChats.Response
 //	@Failure		401
+//	@Failure		404	"cannot find chatroom"
 //	@Router			/chats [get]
 func (*Controller) GetAllChats(c *gin.Context) {
 	type Query struct {
 		ChatroomID int `form:"chatroomId"`
 		SenderID   int `form:"senderId"`
+		ParentID   int `form:"parentId"`
 		Offset     int `form:"offset"`
 		Limit      int `form:"limit"`
 	}
@@ -36,13 +45,56 @@ func (*Controller) GetAllChats(c *gin.Context) {
 		return
 	}
 
-	chatQuery := client.Chat.Query()
+	userID := getCurrentUserID(c)
+
+	if query.ChatroomID != 0 {
+		chatroom, err := client.Chatroom.Get(ctx, query.ChatroomID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "cannot find chatroom",
+			})
+			return
+		}
+
+		canSee, err := canSeeRoom(chatroom, userID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !canSee {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "cannot find chatroom",
+			})
+			return
+		}
+	}
+
+	blockedIDs, err := getBlockedIDs(client, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	chatQuery := client.Chat.
+		Query().
+		Where(
+			chat.SenderIDNotIn(blockedIDs...),
+			chat.HasChatroomWith(visibleChatroom(userID)),
+		)
 	if query.ChatroomID != 0 {
 		chatQuery = chatQuery.Where(chat.ChatroomID(query.ChatroomID))
 	}
 	if query.SenderID != 0 {
 		chatQuery = chatQuery.Where(chat.SenderID(query.SenderID))
 	}
+	if query.ParentID != 0 {
+		chatQuery = chatQuery.Where(chat.ParentID(query.ParentID))
+	} else {
+		chatQuery = chatQuery.Where(chat.ParentIDIsNil())
+	}
 
 	chatQuery = chatQuery.Order(chat.ByCreatedAt(sql.OrderDesc()))
 	if query.Offset != 0 {
@@ -67,18 +119,39 @@ func (*Controller) GetAllChats(c *gin.Context) {
 		chats[i], chats[j] = chats[j], chats[i]
 	}
 
+	threads, err := getThreads(chats)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	reactionCounts, err := getReactionCounts(chats, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
 	type Response struct {
 		*ent.Chat
-		Name  string `json:"displayName"`
-		Color uint8  `json:"profileColorIndex"`
+		Name           string          `json:"displayName"`
+		Color          uint8           `json:"profileColorIndex"`
+		ReplyCount     int             `json:"replyCount"`
+		LastActivityAt *time.Time      `json:"lastActivityAt,omitempty"`
+		Reactions      []ReactionCount `json:"reactions,omitempty"`
 	}
 
 	response := make([]Response, 0, len(chats))
 	for _, chat := range chats {
+		thread := threads[chat.ID]
 		response = append(response, Response{
-			Chat:  chat,
-			Name:  chat.Edges.Sender.DisplayName,
-			Color: chat.Edges.Sender.ProfileColorIndex,
+			Chat:           chat,
+			Name:           chat.Edges.Sender.DisplayName,
+			Color:          chat.Edges.Sender.ProfileColorIndex,
+			ReplyCount:     thread.replyCount,
+			LastActivityAt: thread.lastActivityAt,
+			Reactions:      reactionCounts[chat.ID],
 		})
 	}
 
@@ -87,15 +160,16 @@ func (*Controller) GetAllChats(c *gin.Context) {
 
 // GetChatByID godoc
 //
-//	@Tags		chat
-//	@Summary	get a single chat by id
-//	@Param		uri				path	controller.GetChatByID.Uri	true	"path"
-//	@Param		Authorization	header	string						true	"Bearer AccessToken"
-//	@Security	BearerAuth
-//	@Success	200	{object}	ent.Chat
-//	@Failure	401
-//	@Failure	404	"cannot find chat"
-//	@Router		/chats/{id} [get]
+//	@Description	Chats in the chatrooms the current user cannot see are not found.
+//	@Tags			chat
+//	@Summary		get a single chat by id
+//	@Param			uri				path	controller.GetChatByID.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Chat
+//	@Failure		401
+//	@Failure		404	"cannot find chat"
+//	@Router			/chats/{id} [get]
 func (*Controller) GetChatByID(c *gin.Context) {
 	type Uri struct {
 		ID int `uri:"id" binding:"required"`
@@ -106,7 +180,13 @@ func (*Controller) GetChatByID(c *gin.Context) {
 		return
 	}
 
-	chat, err := client.Chat.Get(ctx, uri.ID)
+	chat, err := client.Chat.
+		Query().
+		Where(
+			chat.ID(uri.ID),
+			chat.HasChatroomWith(visibleChatroom(getCurrentUserID(c))),
+		).
+		Only(ctx)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"message": "cannot find chat",
@@ -119,19 +199,26 @@ func (*Controller) GetChatByID(c *gin.Context) {
 
 // CreateChat godoc
 //
-//	@Tags		chat
-//	@Summary	create a new chat
-//	@Param		Authorization	header	string						true	"Bearer AccessToken"
-//	@Param		body			body	controller.CreateChat.Body	true	"Request body"
-//	@Security	BearerAuth
-//	@Success	201	{object}	ent.Chat
-//	@Failure	401
-//	@Router		/chats [post]
+//	@Description	With parentId, the chat is sent into the thread of the chat, which cannot be a thread reply itself.
+//	@Description	With replyToId, the chat is a reply to the chat.
+//	@Description	The users mentioned with @username receive MENTION, and so do those in the chatroom with @here, and everyone who can see it with @everyone.
+//	@Description	@here and @everyone require the mention everyone permission.
+//	@Tags			chat
+//	@Summary		create a new chat
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateChat.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.Chat
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or chat to reply to"
+//	@Router			/chats [post]
 func (*Controller) CreateChat(c *gin.Context) {
 	type Body struct {
 		ChatroomID int    `json:"chatroomId" binding:"required"`
-		SenderID   int    `json:"senderId" binding:"required"`
 		Content    string `json:"content" binding:"required"`
+		ParentID   int    `json:"parentId"`
+		ReplyToID  int    `json:"replyToId"`
 	}
 
 	var body Body
@@ -139,18 +226,62 @@ func (*Controller) CreateChat(c *gin.Context) {
 		return
 	}
 
-	chat, err := client.Chat.
-		Create().
-		SetChatroomID(body.ChatroomID).
-		SetSenderID(body.SenderID).
-		SetContent(body.Content).
-		Save(ctx)
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, body.ChatroomID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	role, ok := authorizeInRoom(c, tx, chatroom, PermissionSendText)
+	if !ok {
+		return
+	}
+
+	chat, err := saveChat(tx.Client(), body.ChatroomID, getCurrentUserID(c), body.Content, body.ParentID, body.ReplyToID)
+	if ent.IsNotFound(err) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chat to reply to",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	mentions, err := saveMentions(tx.Client(), chat, role.Permissions)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	sender, err := chat.QuerySender().Only(ctx)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	deliverMentions(mentions, chat, sender.DisplayName, sender.ProfileColorIndex)
+
 	c.JSON(http.StatusCreated, chat)
 }
 
@@ -196,7 +327,13 @@ func (*Controller) UpdateChat(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	chat, err := tx.Chat.Get(ctx, uri.ID)
+	chat, err := tx.Chat.
+		Query().
+		Where(
+			chat.ID(uri.ID),
+			chat.DeletedAtIsNil(),
+		).
+		Only(ctx)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"message": "cannot find chat",
@@ -213,7 +350,14 @@ func (*Controller) UpdateChat(c *gin.Context) {
 
 	chatUpdate := chat.Update()
 	if body.Content != "" {
-		chatUpdate = chatUpdate.SetContent(body.Content)
+		content, err := resolveEmojis(tx.Client(), chat.ChatroomID, body.Content)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		chatUpdate = chatUpdate.SetContent(content)
 	}
 
 	chat, err = chatUpdate.Save(ctx)
@@ -234,16 +378,17 @@ func (*Controller) UpdateChat(c *gin.Context) {
 
 // DeleteChat godoc
 //
-//	@Tags		chat
-//	@Summary	delete the chat
-//	@Param		uri				path	controller.DeleteChat.Uri	true	"path"
-//	@Param		Authorization	header	string						true	"Bearer AccessToken"
-//	@Security	BearerAuth
-//	@Success	204
-//	@Failure	401
-//	@Failure	403	"chat sender only"
-//	@Failure	404	"cannot find chat"
-//	@Router		/chats/{id} [delete]
+//	@Description	If the chat has thread replies or replies, it is left as a tombstone without the content.
+//	@Tags			chat
+//	@Summary		delete the chat
+//	@Param			uri				path	controller.DeleteChat.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chat"
+//	@Router			/chats/{id} [delete]
 func (*Controller) DeleteChat(c *gin.Context) {
 	type Uri struct {
 		ID int `uri:"id" binding:"required"`
@@ -264,7 +409,13 @@ func (*Controller) DeleteChat(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	chat, err := tx.Chat.Get(ctx, uri.ID)
+	chat, err := tx.Chat.
+		Query().
+		Where(
+			chat.ID(uri.ID),
+			chat.DeletedAtIsNil(),
+		).
+		Only(ctx)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"message": "cannot find chat",
@@ -272,17 +423,21 @@ func (*Controller) DeleteChat(c *gin.Context) {
 		return
 	}
 
+	// Moderators of the chatroom may delete the chats of others.
 	if chat.SenderID != userID {
-		c.JSON(http.StatusForbidden, gin.H{
-			"message": "chat sender only",
-		})
-		return
+		chatroom, err := chat.QueryChatroom().Only(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageChats); !ok {
+			return
+		}
 	}
 
-	err = tx.Chat.
-		DeleteOneID(uri.ID).
-		Exec(ctx)
-	if err != nil {
+	if err := deleteChat(tx, chat); err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
@@ -296,3 +451,144 @@ func (*Controller) DeleteChat(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// saveChat saves the chat sent to the chatroom, with the custom emojis in the
+// content resolved. parentID and replyToID are 0
+// unless the chat is sent into a thread or replies to a chat, which must be in
+// the same chatroom and not deleted. It returns a not found error otherwise.
+func saveChat(client *ent.Client, chatroomID, senderID int, content string, parentID, replyToID int) (*ent.Chat, error) {
+	content, err := resolveEmojis(client, chatroomID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	chatCreate := client.Chat.
+		Create().
+		SetChatroomID(chatroomID).
+		SetSenderID(senderID).
+		SetContent(content)
+
+	if parentID != 0 {
+		// Threads are not nested, so the parent cannot be a thread reply.
+		parent, err := client.Chat.
+			Query().
+			Where(
+				chat.ID(parentID),
+				chat.ChatroomID(chatroomID),
+				chat.ParentIDIsNil(),
+				chat.DeletedAtIsNil(),
+			).
+			Only(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		chatCreate = chatCreate.SetParentID(parent.ID)
+	}
+
+	if replyToID != 0 {
+		replyTo, err := client.Chat.
+			Query().
+			Where(
+				chat.ID(replyToID),
+				chat.ChatroomID(chatroomID),
+				chat.DeletedAtIsNil(),
+			).
+			Only(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		chatCreate = chatCreate.SetReplyToID(replyTo.ID)
+	}
+
+	return chatCreate.Save(ctx)
+}
+
+// deleteChat deletes the chat, or leaves a tombstone of it if other chats are
+// in its thread or reply to it.
+func deleteChat(tx *ent.Tx, deleted *ent.Chat) error {
+	hasReplies, err := tx.Chat.
+		Query().
+		Where(chat.Or(
+			chat.ParentID(deleted.ID),
+			chat.ReplyToID(deleted.ID),
+		)).
+		Exist(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !hasReplies {
+		return tx.Chat.
+			DeleteOne(deleted).
+			Exec(ctx)
+	}
+
+	return tx.Chat.
+		UpdateOne(deleted).
+		SetContent("").
+		SetDeletedAt(time.Now()).
+		Exec(ctx)
+}
+
+type thread struct {
+	replyCount     int
+	lastActivityAt *time.Time
+}
+
+// getThreads returns the threads of the chats, keyed by the chat ID. Chats
+// without thread replies are left out.
+func getThreads(chats []*ent.Chat) (map[int]thread, error) {
+	chatIDs := make([]int, 0, len(chats))
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+
+	var counts []struct {
+		ParentID    int `json:"parent_id"`
+		Count       int `json:"count"`
+		LastReplyID int `json:"max"`
+	}
+	err := client.Chat.
+		Query().
+		Where(chat.ParentIDIn(chatIDs...)).
+		GroupBy(chat.FieldParentID).
+		Aggregate(
+			ent.Count(),
+			ent.Max(chat.FieldID),
+		).
+		Scan(ctx, &counts)
+	if err != nil {
+		return nil, err
+	}
+
+	lastReplyIDs := make([]int, 0, len(counts))
+	for _, count := range counts {
+		lastReplyIDs = append(lastReplyIDs, count.LastReplyID)
+	}
+
+	lastReplies, err := client.Chat.
+		Query().
+		Where(chat.IDIn(lastReplyIDs...)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lastActivities := make(map[int]time.Time, len(lastReplies))
+	for _, reply := range lastReplies {
+		lastActivities[reply.ID] = reply.CreatedAt
+	}
+
+	threads := make(map[int]thread, len(counts))
+	for _, count := range counts {
+		lastActivityAt := lastActivities[count.LastReplyID]
+		threads[count.ParentID] = thread{
+			replyCount:     count.Count,
+			lastActivityAt: &lastActivityAt,
+		}
+	}
+
+	return threads, nil
+}
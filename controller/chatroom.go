@@ -4,23 +4,31 @@ import (
 	"log"
 	"net/http"
 
+	"disgord/ent"
 	"disgord/ent/chatroom"
+	"disgord/ent/guildmember"
 	"disgord/ent/user"
 
+	"entgo.io/ent/dialect/sql"
 	"github.com/gin-gonic/gin"
 )
 
 // GetAllChatrooms godoc
 //
-//	@Tags		chatroom
-//	@Summary	list all chatrooms with the given query
-//	@Param		q	query	controller.GetAllChatrooms.Query	true	"query"
-//	@Success	200	{array}	ent.Chatroom
-//	@Router		/chatrooms [get]
+//	@Description	Without guildId, it lists the top-level chatrooms. With guildId, it lists the channels of the guild in ascending order of position, only to its members.
+//	@Description	Signed in, every chatroom comes with the read state of the current user. Chatrooms never marked as read are unread from the first chat.
+//	@Tags			chatroom
+//	@Summary		list all chatrooms with the given query
+//	@Param			q				query	controller.GetAllChatrooms.Query	true	"query"
+//	@Param			Authorization	header	string								false	"Bearer AccessToken"
+//	@Success		200				{array}	controller.GetAllChatrooms.Response
+//	@Failure		403				"not a member of the guild"
+//	@Router			/chatrooms [get]
 func (*Controller) GetAllChatrooms(c *gin.Context) {
 	type Query struct {
 		OwnerID  int `form:"ownerId"`
 		MemberID int `form:"memberId"`
+		GuildID  int `form:"guildId"`
 	}
 
 	var query Query
@@ -28,7 +36,39 @@ func (*Controller) GetAllChatrooms(c *gin.Context) {
 		return
 	}
 
+	userID := getOptionalUserID(c)
+
 	chatroomQuery := client.Chatroom.Query()
+	if query.GuildID != 0 {
+		isMember, err := client.GuildMember.
+			Query().
+			Where(
+				guildmember.GuildID(query.GuildID),
+				guildmember.UserID(userID),
+			).
+			Exist(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !isMember {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "not a member of the guild",
+			})
+			return
+		}
+
+		chatroomQuery = chatroomQuery.
+			Where(chatroom.GuildID(query.GuildID)).
+			Order(
+				chatroom.ByPosition(sql.OrderAsc()),
+				chatroom.ByID(sql.OrderAsc()),
+			)
+	} else {
+		chatroomQuery = chatroomQuery.Where(chatroom.GuildIDIsNil())
+	}
 	if query.OwnerID != 0 {
 		chatroomQuery = chatroomQuery.Where(chatroom.OwnerID(query.OwnerID))
 	}
@@ -43,20 +83,49 @@ func (*Controller) GetAllChatrooms(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, chatrooms)
+	readStates := make(map[int]*RoomReadState)
+	if userID != 0 {
+		chatroomIDs := make([]int, 0, len(chatrooms))
+		for _, chatroom := range chatrooms {
+			chatroomIDs = append(chatroomIDs, chatroom.ID)
+		}
+
+		readStates, err = getRoomReadStates(userID, chatroomIDs)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	type Response struct {
+		*ent.Chatroom
+		ReadState *RoomReadState `json:"readState,omitempty"`
+	}
+
+	response := make([]Response, 0, len(chatrooms))
+	for _, chatroom := range chatrooms {
+		response = append(response, Response{
+			Chatroom:  chatroom,
+			ReadState: readStates[chatroom.ID],
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // GetChatroomByID godoc
 //
-//	@Tags		chatroom
-//	@Summary	get a single chatroom by id
-//	@Param		uri				path	controller.GetChatroomByID.Uri	true	"path"
-//	@Param		Authorization	header	string							true	"Bearer AccessToken"
-//	@Security	BearerAuth
-//	@Success	200	{object}	ent.Chatroom
-//	@Failure	401
-//	@Failure	404	"cannot find chatroom"
-//	@Router		/chatrooms/{id} [get]
+//	@Description	A channel of a guild is found by the members of the guild only.
+//	@Tags			chatroom
+//	@Summary		get a single chatroom by id
+//	@Param			uri				path	controller.GetChatroomByID.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Chatroom
+//	@Failure		401
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id} [get]
 func (*Controller) GetChatroomByID(c *gin.Context) {
 	type Uri struct {
 		ID int `uri:"id" binding:"required"`
@@ -75,6 +144,28 @@ func (*Controller) GetChatroomByID(c *gin.Context) {
 		return
 	}
 
+	if chatroom.GuildID != 0 {
+		isMember, err := client.GuildMember.
+			Query().
+			Where(
+				guildmember.GuildID(chatroom.GuildID),
+				guildmember.UserID(getCurrentUserID(c)),
+			).
+			Exist(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !isMember {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "cannot find chatroom",
+			})
+			return
+		}
+	}
+
 	c.JSON(http.StatusOK, chatroom)
 }
 
@@ -91,8 +182,9 @@ func (*Controller) GetChatroomByID(c *gin.Context) {
 //	@Router		/chatrooms [post]
 func (*Controller) CreateChatroom(c *gin.Context) {
 	type Body struct {
-		Name     string `json:"name" binding:"required"`
-		Password string `json:"password"`
+		Name     string        `json:"name" binding:"required"`
+		Type     chatroom.Type `json:"type" binding:"omitempty,oneof=text voice stage" enums:"text,voice,stage"`
+		Password string        `json:"password"`
 	}
 
 	var body Body
@@ -123,6 +215,9 @@ func (*Controller) CreateChatroom(c *gin.Context) {
 		SetName(body.Name).
 		SetOwnerID(userID).
 		SetProfileColorIndex(user.ProfileColorIndex)
+	if body.Type != "" {
+		chatroomCreate = chatroomCreate.SetType(body.Type)
+	}
 	if body.Password != "" {
 		chatroomCreate = chatroomCreate.
 			SetIsPrivate(true).
@@ -143,14 +238,16 @@ func (*Controller) CreateChatroom(c *gin.Context) {
 		return
 	}
 
-	broadcastToAll(&Message{Action: RoomListUpdatedAction})
+	roomListUpdated(0)
 
 	c.JSON(http.StatusCreated, chatroom)
 }
 
 // UpdateChatroom godoc
 //
-//	@Description	If password is not provided, it will be public, i.e. clear the password and the member list.
+//	@Description	If password is empty, it will be public, i.e. clear the password and the member list. If it is not provided, the chatroom stays private or public.
+//	@Description	A chatroom made private is joined by its owner.
+//	@Description	Position and category only apply to the channels of a guild, and a categoryId of 0 takes the channel out of its category.
 //	@Tags			chatroom
 //	@Summary		update the chatroom
 //	@Param			uri				path	controller.UpdateChatroom.Uri	true	"uri"
@@ -159,8 +256,8 @@ func (*Controller) CreateChatroom(c *gin.Context) {
 //	@Security		BearerAuth
 //	@Success		200	{object}	ent.Chatroom
 //	@Failure		401
-//	@Failure		403	"chatroom owner only"
-//	@Failure		404	"cannot find chatroom"
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or category"
 //	@Router			/chatrooms/{id} [patch]
 func (*Controller) UpdateChatroom(c *gin.Context) {
 	type Uri struct {
@@ -173,8 +270,11 @@ func (*Controller) UpdateChatroom(c *gin.Context) {
 	}
 
 	type Body struct {
-		Name     string `json:"name"`
-		Password string `json:"password"`
+		Name       string        `json:"name"`
+		Type       chatroom.Type `json:"type" binding:"omitempty,oneof=text voice stage" enums:"text,voice,stage"`
+		Position   *int          `json:"position"`
+		CategoryID *int          `json:"categoryId"`
+		Password   *string       `json:"password"`
 	}
 
 	var body Body
@@ -182,14 +282,13 @@ func (*Controller) UpdateChatroom(c *gin.Context) {
 		return
 	}
 
-	userID := getCurrentUserID(c)
-
 	tx, err := client.Tx(ctx)
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
+	defer tx.Rollback()
 
 	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
 	if err != nil {
@@ -199,10 +298,7 @@ func (*Controller) UpdateChatroom(c *gin.Context) {
 		return
 	}
 
-	if chatroom.OwnerID != userID {
-		c.JSON(http.StatusForbidden, gin.H{
-			"message": "chatroom owner only",
-		})
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom); !ok {
 		return
 	}
 
@@ -210,15 +306,37 @@ func (*Controller) UpdateChatroom(c *gin.Context) {
 	if body.Name != "" {
 		chatroomUpdate = chatroomUpdate.SetName(body.Name)
 	}
-	if body.Password != "" {
-		chatroomUpdate = chatroomUpdate.SetPassword(hashPassword(body.Password))
+	if body.Type != "" {
+		chatroomUpdate = chatroomUpdate.SetType(body.Type)
+	}
+	if chatroom.GuildID != 0 {
+		chatroomUpdate = chatroomUpdate.SetNillablePosition(body.Position)
+
+		if body.CategoryID != nil {
+			if !findGuildCategory(c, tx, chatroom.GuildID, *body.CategoryID) {
+				return
+			}
+
+			if *body.CategoryID != 0 {
+				chatroomUpdate = chatroomUpdate.SetCategoryID(*body.CategoryID)
+			} else {
+				chatroomUpdate = chatroomUpdate.ClearCategoryID()
+			}
+		}
+	}
+	if body.Password != nil && *body.Password != "" {
+		chatroomUpdate = chatroomUpdate.SetPassword(hashPassword(*body.Password))
 
 		if !chatroom.IsPrivate {
-			chatroomUpdate = chatroomUpdate.
-				SetIsPrivate(true).
-				AddMemberIDs(userID)
+			chatroomUpdate = chatroomUpdate.SetIsPrivate(true)
+
+			// The owner of a channel is the owner of the guild, who is let
+			// in regardless.
+			if chatroom.GuildID == 0 && chatroom.OwnerID != 0 {
+				chatroomUpdate = chatroomUpdate.AddMemberIDs(chatroom.OwnerID)
+			}
 		}
-	} else {
+	} else if body.Password != nil {
 		chatroomUpdate = chatroomUpdate.
 			SetIsPrivate(false).
 			ClearPassword().
@@ -238,23 +356,29 @@ func (*Controller) UpdateChatroom(c *gin.Context) {
 		return
 	}
 
-	broadcastToAll(&Message{Action: RoomListUpdatedAction})
+	// Changing the type or the privacy changes what everyone in the room may
+	// do.
+	if body.Type != "" || body.Password != nil {
+		refreshRoomRoles(chatroom.ID)
+	}
+	roomListUpdated(chatroom.GuildID)
 
 	c.JSON(http.StatusOK, chatroom)
 }
 
 // DeleteChatroom godoc
 //
-//	@Tags		chatroom
-//	@Summary	delete the chatroom and all chats in it
-//	@Param		uri				path	controller.DeleteChatroom.Uri	true	"uri"
-//	@Param		Authorization	header	string							true	"Bearer AccessToken"
-//	@Security	BearerAuth
-//	@Success	204
-//	@Failure	401
-//	@Failure	403	"chatroom owner only"
-//	@Failure	404	"cannot find chatroom"
-//	@Router		/chatrooms/{id} [delete]
+//	@Description	A channel of a guild may be deleted by a moderator of the guild.
+//	@Tags			chatroom
+//	@Summary		delete the chatroom and all chats in it
+//	@Param			uri				path	controller.DeleteChatroom.Uri	true	"uri"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"chatroom owner only, or not allowed in the guild"
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id} [delete]
 func (*Controller) DeleteChatroom(c *gin.Context) {
 	type Uri struct {
 		ID int `uri:"id" binding:"required"`
@@ -283,7 +407,18 @@ func (*Controller) DeleteChatroom(c *gin.Context) {
 		return
 	}
 
-	if chatroom.OwnerID != userID {
+	if chatroom.GuildID != 0 {
+		guild, err := tx.Guild.Get(ctx, chatroom.GuildID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+			return
+		}
+	} else if chatroom.OwnerID != userID {
 		c.JSON(http.StatusForbidden, gin.H{
 			"message": "chatroom owner only",
 		})
@@ -307,7 +442,7 @@ func (*Controller) DeleteChatroom(c *gin.Context) {
 	}
 
 	kickAllClientsFromRoom(uri.ID)
-	broadcastToAll(&Message{Action: RoomListUpdatedAction})
+	roomListUpdated(chatroom.GuildID)
 
 	c.Status(http.StatusNoContent)
 }
@@ -315,7 +450,8 @@ func (*Controller) DeleteChatroom(c *gin.Context) {
 // JoinChatroom godoc
 //
 //	@Description	If the chatroom is public or the user is already a member of the private chatroom, it will ignore the password.
-//	@Description	Otherwise, the user must provide the password to join.
+//	@Description	Otherwise, the user must provide the password to join. Users banned from the chatroom cannot join at all.
+//	@Description	Only the members of a guild may join its channels.
 //	@Tags			chatroom
 //	@Summary		join the chatroom, with password if it is private
 //	@Param			uri				path	controller.JoinChatroom.Uri		true	"uri"
@@ -324,8 +460,9 @@ func (*Controller) DeleteChatroom(c *gin.Context) {
 //	@Security		BearerAuth
 //	@Success		200
 //	@Failure		401
-//	@Failure		403	"not a member of the chatroom, password required"
+//	@Failure		403	"not a member of the chatroom, password required, not a member of the guild, banned from the chatroom, or chatroom archived"
 //	@Failure		404	"cannot find chatroom"
+//	@Failure		429	"too many failed attempts, retry later"
 //	@Router			/chatrooms/{id}/join [post]
 func (*Controller) JoinChatroom(c *gin.Context) {
 	type Uri struct {
@@ -366,6 +503,43 @@ func (*Controller) JoinChatroom(c *gin.Context) {
 		return
 	}
 
+	if chatroom.ArchivedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "chatroom archived",
+		})
+		return
+	}
+
+	if chatroom.GuildID != 0 {
+		isMember, err := isGuildMember(tx, chatroom.GuildID, userID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !isMember {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "not a member of the guild",
+			})
+			return
+		}
+	}
+
+	banned, err := isBannedFromRoom(tx, chatroom.ID, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if banned {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "banned from the chatroom",
+		})
+		return
+	}
+
 	if chatroom.IsPrivate {
 		_, err = chatroom.QueryMembers().
 			Where(user.ID(userID)).
@@ -378,6 +552,12 @@ func (*Controller) JoinChatroom(c *gin.Context) {
 				return
 			}
 
+			keys := []string{ipKey(c.ClientIP()), chatroomKey(uri.ID)}
+			if wait := limiter.Wait(keys...); wait > 0 {
+				retryLater(c, wait)
+				return
+			}
+
 			if !verifyPassword(chatroom.Password, body.Password) {
 				c.JSON(http.StatusForbidden, gin.H{
 					"message": "incorrect password",
@@ -385,6 +565,9 @@ func (*Controller) JoinChatroom(c *gin.Context) {
 				return
 			}
 
+			limiter.Release(ipKey(c.ClientIP()))
+			limiter.Reset(chatroomKey(uri.ID))
+
 			_, err = chatroom.Update().
 				AddMemberIDs(userID).
 				Save(ctx)
@@ -396,13 +579,20 @@ func (*Controller) JoinChatroom(c *gin.Context) {
 		}
 	}
 
+	role, err := getRoomRole(tx, chatroom, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	joinRoom(uri.ID, userID, *body.Muted, *body.CamOn)
+	joinRoom(uri.ID, chatroom.GuildID, getCurrentSessionID(c), *body.Muted, *body.CamOn, role)
 
 	c.Status(http.StatusOK)
 }
@@ -0,0 +1,373 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/chatroomban"
+	"disgord/ent/predicate"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// KickFromChatroom godoc
+//
+//	@Description	It requires the kick permission, and only kicks users below the role of the current user.
+//	@Description	The user receives KICKED and may join again.
+//	@Tags			chatroom
+//	@Summary		kick a user out of the chatroom
+//	@Param			uri				path	controller.KickFromChatroom.Uri		true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.KickFromChatroom.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or user in it"
+//	@Router			/chatrooms/{id}/kick [post]
+func (*Controller) KickFromChatroom(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		UserID int `json:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if !authorizeKick(c, tx, chatroom, body.UserID) {
+		return
+	}
+
+	if !kickFromRoom(chatroom.ID, body.UserID, "") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user in the chatroom",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetChatroomBans godoc
+//
+//	@Description	It requires the kick permission. Expired bans are not listed.
+//	@Tags			chatroom
+//	@Summary		list users banned from the chatroom
+//	@Param			uri				path	controller.GetChatroomBans.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	ent.ChatroomBan
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id}/bans [get]
+func (*Controller) GetChatroomBans(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionKick); !ok {
+		return
+	}
+
+	bans, err := tx.ChatroomBan.
+		Query().
+		Where(
+			chatroomban.ChatroomID(chatroom.ID),
+			activeChatroomBan(),
+		).
+		Order(chatroomban.ByCreatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, bans)
+}
+
+// BanFromChatroom godoc
+//
+//	@Description	It requires the kick permission, and only bans users below the role of the current user.
+//	@Description	The user is kicked, removed from the members of the private chatroom, and cannot join again even with the password.
+//	@Description	The ban expires at expiresAt, or lasts until lifted without it. Banning the user again replaces the ban.
+//	@Tags			chatroom
+//	@Summary		ban a user from the chatroom
+//	@Param			uri				path	controller.BanFromChatroom.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.BanFromChatroom.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.ChatroomBan
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or user"
+//	@Router			/chatrooms/{id}/bans/{userId} [put]
+func (*Controller) BanFromChatroom(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	type Body struct {
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expiresAt" binding:"omitempty,gt"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if !authorizeKick(c, tx, chatroom, uri.UserID) {
+		return
+	}
+
+	ban, err := banFromRoom(tx, chatroom.ID, uri.UserID, getCurrentUserID(c), body.Reason, body.ExpiresAt)
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickFromRoom(chatroom.ID, uri.UserID, body.Reason)
+
+	c.JSON(http.StatusOK, ban)
+}
+
+// UnbanFromChatroom godoc
+//
+//	@Description	It requires the kick permission. The user must join with the password again if the chatroom is private.
+//	@Tags			chatroom
+//	@Summary		lift the ban of a user from the chatroom
+//	@Param			uri				path	controller.UnbanFromChatroom.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or ban"
+//	@Router			/chatrooms/{id}/bans/{userId} [delete]
+func (*Controller) UnbanFromChatroom(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionKick); !ok {
+		return
+	}
+
+	n, err := tx.ChatroomBan.
+		Delete().
+		Where(
+			chatroomban.ChatroomID(chatroom.ID),
+			chatroomban.UserID(uri.UserID),
+			activeChatroomBan(),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find ban",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeKick responds with 403 unless the current user may kick the user
+// out of the chatroom.
+func authorizeKick(c *gin.Context, tx *ent.Tx, chatroom *ent.Chatroom, userID int) bool {
+	current, ok := authorizeInRoom(c, tx, chatroom, PermissionKick)
+	if !ok {
+		return false
+	}
+
+	target, err := getRoomRole(tx, chatroom, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+
+	if !outranksInRoom(current, target.Role) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the chatroom",
+		})
+		return false
+	}
+
+	return true
+}
+
+// banFromRoom bans the user from the chatroom in place of an earlier ban, and
+// removes the user from the members of the chatroom.
+func banFromRoom(tx *ent.Tx, chatroomID, userID, issuerID int, reason string, expiresAt *time.Time) (*ent.ChatroomBan, error) {
+	_, err := tx.ChatroomBan.
+		Delete().
+		Where(
+			chatroomban.ChatroomID(chatroomID),
+			chatroomban.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ban, err := tx.ChatroomBan.
+		Create().
+		SetChatroomID(chatroomID).
+		SetUserID(userID).
+		SetIssuerID(issuerID).
+		SetReason(reason).
+		SetNillableExpiresAt(expiresAt).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Chatroom.
+		UpdateOneID(chatroomID).
+		RemoveMemberIDs(userID).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ban, nil
+}
+
+func isBannedFromRoom(tx *ent.Tx, chatroomID, userID int) (bool, error) {
+	return tx.ChatroomBan.
+		Query().
+		Where(
+			chatroomban.ChatroomID(chatroomID),
+			chatroomban.UserID(userID),
+			activeChatroomBan(),
+		).
+		Exist(ctx)
+}
+
+func activeChatroomBan() predicate.ChatroomBan {
+	return chatroomban.Or(
+		chatroomban.ExpiresAtIsNil(),
+		chatroomban.ExpiresAtGT(time.Now()),
+	)
+}
@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/chatroomrole"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetChatroomRoles godoc
+//
+//	@Description	Users not listed are members, except the owner of the chatroom.
+//	@Tags			chatroom
+//	@Summary		list users given a role in the chatroom
+//	@Param			uri				path	controller.GetChatroomRoles.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.RoomRole
+//	@Failure		401
+//	@Router			/chatrooms/{id}/roles [get]
+func (*Controller) GetChatroomRoles(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	chatroomRoles, err := client.ChatroomRole.
+		Query().
+		Where(chatroomrole.ChatroomID(uri.ID)).
+		Order(chatroomrole.ByCreatedAt(sql.OrderAsc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roles := make([]RoomRole, 0, len(chatroomRoles))
+	for _, chatroomRole := range chatroomRoles {
+		roles = append(roles, newRoomRole(chatroomRole))
+	}
+
+	c.JSON(http.StatusOK, roles)
+}
+
+// GetChatroomRole godoc
+//
+//	@Description	Permissions is a bitset of 1: send text, 2: speak, 4: video, 8: screen share, 16: kick, 32: manage chats, 64: manage room, 128: invite, 256: mention everyone.
+//	@Tags			chatroom
+//	@Summary		get the role of a user in the chatroom
+//	@Param			uri				path	controller.GetChatroomRole.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.RoomRole
+//	@Failure		401
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id}/roles/{userId} [get]
+func (*Controller) GetChatroomRole(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	role, err := getRoomRole(tx, chatroom, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, role)
+}
+
+// UpdateChatroomRole godoc
+//
+//	@Description	It requires the manage room permission, and only manages users below the role of the current user.
+//	@Description	If permissions is provided, it overrides the permissions of the role for the user, within the permissions of the current user.
+//	@Tags			chatroom
+//	@Summary		give a user a role in the chatroom
+//	@Param			uri				path	controller.UpdateChatroomRole.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.UpdateChatroomRole.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.RoomRole
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or user"
+//	@Router			/chatrooms/{id}/roles/{userId} [put]
+func (*Controller) UpdateChatroomRole(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	type Body struct {
+		Role        chatroomrole.Role `json:"role" binding:"required,oneof=moderator member guest" enums:"moderator,member,guest"`
+		Permissions *Permission       `json:"permissions"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	current, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom)
+	if !ok {
+		return
+	}
+
+	target, err := getRoomRole(tx, chatroom, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !outranksInRoom(current, target.Role) || !outranksInRoom(current, body.Role) ||
+		body.Permissions != nil && !current.Permissions.Has(*body.Permissions) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the chatroom",
+		})
+		return
+	}
+
+	var permissions *uint32
+	if body.Permissions != nil {
+		permissions = new(uint32)
+		*permissions = uint32(*body.Permissions)
+	}
+
+	chatroomRoleUpdate := tx.ChatroomRole.
+		Update().
+		Where(
+			chatroomrole.ChatroomID(chatroom.ID),
+			chatroomrole.UserID(uri.UserID),
+		).
+		SetRole(body.Role)
+	if permissions != nil {
+		chatroomRoleUpdate = chatroomRoleUpdate.SetPermissions(*permissions)
+	} else {
+		chatroomRoleUpdate = chatroomRoleUpdate.ClearPermissions()
+	}
+
+	n, err := chatroomRoleUpdate.Save(ctx)
+	if err == nil && n == 0 {
+		err = tx.ChatroomRole.
+			Create().
+			SetChatroomID(chatroom.ID).
+			SetUserID(uri.UserID).
+			SetRole(body.Role).
+			SetNillablePermissions(permissions).
+			Exec(ctx)
+	}
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	role, err := getRoomRole(tx, chatroom, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	updateRoomRole(chatroom.ID, role)
+
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteChatroomRole godoc
+//
+//	@Description	It requires the manage room permission, and only manages users below the role of the current user.
+//	@Tags			chatroom
+//	@Summary		make a user a member of the chatroom again
+//	@Param			uri				path	controller.DeleteChatroomRole.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id}/roles/{userId} [delete]
+func (*Controller) DeleteChatroomRole(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	current, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom)
+	if !ok {
+		return
+	}
+
+	target, err := getRoomRole(tx, chatroom, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !outranksInRoom(current, target.Role) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the chatroom",
+		})
+		return
+	}
+
+	_, err = tx.ChatroomRole.
+		Delete().
+		Where(
+			chatroomrole.ChatroomID(chatroom.ID),
+			chatroomrole.UserID(uri.UserID),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	role, err := getRoomRole(tx, chatroom, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	updateRoomRole(chatroom.ID, role)
+
+	c.Status(http.StatusNoContent)
+}
+
+// outranksInRoom reports whether the role may manage the target role.
+func outranksInRoom(role RoomRole, target chatroomrole.Role) bool {
+	return roomRoleRanks[role.Role] > roomRoleRanks[target]
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings that differ between deployments, read from the
+// environment with defaults for local development.
+var config = struct {
+	// URL of the web client, which links in mails point to.
+	AppURL string
+
+	// Origins of the web client allowed to connect to the WebSocket.
+	WSOrigins []string
+
+	// WebAuthn relying party, i.e. the domain of the web client.
+	RPID      string
+	RPOrigins []string
+
+	// Mails are sent through the SMTP server if SMTPAddr is set, otherwise
+	// written to MailFile, or to the log if MailFile is not set either.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailFile     string
+
+	// OpenID Connect provider to sign in with, disabled if OIDCIssuer is
+	// empty. OIDCRedirectURL must point to /auth/oidc/callback of this server.
+	// Users signing in for the first time are linked to the user with the same
+	// verified email address, or created from the claims if
+	// OIDCAutoProvision is set.
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCScopes        []string
+	OIDCUsernameClaim string
+	OIDCAutoProvision bool
+
+	// How often to lift the suspensions that expired.
+	SuspensionCheckInterval time.Duration
+
+	// What becomes of the chatrooms and guilds of deleted users: transfer to
+	// the longest-standing moderator or member, archiving if there is none,
+	// archive, or delete along with all chats in them.
+	OwnerDeletionPolicy string
+
+	// Most users in a group conversation, including whoever started it.
+	GroupConversationMaxUsers int
+
+	// Users are idle when none of their connections has sent anything for
+	// IdleTimeout. Idleness and expired custom statuses are checked every
+	// PresenceCheckInterval.
+	IdleTimeout           time.Duration
+	PresenceCheckInterval time.Duration
+
+	// Uploaded files are stored under FileDir.
+	FileDir string
+
+	// Largest image in bytes, and most custom emojis, of a chatroom or guild.
+	EmojiMaxSize  int
+	EmojiMaxCount int
+
+	// Failed attempts to guess a password are free up to RateLimitFreeFailures
+	// within RateLimitWindow, then each further failure locks the attempts out
+	// for twice as long as the previous one, from RateLimitBaseDelay up to
+	// RateLimitMaxDelay. RateLimitStore is either memory or sqlite.
+	RateLimitFreeFailures int
+	RateLimitWindow       time.Duration
+	RateLimitBaseDelay    time.Duration
+	RateLimitMaxDelay     time.Duration
+	RateLimitStore        string
+}{
+	AppURL: getenv("DISGORD_APP_URL", "http://localhost:5173"),
+
+	WSOrigins: getenvList("DISGORD_WS_ORIGINS", "http://localhost:5173"),
+
+	RPID:      getenv("DISGORD_RP_ID", "localhost"),
+	RPOrigins: getenvList("DISGORD_RP_ORIGINS", "http://localhost:5173"),
+
+	SMTPAddr:     getenv("DISGORD_SMTP_ADDR", ""),
+	SMTPUsername: getenv("DISGORD_SMTP_USERNAME", ""),
+	SMTPPassword: getenv("DISGORD_SMTP_PASSWORD", ""),
+	MailFrom:     getenv("DISGORD_MAIL_FROM", "disgord@localhost"),
+	MailFile:     getenv("DISGORD_MAIL_FILE", ""),
+
+	OIDCIssuer:        getenv("DISGORD_OIDC_ISSUER", ""),
+	OIDCClientID:      getenv("DISGORD_OIDC_CLIENT_ID", ""),
+	OIDCClientSecret:  getenv("DISGORD_OIDC_CLIENT_SECRET", ""),
+	OIDCRedirectURL:   getenv("DISGORD_OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback"),
+	OIDCScopes:        getenvList("DISGORD_OIDC_SCOPES", "openid,profile,email"),
+	OIDCUsernameClaim: getenv("DISGORD_OIDC_USERNAME_CLAIM", "preferred_username"),
+	OIDCAutoProvision: getenvBool("DISGORD_OIDC_AUTO_PROVISION", true),
+
+	SuspensionCheckInterval: getenvDuration("DISGORD_SUSPENSION_CHECK_INTERVAL", time.Minute),
+
+	OwnerDeletionPolicy: getenv("DISGORD_OWNER_DELETION_POLICY", "transfer"),
+
+	GroupConversationMaxUsers: getenvInt("DISGORD_GROUP_CONVERSATION_MAX_USERS", 10),
+
+	IdleTimeout:           getenvDuration("DISGORD_IDLE_TIMEOUT", time.Minute*5),
+	PresenceCheckInterval: getenvDuration("DISGORD_PRESENCE_CHECK_INTERVAL", time.Second*30),
+
+	FileDir: getenv("DISGORD_FILE_DIR", "files"),
+
+	EmojiMaxSize:  getenvInt("DISGORD_EMOJI_MAX_SIZE", 256*1024),
+	EmojiMaxCount: getenvInt("DISGORD_EMOJI_MAX_COUNT", 50),
+
+	RateLimitFreeFailures: getenvInt("DISGORD_RATE_LIMIT_FREE_FAILURES", 5),
+	RateLimitWindow:       getenvDuration("DISGORD_RATE_LIMIT_WINDOW", time.Minute*15),
+	RateLimitBaseDelay:    getenvDuration("DISGORD_RATE_LIMIT_BASE_DELAY", time.Second),
+	RateLimitMaxDelay:     getenvDuration("DISGORD_RATE_LIMIT_MAX_DELAY", time.Minute*15),
+	RateLimitStore:        getenv("DISGORD_RATE_LIMIT_STORE", "memory"),
+}
+
+func getenv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return fallback
+}
+
+func getenvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+
+	return n
+}
+
+func getenvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+
+	return b
+}
+
+// getenvDuration reads a duration such as "15m" or "1h30m".
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+
+	return d
+}
+
+// getenvList reads a comma-separated list.
+func getenvList(key, fallback string) []string {
+	return strings.Split(getenv(key, fallback), ",")
+}
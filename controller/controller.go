@@ -20,6 +20,8 @@ type Controller struct{}
 func New() *Controller {
 	var err error
 
+	loadKeys()
+
 	client, err = ent.Open(dialect.SQLite, "file:disgord.db?cache=shared&_fk=1")
 	if err != nil {
 		log.Fatalf("failed opening connection to sqlite: %v", err)
@@ -32,6 +34,15 @@ func New() *Controller {
 		log.Fatalf("failed creating schema resources: %v", err)
 	}
 
+	checkOwnerDeletionPolicy(config.OwnerDeletionPolicy)
+	scheduleSuspensionExpiry()
+	scheduleRefreshTokenPruning()
+	schedulePresenceChecks()
+	removeOrphanedEmojiFiles()
+
+	limiter = newLimiter(newLimitStore(config.RateLimitStore))
+	scheduleRateLimitExpiry()
+
 	return &Controller{}
 }
 
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMain runs the tests against a fresh database and signing key in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "disgord")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	block := &pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}
+	if err := os.WriteFile(legacyKid+".pem", pem.EncodeToMemory(block), 0o600); err != nil {
+		log.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	c := New()
+	code := m.Run()
+	c.Close()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestRouter routes the handlers under test the same way as main.
+func newTestRouter() *gin.Engine {
+	c := &Controller{}
+	r := gin.New()
+
+	auth := r.Group("/auth")
+	{
+		auth.POST("/sign-up", c.SignUp)
+		auth.POST("/sign-in", c.SignIn)
+		auth.POST("/sign-in/2fa", c.SignInWithTOTP)
+		auth.POST("/passkey/begin", c.BeginPasskeySignIn)
+		auth.POST("/passkey/finish", c.FinishPasskeySignIn)
+		auth.GET("/oidc/login", c.BeginOIDCSignIn)
+		auth.GET("/oidc/callback", c.FinishOIDCSignIn)
+		auth.POST("/password-reset", c.RequestPasswordReset)
+		auth.POST("/password-reset/confirm", c.ResetPassword)
+		auth.POST("/verify-email", c.VerifyEmail)
+		auth.POST("/refresh", c.Refresh)
+	}
+
+	r.GET("/ws", c.ConnectWebsocket)
+	r.POST("/ws/ticket", c.JWTAuthMiddleware(), c.IssueWebsocketTicket)
+
+	me := r.Group("/users/me")
+	me.Use(c.JWTAuthMiddleware(), c.SessionMiddleware())
+	{
+		me.GET("", c.GetMyProfile)
+		me.PATCH("", c.UpdateMyProfile)
+		me.GET("/passkeys", c.GetMyPasskeys)
+		me.POST("/passkeys/begin", c.BeginPasskeyRegistration)
+		me.POST("/passkeys/finish", c.FinishPasskeyRegistration)
+		me.POST("/email/verification", c.SendEmailVerification)
+		me.POST("/2fa", c.EnrollTOTP)
+		me.POST("/2fa/confirm", c.ConfirmTOTP)
+		me.DELETE("/2fa", c.DisableTOTP)
+	}
+
+	return r
+}
+
+// serve sends the request with the body in JSON, signed in with the access
+// token if given.
+func serve(r http.Handler, method, path, accessToken string, body any) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&b).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, path, &b)
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+// expect fails the test unless the response has the status, and decodes the
+// response body into v if given.
+func expect(t *testing.T, w *httptest.ResponseRecorder, status int, v any) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// signUp creates the user and returns an access token of the user.
+func signUp(t *testing.T, r http.Handler, username, password string) string {
+	t.Helper()
+
+	body := gin.H{
+		"username": username,
+		"password": password,
+	}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-up", "", body), http.StatusCreated, nil)
+
+	var token Token
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in", "", body), http.StatusOK, &token)
+
+	return token.AccessToken
+}
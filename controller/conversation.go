@@ -0,0 +1,636 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"disgord/ent"
+	"disgord/ent/chatroomrole"
+	"disgord/ent/conversation"
+	"disgord/ent/conversationparticipant"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationResponse is a conversation with the IDs of the users in it.
+type ConversationResponse struct {
+	*ent.Conversation
+	ParticipantIDs []int `json:"participantIds" binding:"required"`
+}
+
+// GetAllConversations godoc
+//
+//	@Description	It lists the conversations of the current user, the latest first.
+//	@Tags			conversation
+//	@Summary		list my conversations
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.ConversationResponse
+//	@Failure		401
+//	@Router			/conversations [get]
+func (*Controller) GetAllConversations(c *gin.Context) {
+	conversations, err := client.Conversation.
+		Query().
+		Where(conversation.HasParticipantsWith(conversationparticipant.UserID(getCurrentUserID(c)))).
+		WithParticipants().
+		Order(conversation.ByUpdatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	response := make([]ConversationResponse, 0, len(conversations))
+	for _, conversation := range conversations {
+		response = append(response, newConversationResponse(conversation))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetConversationByID godoc
+//
+//	@Tags		conversation
+//	@Summary	get a single conversation by id
+//	@Param		uri				path	controller.GetConversationByID.Uri	true	"path"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{object}	controller.ConversationResponse
+//	@Failure	401
+//	@Failure	404	"cannot find conversation"
+//	@Router		/conversations/{id} [get]
+func (*Controller) GetConversationByID(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	conversation, ok := findConversation(c, client, uri.ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(conversation))
+}
+
+// CreateConversation godoc
+//
+//	@Description	With a single user, it returns the direct message with the user if there is one already.
+//	@Description	With more users, it starts a group conversation, up to a limited number of users including the current user.
+//	@Description	Users who blocked the current user, or were blocked by the current user, cannot be in the conversation.
+//	@Tags			conversation
+//	@Summary		start a conversation with other users
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateConversation.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.ConversationResponse	"existing direct message"
+//	@Success		201	{object}	controller.ConversationResponse
+//	@Failure		400	"no other users, or too many users"
+//	@Failure		401
+//	@Failure		403	"cannot message the user"
+//	@Failure		404	"cannot find user"
+//	@Router			/conversations [post]
+func (*Controller) CreateConversation(c *gin.Context) {
+	type Body struct {
+		UserIDs []int  `json:"userIds" binding:"required,min=1"`
+		Name    string `json:"name"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	userIDs := make([]int, 0, len(body.UserIDs))
+	for _, id := range body.UserIDs {
+		if id != userID && !slices.Contains(userIDs, id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	if len(userIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "no other users",
+		})
+		return
+	}
+
+	if len(userIDs)+1 > config.GroupConversationMaxUsers {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "too many users",
+		})
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	count, err := tx.User.
+		Query().
+		Where(user.IDIn(userIDs...)).
+		Count(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if count != len(userIDs) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	blocked, err := isBlocked(tx.Client(), userID, userIDs...)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot message the user",
+		})
+		return
+	}
+
+	isGroup := len(userIDs) > 1
+	if !isGroup {
+		existing, err := tx.Conversation.
+			Query().
+			Where(
+				conversation.IsGroup(false),
+				conversation.HasParticipantsWith(conversationparticipant.UserID(userID)),
+				conversation.HasParticipantsWith(conversationparticipant.UserID(userIDs[0])),
+			).
+			WithParticipants().
+			First(ctx)
+		if err == nil {
+			c.JSON(http.StatusOK, newConversationResponse(existing))
+			return
+		}
+		if !ent.IsNotFound(err) {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	conversationCreate := tx.Conversation.
+		Create().
+		SetIsGroup(isGroup)
+	if isGroup {
+		conversationCreate = conversationCreate.
+			SetName(body.Name).
+			SetOwnerID(userID)
+	}
+
+	conversation, err := conversationCreate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	participantIDs := append([]int{userID}, userIDs...)
+	participantCreates := make([]*ent.ConversationParticipantCreate, 0, len(participantIDs))
+	for _, id := range participantIDs {
+		participantCreates = append(participantCreates, tx.ConversationParticipant.
+			Create().
+			SetConversationID(conversation.ID).
+			SetUserID(id))
+	}
+
+	participants, err := tx.ConversationParticipant.
+		CreateBulk(participantCreates...).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	conversation.Edges.Participants = participants
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	broadcastToUsers(participantIDs, conversationListUpdated(conversation.ID))
+
+	c.JSON(http.StatusCreated, newConversationResponse(conversation))
+}
+
+// UpdateConversation godoc
+//
+//	@Tags		conversation
+//	@Summary	rename the group conversation
+//	@Param		uri				path	controller.UpdateConversation.Uri	true	"path"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Param		body			body	controller.UpdateConversation.Body	true	"Request body"
+//	@Security	BearerAuth
+//	@Success	200	{object}	controller.ConversationResponse
+//	@Failure	401
+//	@Failure	403	"group conversations only"
+//	@Failure	404	"cannot find conversation"
+//	@Router		/conversations/{id} [patch]
+func (*Controller) UpdateConversation(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Name string `json:"name"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, ok := findConversation(c, tx.Client(), uri.ID)
+	if !ok {
+		return
+	}
+
+	if !conversation.IsGroup {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "group conversations only",
+		})
+		return
+	}
+
+	participants := conversation.Edges.Participants
+	conversation, err = conversation.
+		Update().
+		SetName(body.Name).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	conversation.Edges.Participants = participants
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	response := newConversationResponse(conversation)
+	broadcastToUsers(response.ParticipantIDs, conversationListUpdated(conversation.ID))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// AddConversationParticipant godoc
+//
+//	@Description	Any participant may add users to the group conversation, up to a limited number of users.
+//	@Tags			conversation
+//	@Summary		add a user to the group conversation
+//	@Param			uri				path	controller.AddConversationParticipant.Uri	true	"path"
+//	@Param			Authorization	header	string										true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.ConversationResponse
+//	@Failure		400	"too many users"
+//	@Failure		401
+//	@Failure		403	"group conversations only, or cannot message the user"
+//	@Failure		404	"cannot find conversation or user"
+//	@Failure		409	"already in the conversation"
+//	@Router			/conversations/{id}/participants/{userId} [put]
+func (*Controller) AddConversationParticipant(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, ok := findConversation(c, tx.Client(), uri.ID)
+	if !ok {
+		return
+	}
+
+	if !conversation.IsGroup {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "group conversations only",
+		})
+		return
+	}
+
+	if len(conversation.Edges.Participants)+1 > config.GroupConversationMaxUsers {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "too many users",
+		})
+		return
+	}
+
+	exists, err := tx.User.
+		Query().
+		Where(user.ID(uri.UserID)).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	blocked, err := isBlocked(tx.Client(), getCurrentUserID(c), uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot message the user",
+		})
+		return
+	}
+
+	participant, err := tx.ConversationParticipant.
+		Create().
+		SetConversationID(conversation.ID).
+		SetUserID(uri.UserID).
+		Save(ctx)
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "already in the conversation",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	conversation.Edges.Participants = append(conversation.Edges.Participants, participant)
+	response := newConversationResponse(conversation)
+	broadcastToUsers(response.ParticipantIDs, conversationListUpdated(conversation.ID))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RemoveConversationParticipant godoc
+//
+//	@Description	Any participant may leave the group conversation, and the user who started it may remove the others.
+//	@Tags			conversation
+//	@Summary		remove a user from the group conversation
+//	@Param			uri				path	controller.RemoveConversationParticipant.Uri	true	"path"
+//	@Param			Authorization	header	string											true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"group conversations only, or conversation owner only"
+//	@Failure		404	"cannot find conversation or participant"
+//	@Router			/conversations/{id}/participants/{userId} [delete]
+func (*Controller) RemoveConversationParticipant(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, ok := findConversation(c, tx.Client(), uri.ID)
+	if !ok {
+		return
+	}
+
+	if !conversation.IsGroup {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "group conversations only",
+		})
+		return
+	}
+
+	if uri.UserID != userID && conversation.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "conversation owner only",
+		})
+		return
+	}
+
+	participantIDs := newConversationResponse(conversation).ParticipantIDs
+	if !slices.Contains(participantIDs, uri.UserID) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find participant",
+		})
+		return
+	}
+
+	_, err = tx.ConversationParticipant.
+		Delete().
+		Where(
+			conversationparticipant.ConversationID(conversation.ID),
+			conversationparticipant.UserID(uri.UserID),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickFromCall(conversation.ID, uri.UserID)
+	broadcastToUsers(participantIDs, conversationListUpdated(conversation.ID))
+
+	c.Status(http.StatusNoContent)
+}
+
+// JoinCall godoc
+//
+//	@Description	Calls are only for direct messages between two users. The other user receives CALL with the conversation ID as content when the call starts.
+//	@Description	In the call, the WebSocket works as in a chatroom, and SEND_TEXT is sent as a direct message.
+//	@Tags			conversation
+//	@Summary		join the voice/video call of the conversation
+//	@Param			uri				path	controller.JoinCall.Uri		true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Param			body			body	controller.JoinCall.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200
+//	@Failure		401
+//	@Failure		403	"direct messages between two users only, or cannot call the user"
+//	@Failure		404	"cannot find conversation"
+//	@Router			/conversations/{id}/call [post]
+func (*Controller) JoinCall(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Muted *bool `json:"muted" binding:"required"`
+		CamOn *bool `json:"camOn" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	conversation, ok := findConversation(c, client, uri.ID)
+	if !ok {
+		return
+	}
+
+	participantIDs := newConversationResponse(conversation).ParticipantIDs
+	if conversation.IsGroup || len(participantIDs) != 2 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "direct messages between two users only",
+		})
+		return
+	}
+
+	blocked, err := isBlocked(client, getCurrentUserID(c), participantIDs...)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot call the user",
+		})
+		return
+	}
+
+	role := RoomRole{
+		UserID:      getCurrentUserID(c),
+		Role:        chatroomrole.RoleMember,
+		Permissions: PermissionSendText | mediaPermissions,
+	}
+
+	if joinCall(conversation.ID, getCurrentSessionID(c), *body.Muted, *body.CamOn, role) {
+		others := slices.DeleteFunc(participantIDs, func(id int) bool { return id == role.UserID })
+		broadcastToUsers(others, &Message{
+			Action:  CallAction,
+			Content: strconv.Itoa(conversation.ID),
+		})
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// findConversation responds with 404 unless the current user is in the
+// conversation, which is returned with its participants.
+func findConversation(c *gin.Context, client *ent.Client, id int) (*ent.Conversation, bool) {
+	conversation, err := client.Conversation.
+		Query().
+		Where(
+			conversation.ID(id),
+			conversation.HasParticipantsWith(conversationparticipant.UserID(getCurrentUserID(c))),
+		).
+		WithParticipants().
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find conversation",
+		})
+		return nil, false
+	}
+
+	return conversation, true
+}
+
+func newConversationResponse(conversation *ent.Conversation) ConversationResponse {
+	participantIDs := make([]int, 0, len(conversation.Edges.Participants))
+	for _, participant := range conversation.Edges.Participants {
+		participantIDs = append(participantIDs, participant.UserID)
+	}
+
+	return ConversationResponse{
+		Conversation:   conversation,
+		ParticipantIDs: participantIDs,
+	}
+}
+
+func conversationListUpdated(conversationID int) *Message {
+	return &Message{
+		Action:  ConversationListUpdatedAction,
+		Content: strconv.Itoa(conversationID),
+	}
+}
@@ -0,0 +1,354 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/conversationparticipant"
+	"disgord/ent/directmessage"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetDirectMessages godoc
+//
+//	@Description	It supports latest-first paging by offset and limit, and returns in oldest-first order.
+//	@Description	Messages sent by the users the current user blocked are left out.
+//	@Tags			conversation
+//	@Summary		list the messages of the conversation
+//	@Param			uri				path	controller.GetDirectMessages.Uri	true	"path"
+//	@Param			q				query	controller.GetDirectMessages.Query	true	"query"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.GetDirectMessages.Response
+//	@Failure		401
+//	@Failure		404	"cannot find conversation"
+//	@Router			/conversations/{id}/messages [get]
+func (*Controller) GetDirectMessages(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Query struct {
+		Offset int `form:"offset"`
+		Limit  int `form:"limit"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	conversation, ok := findConversation(c, client, uri.ID)
+	if !ok {
+		return
+	}
+
+	blockedIDs, err := getBlockedIDs(client, getCurrentUserID(c))
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	messageQuery := conversation.
+		QueryMessages().
+		Where(directmessage.SenderIDNotIn(blockedIDs...)).
+		Order(directmessage.ByCreatedAt(sql.OrderDesc()))
+	if query.Offset != 0 {
+		messageQuery = messageQuery.Offset(query.Offset)
+	}
+	if query.Limit != 0 {
+		messageQuery = messageQuery.Limit(query.Limit)
+	}
+
+	messages, err := messageQuery.
+		WithSender(func(uq *ent.UserQuery) {
+			uq.Select(user.FieldDisplayName, user.FieldProfileColorIndex)
+		}).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	type Response struct {
+		*ent.DirectMessage
+		Name  string `json:"displayName"`
+		Color uint8  `json:"profileColorIndex"`
+	}
+
+	response := make([]Response, 0, len(messages))
+	for _, message := range messages {
+		response = append(response, Response{
+			DirectMessage: message,
+			Name:          message.Edges.Sender.DisplayName,
+			Color:         message.Edges.Sender.ProfileColorIndex,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// SendDirectMessage godoc
+//
+//	@Description	Every connection of the participants receives DIRECT_MESSAGE with the message as content, whether or not they are in a room.
+//	@Description	Direct messages between two users are not allowed if either has blocked the other.
+//	@Tags			conversation
+//	@Summary		send a message to the conversation
+//	@Param			uri				path	controller.SendDirectMessage.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.SendDirectMessage.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.DirectMessage
+//	@Failure		401
+//	@Failure		403	"cannot message the user"
+//	@Failure		404	"cannot find conversation"
+//	@Router			/conversations/{id}/messages [post]
+func (*Controller) SendDirectMessage(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Content string `json:"content" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	sender, err := getCurrentUser(c)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, ok := findConversation(c, tx.Client(), uri.ID)
+	if !ok {
+		return
+	}
+
+	participantIDs := newConversationResponse(conversation).ParticipantIDs
+	if !conversation.IsGroup {
+		blocked, err := isBlocked(tx.Client(), sender.ID, participantIDs...)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if blocked {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "cannot message the user",
+			})
+			return
+		}
+	}
+
+	message, err := saveDirectMessage(tx, conversation, sender.ID, body.Content)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	deliverDirectMessage(participantIDs, message, sender.DisplayName, sender.ProfileColorIndex)
+
+	c.JSON(http.StatusCreated, message)
+}
+
+// DeleteDirectMessage godoc
+//
+//	@Tags		conversation
+//	@Summary	delete the message
+//	@Param		uri				path	controller.DeleteDirectMessage.Uri	true	"path"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"message sender only"
+//	@Failure	404	"cannot find conversation or message"
+//	@Router		/conversations/{id}/messages/{messageId} [delete]
+func (*Controller) DeleteDirectMessage(c *gin.Context) {
+	type Uri struct {
+		ID        int `uri:"id" binding:"required"`
+		MessageID int `uri:"messageId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, ok := findConversation(c, tx.Client(), uri.ID)
+	if !ok {
+		return
+	}
+
+	message, err := conversation.
+		QueryMessages().
+		Where(directmessage.ID(uri.MessageID)).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find message",
+		})
+		return
+	}
+
+	if message.SenderID != getCurrentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "message sender only",
+		})
+		return
+	}
+
+	err = tx.DirectMessage.
+		DeleteOne(message).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// saveDirectMessage saves the message, and brings the conversation to the top
+// of the list.
+func saveDirectMessage(tx *ent.Tx, conversation *ent.Conversation, senderID int, content string) (*ent.DirectMessage, error) {
+	message, err := tx.DirectMessage.
+		Create().
+		SetConversationID(conversation.ID).
+		SetSenderID(senderID).
+		SetContent(content).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Conversation.
+		UpdateOne(conversation).
+		SetUpdatedAt(message.CreatedAt).
+		Exec(ctx)
+	return message, err
+}
+
+// deliverDirectMessage sends the message to every connection of the
+// participants.
+func deliverDirectMessage(participantIDs []int, message *ent.DirectMessage, name string, color uint8) {
+	b, _ := json.Marshal(message)
+
+	broadcastToUsers(participantIDs, &Message{
+		Action:    DirectMessageAction,
+		Content:   string(b),
+		Name:      name,
+		Color:     color,
+		CreatedAt: &message.CreatedAt,
+		senderID:  message.SenderID,
+	})
+}
+
+// sendTextInCall saves the text sent in the call of the conversation as a
+// direct message, and delivers it to the participants in and out of the call.
+func sendTextInCall(conversationID int, sender *Client, content string) {
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	conversation, err := tx.Conversation.Get(ctx, conversationID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	participantIDs, err := conversation.
+		QueryParticipants().
+		Select(conversationparticipant.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	blocked, err := isBlocked(tx.Client(), sender.ID, participantIDs...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if blocked {
+		sender.deliver(&Message{
+			Action:  ForbiddenAction,
+			Content: SendTextAction,
+		})
+		return
+	}
+
+	message, err := saveDirectMessage(tx, conversation, sender.ID, content)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	deliverDirectMessage(participantIDs, message, sender.Name, sender.Color)
+}
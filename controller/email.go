@@ -0,0 +1,347 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/securityevent"
+	"disgord/ent/session"
+	"disgord/ent/user"
+	"disgord/ent/verificationtoken"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	passwordResetExpiry     = time.Hour
+	emailVerificationExpiry = time.Hour * 24
+)
+
+// RequestPasswordReset godoc
+//
+//	@Description	A reset link is mailed if the user has a verified email address.
+//	@Description	It always responds with 202, not to tell whether the user exists.
+//	@Tags			auth
+//	@Summary		request a password reset link by mail
+//	@Param			body	body	controller.RequestPasswordReset.Body	true	"Request body"
+//	@Success		202
+//	@Router			/auth/password-reset [post]
+func (*Controller) RequestPasswordReset(c *gin.Context) {
+	type Body struct {
+		Username string `json:"username" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.
+		Query().
+		Where(user.Username(body.Username)).
+		Only(ctx)
+	if err != nil || user.Email == "" || !user.EmailVerified {
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	token, err := issueVerificationToken(tx, user, verificationtoken.PurposePasswordReset, passwordResetExpiry)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	sendMail(user.Email, "Reset your disGOrd password",
+		"Hi "+user.DisplayName+",\n\n"+
+			"Open the link below within an hour to reset your password.\n"+
+			appLink("/reset-password", token)+"\n\n"+
+			"If you did not request it, just ignore this mail.\n")
+
+	c.Status(http.StatusAccepted)
+}
+
+// ResetPassword godoc
+//
+//	@Description	All sessions of the user are revoked and disconnected from the WebSocket.
+//	@Tags			auth
+//	@Summary		reset the password with the token from the reset link
+//	@Param			body	body	controller.ResetPassword.Body	true	"Request body"
+//	@Success		204
+//	@Failure		401	"invalid or expired token"
+//	@Router			/auth/password-reset/confirm [post]
+func (*Controller) ResetPassword(c *gin.Context) {
+	type Body struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := consumeVerificationToken(tx, body.Token, verificationtoken.PurposePasswordReset)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid or expired token",
+		})
+		return
+	}
+
+	_, err = tx.User.
+		UpdateOneID(token.UserID).
+		SetPassword(hashPassword(body.Password)).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// Whoever knew the old password may still be signed in somewhere.
+	_, err = tx.Session.
+		Delete().
+		Where(session.UserID(token.UserID)).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	_, err = tx.VerificationToken.
+		Delete().
+		Where(
+			verificationtoken.UserID(token.UserID),
+			verificationtoken.PurposeEQ(verificationtoken.PurposePasswordReset),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = newSecurityEvent(tx, c, token.UserID, securityevent.TypePasswordReset).Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	disconnect(token.UserID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// SendEmailVerification godoc
+//
+//	@Tags		user
+//	@Summary	mail a verification link to the email address of the current user again
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	202
+//	@Failure	401
+//	@Failure	404	"cannot find user"
+//	@Failure	409	"no email address or already verified"
+//	@Router		/users/me/email/verification [post]
+func (*Controller) SendEmailVerification(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	if user.Email == "" || user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "no email address or already verified",
+		})
+		return
+	}
+
+	if err := sendEmailVerification(tx, user); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// VerifyEmail godoc
+//
+//	@Tags		auth
+//	@Summary	verify the email address with the token from the verification link
+//	@Param		body	body	controller.VerifyEmail.Body	true	"Request body"
+//	@Success	204
+//	@Failure	401	"invalid or expired token"
+//	@Router		/auth/verify-email [post]
+func (*Controller) VerifyEmail(c *gin.Context) {
+	type Body struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := consumeVerificationToken(tx, body.Token, verificationtoken.PurposeEmailVerification)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid or expired token",
+		})
+		return
+	}
+
+	// The user may have changed the address after the mail was sent.
+	n, err := tx.User.
+		Update().
+		Where(
+			user.ID(token.UserID),
+			user.Email(token.Email),
+		).
+		SetEmailVerified(true).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid or expired token",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// sendEmailVerification commits the transaction and mails a verification link
+// to the email address of the user.
+func sendEmailVerification(tx *ent.Tx, user *ent.User) error {
+	token, err := issueVerificationToken(tx, user, verificationtoken.PurposeEmailVerification, emailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sendMail(user.Email, "Verify your email address for disGOrd",
+		"Hi "+user.DisplayName+",\n\n"+
+			"Open the link below to verify your email address.\n"+
+			appLink("/verify-email", token)+"\n")
+
+	return nil
+}
+
+// issueVerificationToken returns a new token to mail to the user. Only its
+// hash is stored, so it can be used only from the mail.
+func issueVerificationToken(tx *ent.Tx, user *ent.User, purpose verificationtoken.Purpose, expiry time.Duration) (string, error) {
+	token := randomToken(32)
+
+	err := tx.VerificationToken.
+		Create().
+		SetUserID(user.ID).
+		SetPurpose(purpose).
+		SetToken(hashToken(token)).
+		SetEmail(user.Email).
+		SetExpiresAt(time.Now().Add(expiry)).
+		Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeVerificationToken deletes the token so that it cannot be used again,
+// and returns it if it was valid.
+func consumeVerificationToken(tx *ent.Tx, token string, purpose verificationtoken.Purpose) (*ent.VerificationToken, error) {
+	verificationToken, err := tx.VerificationToken.
+		Query().
+		Where(
+			verificationtoken.Token(hashToken(token)),
+			verificationtoken.PurposeEQ(purpose),
+			verificationtoken.ExpiresAtGT(time.Now()),
+		).
+		Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.VerificationToken.
+		DeleteOne(verificationToken).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return verificationToken, nil
+}
+
+func appLink(path, token string) string {
+	return config.AppURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// smtpSink is an SMTP server that accepts every mail and keeps it, so that
+// tests can read what would have been sent.
+type smtpSink struct {
+	listener net.Listener
+	mails    chan string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{
+		listener: listener,
+		mails:    make(chan string, 8),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go sink.serve(conn)
+		}
+	}()
+
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch verb, _, _ := strings.Cut(line, " "); strings.ToUpper(verb) {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 end with <CRLF>.<CRLF>")
+
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+
+			s.mails <- strings.Join(lines, "\n")
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+var mailedToken = regexp.MustCompile(`\?token=([\w-]+)`)
+
+// receive waits for the next mail to the address, and returns the token in
+// the link of the mail.
+func (s *smtpSink) receive(t *testing.T, to, subject string) string {
+	t.Helper()
+
+	select {
+	case mail := <-s.mails:
+		header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(mail + "\n"))).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("To") != to || header.Get("Subject") != subject {
+			t.Fatalf("mail to %q about %q, want to %q about %q", header.Get("To"), header.Get("Subject"), to, subject)
+		}
+
+		match := mailedToken.FindStringSubmatch(mail)
+		if match == nil {
+			t.Fatalf("no link in the mail: %s", mail)
+		}
+		return match[1]
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail sent")
+		return ""
+	}
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	previous := mailer
+	mailer = newSMTPMailer(sink.listener.Addr().String(), "", "", config.MailFrom)
+	t.Cleanup(func() { mailer = previous })
+
+	r := newTestRouter()
+	accessToken := signUp(t, r, "mailer", "password")
+
+	// Changing the address mails a verification link to it.
+	body := gin.H{"email": "mailer@example.com"}
+	expect(t, serve(r, http.MethodPatch, "/users/me", accessToken, body), http.StatusOK, nil)
+
+	token := sink.receive(t, "mailer@example.com", "Verify your email address for disGOrd")
+
+	// A password reset is mailed only to a verified address.
+	body = gin.H{"username": "mailer"}
+	expect(t, serve(r, http.MethodPost, "/auth/password-reset", "", body), http.StatusAccepted, nil)
+
+	body = gin.H{"token": token}
+	expect(t, serve(r, http.MethodPost, "/auth/verify-email", "", body), http.StatusNoContent, nil)
+	expect(t, serve(r, http.MethodPost, "/auth/verify-email", "", body), http.StatusUnauthorized, nil)
+
+	var profile Profile
+	expect(t, serve(r, http.MethodGet, "/users/me", accessToken, nil), http.StatusOK, &profile)
+	if !profile.EmailVerified {
+		t.Fatal("email not verified")
+	}
+
+	body = gin.H{"username": "mailer"}
+	expect(t, serve(r, http.MethodPost, "/auth/password-reset", "", body), http.StatusAccepted, nil)
+
+	token = sink.receive(t, "mailer@example.com", "Reset your disGOrd password")
+
+	body = gin.H{"token": token, "password": "new password"}
+	expect(t, serve(r, http.MethodPost, "/auth/password-reset/confirm", "", body), http.StatusNoContent, nil)
+	expect(t, serve(r, http.MethodPost, "/auth/password-reset/confirm", "", body), http.StatusUnauthorized, nil)
+
+	// The reset signs out every session, and only the new password signs in.
+	expect(t, serve(r, http.MethodGet, "/users/me", accessToken, nil), http.StatusUnauthorized, nil)
+
+	body = gin.H{"username": "mailer", "password": "password"}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in", "", body), http.StatusUnauthorized, nil)
+
+	body = gin.H{"username": "mailer", "password": "new password"}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in", "", body), http.StatusOK, nil)
+}
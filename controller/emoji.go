@@ -0,0 +1,664 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"disgord/ent"
+	"disgord/ent/customemoji"
+	"disgord/ent/guildmember"
+	"disgord/ent/predicate"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/apparentlymart/go-textseg/v15/textseg"
+	"github.com/gin-gonic/gin"
+)
+
+// emojiDir is the directory of the file storage for the images of custom
+// emojis.
+const emojiDir = "emojis"
+
+// emojiImageTypes are the extensions of the image types allowed for custom
+// emojis.
+var emojiImageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+var emojiName = regexp.MustCompile(`^\w{2,32}$`)
+
+// emojiShortcode matches :name: as well as <:name:id>, which :name: is
+// resolved to, capturing the name.
+var emojiShortcode = regexp.MustCompile(`<:(\w{2,32}):\d+>|:(\w{2,32}):`)
+
+// customEmojiName matches :name: alone, which a custom emoji is given as.
+var customEmojiName = regexp.MustCompile(`^:\w{2,32}:$`)
+
+// EmojiForm is the form to upload a custom emoji with.
+type EmojiForm struct {
+	Name  string                `form:"name" binding:"required"`
+	Image *multipart.FileHeader `form:"image" binding:"required"`
+}
+
+// emojiFormOverhead is how much larger than the image the form may be, for the
+// name and the multipart headers.
+const emojiFormOverhead = 16 * 1024
+
+// bindEmojiForm binds the form, and stops reading the request as soon as it is
+// too large for an image of config.EmojiMaxSize.
+func bindEmojiForm(c *gin.Context, form *EmojiForm) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(config.EmojiMaxSize)+emojiFormOverhead)
+
+	if err := c.ShouldBind(form); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"message": "image too large",
+			})
+			return false
+		}
+
+		c.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypeBind)
+		return false
+	}
+
+	return true
+}
+
+// GetChatroomEmojis godoc
+//
+//	@Description	The custom emojis of the guild are listed as well, for a channel of a guild.
+//	@Tags			chatroom
+//	@Summary		list the custom emojis usable in the chatroom
+//	@Param			uri				path	controller.GetChatroomEmojis.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	ent.CustomEmoji
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id}/emojis [get]
+func (*Controller) GetChatroomEmojis(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionSendText); !ok {
+		return
+	}
+
+	emojis, err := tx.CustomEmoji.
+		Query().
+		Where(emojisOfRoom(chatroom)).
+		Order(customemoji.ByName(sql.OrderAsc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, emojis)
+}
+
+// CreateChatroomEmoji godoc
+//
+//	@Description	It requires the manage room permission. The image is a PNG, GIF, JPEG or WebP of limited size.
+//	@Description	The name is 2 to 32 letters, digits or underscores, unique in the chatroom.
+//	@Tags			chatroom
+//	@Summary		upload a custom emoji to the chatroom
+//	@Accept			multipart/form-data
+//	@Param			uri				path		controller.CreateChatroomEmoji.Uri	true	"path"
+//	@Param			Authorization	header		string								true	"Bearer AccessToken"
+//	@Param			name			formData	string								true	"name"
+//	@Param			image			formData	file								true	"image"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.CustomEmoji
+//	@Failure		400	"invalid name or unsupported image type"
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom, or too many emojis"
+//	@Failure		404	"cannot find chatroom"
+//	@Failure		409	"emoji name already taken"
+//	@Failure		413	"image too large"
+//	@Router			/chatrooms/{id}/emojis [post]
+func (*Controller) CreateChatroomEmoji(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var form EmojiForm
+	if !bindEmojiForm(c, &form) {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom); !ok {
+		return
+	}
+
+	createEmoji(c, tx, form, customemoji.ChatroomID(chatroom.ID), func(ec *ent.CustomEmojiCreate) {
+		ec.SetChatroomID(chatroom.ID)
+	})
+}
+
+// DeleteChatroomEmoji godoc
+//
+//	@Description	It requires the manage room permission. Chats keep the emoji as <:name:id>, which no longer shows the image.
+//	@Tags			chatroom
+//	@Summary		delete the custom emoji of the chatroom
+//	@Param			uri				path	controller.DeleteChatroomEmoji.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or emoji"
+//	@Router			/chatrooms/{id}/emojis/{emojiId} [delete]
+func (*Controller) DeleteChatroomEmoji(c *gin.Context) {
+	type Uri struct {
+		ID      int `uri:"id" binding:"required"`
+		EmojiID int `uri:"emojiId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom); !ok {
+		return
+	}
+
+	deleteEmoji(c, tx, customemoji.ID(uri.EmojiID), customemoji.ChatroomID(chatroom.ID))
+}
+
+// GetGuildEmojis godoc
+//
+//	@Tags		guild
+//	@Summary	list the custom emojis of the guild
+//	@Param		uri				path	controller.GetGuildEmojis.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.CustomEmoji
+//	@Failure	401
+//	@Failure	403	"not allowed in the guild"
+//	@Failure	404	"cannot find guild"
+//	@Router		/guilds/{id}/emojis [get]
+func (*Controller) GetGuildEmojis(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleMember); !ok {
+		return
+	}
+
+	emojis, err := guild.
+		QueryEmojis().
+		Order(customemoji.ByName(sql.OrderAsc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, emojis)
+}
+
+// CreateGuildEmoji godoc
+//
+//	@Description	It requires the moderator role in the guild. The image is a PNG, GIF, JPEG or WebP of limited size.
+//	@Description	The name is 2 to 32 letters, digits or underscores, unique in the guild.
+//	@Description	The emoji is usable in every channel of the guild, unless the channel has its own emoji of the name.
+//	@Tags			guild
+//	@Summary		upload a custom emoji to the guild
+//	@Accept			multipart/form-data
+//	@Param			uri				path		controller.CreateGuildEmoji.Uri	true	"path"
+//	@Param			Authorization	header		string							true	"Bearer AccessToken"
+//	@Param			name			formData	string							true	"name"
+//	@Param			image			formData	file							true	"image"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.CustomEmoji
+//	@Failure		400	"invalid name or unsupported image type"
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild, or too many emojis"
+//	@Failure		404	"cannot find guild"
+//	@Failure		409	"emoji name already taken"
+//	@Failure		413	"image too large"
+//	@Router			/guilds/{id}/emojis [post]
+func (*Controller) CreateGuildEmoji(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var form EmojiForm
+	if !bindEmojiForm(c, &form) {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	createEmoji(c, tx, form, customemoji.GuildID(guild.ID), func(ec *ent.CustomEmojiCreate) {
+		ec.SetGuildID(guild.ID)
+	})
+}
+
+// DeleteGuildEmoji godoc
+//
+//	@Description	It requires the moderator role in the guild.
+//	@Tags			guild
+//	@Summary		delete the custom emoji of the guild
+//	@Param			uri				path	controller.DeleteGuildEmoji.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or emoji"
+//	@Router			/guilds/{id}/emojis/{emojiId} [delete]
+func (*Controller) DeleteGuildEmoji(c *gin.Context) {
+	type Uri struct {
+		ID      int `uri:"id" binding:"required"`
+		EmojiID int `uri:"emojiId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	deleteEmoji(c, tx, customemoji.ID(uri.EmojiID), customemoji.GuildID(guild.ID))
+}
+
+// GetEmojiImage godoc
+//
+//	@Description	It does not require authentication, so that the image can be used as the source of an img element.
+//	@Tags			emoji
+//	@Summary		get the image of the custom emoji
+//	@Param			uri	path	controller.GetEmojiImage.Uri	true	"path"
+//	@Produce		png,gif,jpeg,webp
+//	@Success		200
+//	@Failure		404	"cannot find emoji"
+//	@Router			/emojis/{id}/image [get]
+func (*Controller) GetEmojiImage(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	emoji, err := client.CustomEmoji.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find emoji",
+		})
+		return
+	}
+
+	c.File(filePath(emojiDir, emoji.FileName))
+}
+
+// createEmoji saves the emoji uploaded with the form, in the scope the predicate
+// selects the emojis of and setScope sets, and responds with it.
+func createEmoji(c *gin.Context, tx *ent.Tx, form EmojiForm, scope predicate.CustomEmoji, setScope func(*ent.CustomEmojiCreate)) {
+	if !emojiName.MatchString(form.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid name",
+		})
+		return
+	}
+
+	if form.Image.Size > int64(config.EmojiMaxSize) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": "image too large",
+		})
+		return
+	}
+
+	image, err := readFormFile(form.Image)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	ext, ok := emojiImageTypes[http.DetectContentType(image)]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "unsupported image type",
+		})
+		return
+	}
+
+	emojis, err := tx.CustomEmoji.
+		Query().
+		Where(scope).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if len(emojis) >= config.EmojiMaxCount {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "too many emojis",
+		})
+		return
+	}
+
+	for _, emoji := range emojis {
+		if emoji.Name == form.Name {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": "emoji name already taken",
+			})
+			return
+		}
+	}
+
+	emojiCreate := tx.CustomEmoji.
+		Create().
+		SetName(form.Name).
+		SetUploaderID(getCurrentUserID(c)).
+		SetFileName(randomToken(16) + ext).
+		SetSize(len(image))
+	setScope(emojiCreate)
+
+	emoji, err := emojiCreate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := saveFile(emojiDir, emoji.FileName, image); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		removeFiles(emojiDir, emoji.FileName)
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, emoji)
+}
+
+// deleteEmoji deletes the emoji the predicates select along with its image, and
+// responds with 204.
+func deleteEmoji(c *gin.Context, tx *ent.Tx, predicates ...predicate.CustomEmoji) {
+	emoji, err := tx.CustomEmoji.
+		Query().
+		Where(predicates...).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find emoji",
+		})
+		return
+	}
+
+	err = tx.CustomEmoji.
+		DeleteOne(emoji).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	removeFiles(emojiDir, emoji.FileName)
+
+	c.Status(http.StatusNoContent)
+}
+
+func readFormFile(fileHeader *multipart.FileHeader) ([]byte, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// emojisOfRoom selects the custom emojis usable in the chatroom, its own and
+// those of its guild.
+func emojisOfRoom(chatroom *ent.Chatroom) predicate.CustomEmoji {
+	if chatroom.GuildID == 0 {
+		return customemoji.ChatroomID(chatroom.ID)
+	}
+
+	return customemoji.Or(
+		customemoji.ChatroomID(chatroom.ID),
+		customemoji.GuildID(chatroom.GuildID),
+	)
+}
+
+// resolveEmojis replaces :name: in the content with <:name:id> of the custom
+// emoji usable in the chatroom. The emoji of the chatroom comes before that of
+// its guild, and unknown names are left as they are. <:name:id> given in the
+// content is kept only if it is usable in the chatroom.
+func resolveEmojis(client *ent.Client, chatroomID int, content string) (string, error) {
+	if !strings.Contains(content, ":") {
+		return content, nil
+	}
+
+	chatroom, err := client.Chatroom.Get(ctx, chatroomID)
+	if err != nil {
+		return "", err
+	}
+
+	emojis, err := client.CustomEmoji.
+		Query().
+		Where(emojisOfRoom(chatroom)).
+		All(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	emojiIDs := make(map[string]int, len(emojis))
+	usable := make(map[string]bool, len(emojis))
+	for _, emoji := range emojis {
+		if _, ok := emojiIDs[emoji.Name]; !ok || emoji.ChatroomID != 0 {
+			emojiIDs[emoji.Name] = emoji.ID
+		}
+		usable[fmt.Sprintf("<:%s:%d>", emoji.Name, emoji.ID)] = true
+	}
+
+	return emojiShortcode.ReplaceAllStringFunc(content, func(shortcode string) string {
+		if usable[shortcode] {
+			return shortcode
+		}
+
+		// <:name:id> of an emoji not usable in the chatroom is resolved by
+		// its name like :name:.
+		match := emojiShortcode.FindStringSubmatch(shortcode)
+		name := match[1] + match[2]
+		if id, ok := emojiIDs[name]; ok {
+			return fmt.Sprintf("<:%s:%d>", name, id)
+		}
+		return ":" + name + ":"
+	}), nil
+}
+
+// isEmoji reports whether the text is a single unicode emoji, including those
+// with skin tones, flags, keycaps and sequences joined with ZWJ.
+func isEmoji(text string) bool {
+	count, err := textseg.TokenCount([]byte(text), textseg.ScanGraphemeClusters)
+	if err != nil || count != 1 {
+		return false
+	}
+
+	r, _ := utf8.DecodeRuneInString(text)
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+		return true
+	case r >= 0x2190 && r <= 0x21FF, r >= 0x2300 && r <= 0x23FF, r >= 0x25A0 && r <= 0x27BF, r >= 0x2B00 && r <= 0x2BFF:
+		return true
+	case strings.ContainsRune("\u00A9\u00AE\u203C\u2049\u2122\u2139\u2934\u2935\u3030\u303D\u3297\u3299", r):
+		return true
+	case strings.ContainsRune("#*0123456789", r):
+		return strings.HasSuffix(text, "\u20E3")
+	}
+
+	return false
+}
+
+// removeOrphanedEmojiFiles removes the images of the custom emojis deleted
+// along with their chatrooms or guilds.
+func removeOrphanedEmojiFiles() {
+	fileNames, err := client.CustomEmoji.
+		Query().
+		Select(customemoji.FieldFileName).
+		Strings(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	removeOrphanedFiles(emojiDir, fileNames)
+}
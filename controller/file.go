@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// filePath returns where the file of the name in the directory is stored.
+func filePath(dir, name string) string {
+	return filepath.Join(config.FileDir, dir, filepath.Base(name))
+}
+
+// saveFile stores the data as the file of the name in the directory.
+func saveFile(dir, name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Join(config.FileDir, dir), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath(dir, name), data, 0o644)
+}
+
+// removeFiles removes the files of the names in the directory, if they exist.
+func removeFiles(dir string, names ...string) {
+	for _, name := range names {
+		if err := os.Remove(filePath(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+// removeOrphanedFiles removes the files in the directory other than the names,
+// which are left behind when what they belong to is deleted along with
+// something else.
+func removeOrphanedFiles(dir string, names []string) {
+	entries, err := os.ReadDir(filepath.Join(config.FileDir, dir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			removeFiles(dir, entry.Name())
+		}
+	}
+}
@@ -0,0 +1,677 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/chatroom"
+	"disgord/ent/chatroomrole"
+	"disgord/ent/guild"
+	"disgord/ent/guildmember"
+	"disgord/ent/membership"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roleGuildOwner is the role of the owner of the guild, which is not stored in
+// its GuildMember.
+const roleGuildOwner guildmember.Role = "owner"
+
+// guildRoleRanks orders the roles in a guild.
+var guildRoleRanks = map[guildmember.Role]int{
+	guildmember.RoleMember:    1,
+	guildmember.RoleModerator: 2,
+	roleGuildOwner:            3,
+}
+
+// GetAllGuilds godoc
+//
+//	@Tags		guild
+//	@Summary	list all guilds with the given query
+//	@Param		q				query	controller.GetAllGuilds.Query	true	"query"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.Guild
+//	@Failure	401
+//	@Router		/guilds [get]
+func (*Controller) GetAllGuilds(c *gin.Context) {
+	type Query struct {
+		MemberID int `form:"memberId"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	guildQuery := client.Guild.Query()
+	if query.MemberID != 0 {
+		guildQuery = guildQuery.Where(guild.HasMembersWith(guildmember.UserID(query.MemberID)))
+	}
+
+	guilds, err := guildQuery.All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, guilds)
+}
+
+// GetGuildByID godoc
+//
+//	@Tags		guild
+//	@Summary	get a single guild by id
+//	@Param		uri				path	controller.GetGuildByID.Uri	true	"path"
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{object}	ent.Guild
+//	@Failure	401
+//	@Failure	404	"cannot find guild"
+//	@Router		/guilds/{id} [get]
+func (*Controller) GetGuildByID(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	guild, err := client.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, guild)
+}
+
+// CreateGuild godoc
+//
+//	@Tags		guild
+//	@Summary	create a new guild
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Param		body			body	controller.CreateGuild.Body	true	"Request body"
+//	@Security	BearerAuth
+//	@Success	201	{object}	ent.Guild
+//	@Failure	401
+//	@Failure	404	"cannot find user"
+//	@Router		/guilds [post]
+func (*Controller) CreateGuild(c *gin.Context) {
+	type Body struct {
+		Name string `json:"name" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	guild, err := tx.Guild.
+		Create().
+		SetName(body.Name).
+		SetOwnerID(userID).
+		SetProfileColorIndex(user.ProfileColorIndex).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = tx.GuildMember.
+		Create().
+		SetGuildID(guild.ID).
+		SetUserID(userID).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, guild)
+}
+
+// UpdateGuild godoc
+//
+//	@Tags		guild
+//	@Summary	update the guild
+//	@Param		uri				path	controller.UpdateGuild.Uri	true	"path"
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Param		body			body	controller.UpdateGuild.Body	false	"Request body"
+//	@Security	BearerAuth
+//	@Success	200	{object}	ent.Guild
+//	@Failure	401
+//	@Failure	403	"not allowed in the guild"
+//	@Failure	404	"cannot find guild"
+//	@Router		/guilds/{id} [patch]
+func (*Controller) UpdateGuild(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Name string `json:"name"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, roleGuildOwner); !ok {
+		return
+	}
+
+	guildUpdate := guild.Update()
+	if body.Name != "" {
+		guildUpdate = guildUpdate.SetName(body.Name)
+	}
+
+	guild, err = guildUpdate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roomListUpdated(guild.ID)
+
+	c.JSON(http.StatusOK, guild)
+}
+
+// DeleteGuild godoc
+//
+//	@Tags		guild
+//	@Summary	delete the guild with all channels and chats in it
+//	@Param		uri				path	controller.DeleteGuild.Uri	true	"path"
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"not allowed in the guild"
+//	@Failure	404	"cannot find guild"
+//	@Router		/guilds/{id} [delete]
+func (*Controller) DeleteGuild(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, roleGuildOwner); !ok {
+		return
+	}
+
+	memberIDs, err := guild.
+		QueryMembers().
+		Select(guildmember.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = tx.Guild.
+		DeleteOne(guild).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickAllClientsFromGuild(guild.ID)
+	broadcastToUsers(memberIDs, guildListUpdated(guild.ID))
+
+	c.Status(http.StatusNoContent)
+}
+
+// JoinGuild godoc
+//
+//	@Description	Joining the guild lets the user into its public channels. Private channels still need the password or an invite.
+//	@Tags			guild
+//	@Summary		join the guild
+//	@Param			uri				path	controller.JoinGuild.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.GuildMember
+//	@Failure		401
+//	@Failure		403	"guild archived"
+//	@Failure		404	"cannot find guild"
+//	@Failure		409	"already a member of the guild"
+//	@Router			/guilds/{id}/join [post]
+func (*Controller) JoinGuild(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if guild.ArchivedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "guild archived",
+		})
+		return
+	}
+
+	member, err := tx.GuildMember.
+		Create().
+		SetGuildID(guild.ID).
+		SetUserID(getCurrentUserID(c)).
+		Save(ctx)
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "already a member of the guild",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// LeaveGuild godoc
+//
+//	@Description	The user is kicked from the channels of the guild and loses the roles in them.
+//	@Tags			guild
+//	@Summary		leave the guild
+//	@Param			uri				path	controller.LeaveGuild.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		404	"not a member of the guild"
+//	@Failure		409	"guild owner cannot leave, transfer the guild first"
+//	@Router			/guilds/{id}/leave [post]
+func (*Controller) LeaveGuild(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	role, err := getGuildRole(tx, uri.ID, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if role == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "not a member of the guild",
+		})
+		return
+	}
+
+	if role == roleGuildOwner {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "guild owner cannot leave, transfer the guild first",
+		})
+		return
+	}
+
+	if err := removeFromGuild(tx, uri.ID, userID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickFromGuild(uri.ID, userID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// TransferGuild godoc
+//
+//	@Description	The new owner must be a member of the guild. The previous owner becomes a moderator.
+//	@Tags			guild
+//	@Summary		transfer the ownership of the guild to another member
+//	@Param			uri				path	controller.TransferGuild.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.TransferGuild.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Guild
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or member"
+//	@Router			/guilds/{id}/transfer [post]
+func (*Controller) TransferGuild(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		UserID int `json:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, roleGuildOwner); !ok {
+		return
+	}
+
+	role, err := getGuildRole(tx, guild.ID, body.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if role == "" || role == roleGuildOwner {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find member",
+		})
+		return
+	}
+
+	// The previous owner stays on as a moderator.
+	_, err = tx.GuildMember.
+		Update().
+		Where(
+			guildmember.GuildID(guild.ID),
+			guildmember.UserID(guild.OwnerID),
+		).
+		SetRole(guildmember.RoleModerator).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	guild, err = guild.
+		Update().
+		SetOwnerID(body.UserID).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	refreshGuildRoles(guild.ID)
+	roomListUpdated(guild.ID)
+
+	c.JSON(http.StatusOK, guild)
+}
+
+// getGuildRole returns the role of the user in the guild, or "" if the user is
+// not a member of it.
+func getGuildRole(tx *ent.Tx, guildID, userID int) (guildmember.Role, error) {
+	guild, err := tx.Guild.Get(ctx, guildID)
+	if ent.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if guild.OwnerID == userID {
+		return roleGuildOwner, nil
+	}
+
+	member, err := tx.GuildMember.
+		Query().
+		Where(
+			guildmember.GuildID(guildID),
+			guildmember.UserID(userID),
+		).
+		Only(ctx)
+	if ent.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return member.Role, nil
+}
+
+// authorizeInGuild responds with 403 unless the current user has at least the
+// required role in the guild.
+func authorizeInGuild(c *gin.Context, tx *ent.Tx, guild *ent.Guild, required guildmember.Role) (guildmember.Role, bool) {
+	role, err := getGuildRole(tx, guild.ID, getCurrentUserID(c))
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return role, false
+	}
+
+	if guildRoleRanks[role] < guildRoleRanks[required] {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the guild",
+		})
+		return role, false
+	}
+
+	return role, true
+}
+
+// removeFromGuild removes the user from the guild, along with the roles in its
+// channels and the memberships of its private channels.
+func removeFromGuild(tx *ent.Tx, guildID, userID int) error {
+	_, err := tx.GuildMember.
+		Delete().
+		Where(
+			guildmember.GuildID(guildID),
+			guildmember.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	channelIDs, err := tx.Chatroom.
+		Query().
+		Where(chatroom.GuildID(guildID)).
+		IDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ChatroomRole.
+		Delete().
+		Where(
+			chatroomrole.ChatroomIDIn(channelIDs...),
+			chatroomrole.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Membership.
+		Delete().
+		Where(
+			membership.ChatroomIDIn(channelIDs...),
+			membership.UserID(userID),
+		).
+		Exec(ctx)
+	return err
+}
+
+// archiveGuild archives the guild along with all channels in it.
+func archiveGuild(tx *ent.Tx, guild *ent.Guild) error {
+	now := time.Now()
+
+	err := guild.
+		Update().
+		ClearOwnerID().
+		SetArchivedAt(now).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Chatroom.
+		Update().
+		Where(chatroom.GuildID(guild.ID)).
+		SetArchivedAt(now).
+		Save(ctx)
+	return err
+}
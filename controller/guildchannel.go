@@ -0,0 +1,469 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/chatroom"
+	"disgord/ent/guildcategory"
+	"disgord/ent/guildmember"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetGuildChannels godoc
+//
+//	@Description	Channels without a category come first, then the categories with the channels in them, in ascending order of position.
+//	@Tags			guild
+//	@Summary		list the channels of the guild by category
+//	@Param			uri				path	controller.GetGuildChannels.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.GetGuildChannels.Response
+//	@Failure		401
+//	@Failure		404	"cannot find guild"
+//	@Router			/guilds/{id}/channels [get]
+func (*Controller) GetGuildChannels(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Category struct {
+		*ent.GuildCategory
+		Channels []*ent.Chatroom `json:"channels" binding:"required"`
+	}
+
+	type Response struct {
+		Channels   []*ent.Chatroom `json:"channels" binding:"required"`
+		Categories []Category      `json:"categories" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	guild, err := client.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	categories, err := guild.
+		QueryCategories().
+		Order(
+			guildcategory.ByPosition(sql.OrderAsc()),
+			guildcategory.ByID(sql.OrderAsc()),
+		).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	channels, err := guild.
+		QueryChannels().
+		Order(
+			chatroom.ByPosition(sql.OrderAsc()),
+			chatroom.ByID(sql.OrderAsc()),
+		).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	response := Response{
+		Channels:   make([]*ent.Chatroom, 0),
+		Categories: make([]Category, 0, len(categories)),
+	}
+
+	categoryIndexes := make(map[int]int, len(categories))
+	for i, category := range categories {
+		categoryIndexes[category.ID] = i
+		response.Categories = append(response.Categories, Category{
+			GuildCategory: category,
+			Channels:      make([]*ent.Chatroom, 0),
+		})
+	}
+
+	for _, channel := range channels {
+		i, ok := categoryIndexes[channel.CategoryID]
+		if !ok {
+			response.Channels = append(response.Channels, channel)
+			continue
+		}
+
+		response.Categories[i].Channels = append(response.Categories[i].Channels, channel)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// CreateGuildChannel godoc
+//
+//	@Description	It requires a moderator of the guild. If password is provided, the channel is private.
+//	@Tags			guild
+//	@Summary		create a new channel in the guild
+//	@Param			uri				path	controller.CreateGuildChannel.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateGuildChannel.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.Chatroom
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild, or guild archived"
+//	@Failure		404	"cannot find guild or category"
+//	@Router			/guilds/{id}/channels [post]
+func (*Controller) CreateGuildChannel(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Name       string        `json:"name" binding:"required"`
+		Type       chatroom.Type `json:"type" binding:"omitempty,oneof=text voice stage" enums:"text,voice,stage"`
+		CategoryID int           `json:"categoryId"`
+		Position   int           `json:"position"`
+		Password   string        `json:"password"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if guild.ArchivedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "guild archived",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	if !findGuildCategory(c, tx, guild.ID, body.CategoryID) {
+		return
+	}
+
+	chatroomCreate := tx.Chatroom.
+		Create().
+		SetName(body.Name).
+		SetGuildID(guild.ID).
+		SetPosition(body.Position).
+		SetProfileColorIndex(guild.ProfileColorIndex)
+	if body.CategoryID != 0 {
+		chatroomCreate = chatroomCreate.SetCategoryID(body.CategoryID)
+	}
+	if body.Type != "" {
+		chatroomCreate = chatroomCreate.SetType(body.Type)
+	}
+	if body.Password != "" {
+		chatroomCreate = chatroomCreate.
+			SetIsPrivate(true).
+			SetPassword(hashPassword(body.Password)).
+			AddMemberIDs(userID)
+	}
+
+	chatroom, err := chatroomCreate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roomListUpdated(guild.ID)
+
+	c.JSON(http.StatusCreated, chatroom)
+}
+
+// CreateGuildCategory godoc
+//
+//	@Description	It requires a moderator of the guild.
+//	@Tags			guild
+//	@Summary		create a new category of channels in the guild
+//	@Param			uri				path	controller.CreateGuildCategory.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateGuildCategory.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.GuildCategory
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild"
+//	@Router			/guilds/{id}/categories [post]
+func (*Controller) CreateGuildCategory(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Name     string `json:"name" binding:"required"`
+		Position int    `json:"position"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	category, err := tx.GuildCategory.
+		Create().
+		SetGuildID(guild.ID).
+		SetName(body.Name).
+		SetPosition(body.Position).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roomListUpdated(guild.ID)
+
+	c.JSON(http.StatusCreated, category)
+}
+
+// UpdateGuildCategory godoc
+//
+//	@Description	It requires a moderator of the guild.
+//	@Tags			guild
+//	@Summary		rename or move the category
+//	@Param			uri				path	controller.UpdateGuildCategory.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.UpdateGuildCategory.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.GuildCategory
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or category"
+//	@Router			/guilds/{id}/categories/{categoryId} [patch]
+func (*Controller) UpdateGuildCategory(c *gin.Context) {
+	type Uri struct {
+		ID         int `uri:"id" binding:"required"`
+		CategoryID int `uri:"categoryId" binding:"required"`
+	}
+
+	type Body struct {
+		Name     string `json:"name"`
+		Position *int   `json:"position"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	categoryUpdate := tx.GuildCategory.
+		UpdateOneID(uri.CategoryID).
+		Where(guildcategory.GuildID(guild.ID)).
+		SetNillablePosition(body.Position)
+	if body.Name != "" {
+		categoryUpdate = categoryUpdate.SetName(body.Name)
+	}
+
+	category, err := categoryUpdate.Save(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find category",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roomListUpdated(guild.ID)
+
+	c.JSON(http.StatusOK, category)
+}
+
+// DeleteGuildCategory godoc
+//
+//	@Description	It requires a moderator of the guild. The channels in the category are kept without a category.
+//	@Tags			guild
+//	@Summary		delete the category
+//	@Param			uri				path	controller.DeleteGuildCategory.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or category"
+//	@Router			/guilds/{id}/categories/{categoryId} [delete]
+func (*Controller) DeleteGuildCategory(c *gin.Context) {
+	type Uri struct {
+		ID         int `uri:"id" binding:"required"`
+		CategoryID int `uri:"categoryId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator); !ok {
+		return
+	}
+
+	err = tx.GuildCategory.
+		DeleteOneID(uri.CategoryID).
+		Where(guildcategory.GuildID(guild.ID)).
+		Exec(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find category",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	roomListUpdated(guild.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// findGuildCategory responds with 404 unless the category is in the guild. A
+// categoryID of 0 is no category, and is always found.
+func findGuildCategory(c *gin.Context, tx *ent.Tx, guildID, categoryID int) bool {
+	if categoryID == 0 {
+		return true
+	}
+
+	exists, err := tx.GuildCategory.
+		Query().
+		Where(
+			guildcategory.ID(categoryID),
+			guildcategory.GuildID(guildID),
+		).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find category",
+		})
+		return false
+	}
+
+	return true
+}
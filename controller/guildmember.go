@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/guildmember"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetGuildMembers godoc
+//
+//	@Description	The owner of the guild is listed as well, with the role kept from before the ownership.
+//	@Tags			guild
+//	@Summary		list the members of the guild
+//	@Param			uri				path	controller.GetGuildMembers.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	ent.GuildMember
+//	@Failure		401
+//	@Router			/guilds/{id}/members [get]
+func (*Controller) GetGuildMembers(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	members, err := client.GuildMember.
+		Query().
+		Where(guildmember.GuildID(uri.ID)).
+		Order(guildmember.ByCreatedAt(sql.OrderAsc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// UpdateGuildMemberRole godoc
+//
+//	@Description	Moderators of the guild are moderators in every channel of it, and may manage the channels and categories.
+//	@Tags			guild
+//	@Summary		give a member a role in the guild
+//	@Param			uri				path	controller.UpdateGuildMemberRole.Uri	true	"path"
+//	@Param			Authorization	header	string									true	"Bearer AccessToken"
+//	@Param			body			body	controller.UpdateGuildMemberRole.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.GuildMember
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or member"
+//	@Router			/guilds/{id}/members/{userId} [put]
+func (*Controller) UpdateGuildMemberRole(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	type Body struct {
+		Role guildmember.Role `json:"role" binding:"required,oneof=moderator member" enums:"moderator,member"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	if _, ok := authorizeInGuild(c, tx, guild, roleGuildOwner); !ok {
+		return
+	}
+
+	member, err := tx.GuildMember.
+		Query().
+		Where(
+			guildmember.GuildID(guild.ID),
+			guildmember.UserID(uri.UserID),
+		).
+		Only(ctx)
+	if err != nil || member.UserID == guild.OwnerID {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find member",
+		})
+		return
+	}
+
+	member, err = member.
+		Update().
+		SetRole(body.Role).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	refreshGuildRoles(guild.ID)
+
+	c.JSON(http.StatusOK, member)
+}
+
+// DeleteGuildMember godoc
+//
+//	@Description	It requires a role in the guild above the role of the member. The member may join again.
+//	@Tags			guild
+//	@Summary		kick a member out of the guild
+//	@Param			uri				path	controller.DeleteGuildMember.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the guild"
+//	@Failure		404	"cannot find guild or member"
+//	@Router			/guilds/{id}/members/{userId} [delete]
+func (*Controller) DeleteGuildMember(c *gin.Context) {
+	type Uri struct {
+		ID     int `uri:"id" binding:"required"`
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	guild, err := tx.Guild.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find guild",
+		})
+		return
+	}
+
+	current, ok := authorizeInGuild(c, tx, guild, guildmember.RoleModerator)
+	if !ok {
+		return
+	}
+
+	target, err := getGuildRole(tx, guild.ID, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if target == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find member",
+		})
+		return
+	}
+
+	if guildRoleRanks[current] <= guildRoleRanks[target] {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the guild",
+		})
+		return
+	}
+
+	if err := removeFromGuild(tx, guild.ID, uri.UserID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickFromGuild(guild.ID, uri.UserID)
+	broadcastToUsers([]int{uri.UserID}, guildListUpdated(guild.ID))
+
+	c.Status(http.StatusNoContent)
+}
+
+// isGuildMember reports whether the user is a member of the guild.
+func isGuildMember(tx *ent.Tx, guildID, userID int) (bool, error) {
+	return tx.GuildMember.
+		Query().
+		Where(
+			guildmember.GuildID(guildID),
+			guildmember.UserID(userID),
+		).
+		Exist(ctx)
+}
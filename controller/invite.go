@@ -0,0 +1,441 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/invite"
+	"disgord/ent/inviteredemption"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateInvite godoc
+//
+//	@Description	It requires the invite permission. Share the code, e.g. as a link to the web client, to be accepted at /invites/{code}/accept.
+//	@Description	Without maxUses or expiresAt, the invite can be accepted any number of times until revoked.
+//	@Description	With targetUserId, only the user can accept it.
+//	@Tags			chatroom
+//	@Summary		create an invite to the chatroom
+//	@Param			uri				path	controller.CreateInvite.Uri		true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.CreateInvite.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.Invite
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or user"
+//	@Router			/chatrooms/{id}/invites [post]
+func (*Controller) CreateInvite(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		MaxUses      *int       `json:"maxUses" binding:"omitempty,min=1"`
+		ExpiresAt    *time.Time `json:"expiresAt" binding:"omitempty,gt"`
+		TargetUserID *int       `json:"targetUserId"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionInvite); !ok {
+		return
+	}
+
+	invite, err := tx.Invite.
+		Create().
+		SetCode(randomToken(8)).
+		SetChatroomID(chatroom.ID).
+		SetCreatorID(getCurrentUserID(c)).
+		SetNillableTargetUserID(body.TargetUserID).
+		SetNillableMaxUses(body.MaxUses).
+		SetNillableExpiresAt(body.ExpiresAt).
+		Save(ctx)
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// GetChatroomInvites godoc
+//
+//	@Description	It requires the manage room permission. Revoked and expired invites are listed as well, with the users who joined through them in redemptions.
+//	@Tags			chatroom
+//	@Summary		list invites to the chatroom
+//	@Param			uri				path	controller.GetChatroomInvites.Uri	true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.GetChatroomInvites.Response
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom"
+//	@Router			/chatrooms/{id}/invites [get]
+func (*Controller) GetChatroomInvites(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom); !ok {
+		return
+	}
+
+	invites, err := tx.Invite.
+		Query().
+		Where(invite.ChatroomID(chatroom.ID)).
+		WithRedemptions().
+		Order(invite.ByCreatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	type Response struct {
+		*ent.Invite
+		Redemptions []*ent.InviteRedemption `json:"redemptions" binding:"required"`
+	}
+
+	response := make([]Response, 0, len(invites))
+	for _, invite := range invites {
+		response = append(response, Response{
+			Invite:      invite,
+			Redemptions: invite.Edges.Redemptions,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeInvite godoc
+//
+//	@Description	It requires the manage room permission, unless the current user created the invite.
+//	@Tags			chatroom
+//	@Summary		revoke an invite to the chatroom
+//	@Param			uri				path	controller.RevokeInvite.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or invite"
+//	@Router			/chatrooms/{id}/invites/{inviteId} [delete]
+func (*Controller) RevokeInvite(c *gin.Context) {
+	type Uri struct {
+		ID       int `uri:"id" binding:"required"`
+		InviteID int `uri:"inviteId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	invite, err := tx.Invite.
+		Query().
+		Where(
+			invite.ID(uri.InviteID),
+			invite.ChatroomID(chatroom.ID),
+			invite.RevokedAtIsNil(),
+		).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find invite",
+		})
+		return
+	}
+
+	if invite.CreatorID != getCurrentUserID(c) {
+		if _, ok := authorizeInRoom(c, tx, chatroom, PermissionManageRoom); !ok {
+			return
+		}
+	}
+
+	err = invite.
+		Update().
+		SetRevokedAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AcceptInvite godoc
+//
+//	@Description	The user becomes a member of the chatroom, and joins it without the password from then on.
+//	@Description	Accepting an invite to a chatroom the user is already a member of does not use it up.
+//	@Description	An invite to a channel of a guild lets the user into the guild as well.
+//	@Tags			chatroom
+//	@Summary		accept an invite to a chatroom
+//	@Param			uri				path	controller.AcceptInvite.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Chatroom
+//	@Failure		401
+//	@Failure		403	"invite for another user, banned from the chatroom, or chatroom archived"
+//	@Failure		404	"invalid or expired invite"
+//	@Router			/invites/{code}/accept [post]
+func (*Controller) AcceptInvite(c *gin.Context) {
+	type Uri struct {
+		Code string `uri:"code" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	invite, err := tx.Invite.
+		Query().
+		Where(
+			invite.Code(uri.Code),
+			invite.RevokedAtIsNil(),
+			invite.Or(
+				invite.ExpiresAtIsNil(),
+				invite.ExpiresAtGT(time.Now()),
+			),
+		).
+		WithChatroom().
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "invalid or expired invite",
+		})
+		return
+	}
+	chatroom := invite.Edges.Chatroom
+
+	if chatroom.ArchivedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "chatroom archived",
+		})
+		return
+	}
+
+	if invite.TargetUserID != nil && *invite.TargetUserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "invite for another user",
+		})
+		return
+	}
+
+	banned, err := isBannedFromRoom(tx, chatroom.ID, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if banned {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "banned from the chatroom",
+		})
+		return
+	}
+
+	isMember, err := chatroom.QueryMembers().
+		Where(user.ID(userID)).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// Public chatrooms have no members, so whoever accepted the invite before
+	// is in already.
+	redeemed, err := tx.InviteRedemption.
+		Query().
+		Where(
+			inviteredemption.InviteID(invite.ID),
+			inviteredemption.UserID(userID),
+		).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	alreadyIn := isMember || chatroom.OwnerID == userID || !chatroom.IsPrivate && redeemed
+	inGuild := true
+	if chatroom.GuildID != 0 {
+		inGuild, err = isGuildMember(tx, chatroom.GuildID, userID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		alreadyIn = inGuild && (isMember || !chatroom.IsPrivate)
+	}
+
+	if alreadyIn {
+		c.JSON(http.StatusOK, chatroom)
+		return
+	}
+
+	if invite.MaxUses != nil && invite.Uses >= *invite.MaxUses {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "invalid or expired invite",
+		})
+		return
+	}
+
+	if !inGuild {
+		err = tx.GuildMember.
+			Create().
+			SetGuildID(chatroom.GuildID).
+			SetUserID(userID).
+			Exec(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	// Public chatrooms have no members, but who joined through the invite is
+	// recorded all the same.
+	if chatroom.IsPrivate {
+		err = chatroom.Update().
+			AddMemberIDs(userID).
+			Exec(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	err = tx.InviteRedemption.
+		Create().
+		SetInviteID(invite.ID).
+		SetUserID(userID).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = invite.
+		Update().
+		AddUses(1).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, chatroom)
+}
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyDir holds the signing keys as <kid>.pem, and the kid of the key used for
+// signing in the active file. The other keys are only used for verification,
+// so that tokens signed before a rotation stay valid until they expire.
+const keyDir = "keys"
+
+// legacyKid is the kid of the single key used before the key ring was
+// introduced, which signed its tokens without kid.
+const legacyKid = "disgord"
+
+type keyRing struct {
+	active string
+	keys   map[string]*ecdsa.PrivateKey
+}
+
+var ring *keyRing
+
+// loadKeys loads the key ring, or the single key used before it.
+func loadKeys() {
+	var err error
+
+	ring, err = loadKeyRing(keyDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// Fall back to the single key used before the key ring was introduced.
+		ring, err = loadLegacyKey(legacyKid + ".pem")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadKeyRing(dir string) (*keyRing, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	ring := &keyRing{
+		keys: make(map[string]*ecdsa.PrivateKey),
+	}
+
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := jwt.ParseECPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, err
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		ring.keys[kid] = key
+	}
+
+	// The active key is always chosen explicitly, since kids do not tell which
+	// key is the newest, e.g. the legacy key sorts after the generated ones.
+	b, err := os.ReadFile(filepath.Join(dir, "active"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("no active key, run go run keygen.go activate KID")
+	}
+	if err != nil {
+		return nil, err
+	}
+	ring.active = strings.TrimSpace(string(b))
+
+	if _, ok := ring.keys[ring.active]; !ok {
+		return nil, errors.New("active key " + ring.active + " is not in the key ring")
+	}
+
+	return ring, nil
+}
+
+func loadLegacyKey(path string) (*keyRing, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyRing{
+		active: legacyKid,
+		keys:   map[string]*ecdsa.PrivateKey{legacyKid: key},
+	}, nil
+}
+
+// signToken signs the claims with the active key, stamping its kid header.
+func signToken(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = ring.active
+
+	return token.SignedString(ring.keys[ring.active])
+}
+
+// verificationKey selects the public key by the kid header of the token.
+// Tokens without kid were signed before the key ring, by the legacy key.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = legacyKid
+	}
+
+	key, ok := ring.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown key id " + kid)
+	}
+
+	return key.Public(), nil
+}
+
+type JWK struct {
+	Kty string `json:"kty" binding:"required"`
+	Crv string `json:"crv" binding:"required"`
+	X   string `json:"x" binding:"required"`
+	Y   string `json:"y" binding:"required"`
+	Kid string `json:"kid" binding:"required"`
+	Use string `json:"use" binding:"required"`
+	Alg string `json:"alg" binding:"required"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys" binding:"required"`
+}
+
+// GetJWKS godoc
+//
+//	@Description	Other services can validate access tokens with these keys, selected by the kid header of the token.
+//	@Tags			auth
+//	@Summary		list public keys to verify tokens
+//	@Success		200	{object}	controller.JWKS
+//	@Router			/.well-known/jwks.json [get]
+func (*Controller) GetJWKS(c *gin.Context) {
+	kids := make([]string, 0, len(ring.keys))
+	for kid := range ring.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := JWKS{
+		Keys: make([]JWK, 0, len(kids)),
+	}
+	for _, kid := range kids {
+		key := ring.keys[kid]
+		size := (key.Curve.Params().BitSize + 7) / 8
+
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodES256.Name,
+		})
+	}
+
+	c.JSON(http.StatusOK, jwks)
+}
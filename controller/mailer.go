@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends a plain text mail.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+func init() {
+	switch {
+	case config.SMTPAddr != "":
+		mailer = newSMTPMailer(config.SMTPAddr, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+
+	case config.MailFile != "":
+		file, err := os.OpenFile(config.MailFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		mailer = newWriterMailer(file, config.MailFrom)
+
+	default:
+		mailer = newWriterMailer(log.Writer(), config.MailFrom)
+	}
+}
+
+// sendMail sends the mail in the background, so that the response time does
+// not tell whether a mail was sent.
+func sendMail(to, subject, body string) {
+	go func() {
+		if err := mailer.Send(to, subject, body); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// SMTPMailer sends mails through an SMTP server, authenticating with PLAIN
+// if the username is given.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPMailer(addr, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		addr: addr,
+		auth: auth,
+		from: from,
+	}
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, composeMail(m.from, to, subject, body))
+}
+
+// WriterMailer writes mails to a file or the log instead of sending them,
+// for development.
+type WriterMailer struct {
+	lock sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func newWriterMailer(w io.Writer, from string) *WriterMailer {
+	return &WriterMailer{
+		w:    w,
+		from: from,
+	}
+}
+
+func (m *WriterMailer) Send(to, subject, body string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := m.w.Write(append(composeMail(m.from, to, subject, body), '\n'))
+	return err
+}
+
+func composeMail(from, to, subject, body string) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
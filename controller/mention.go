@@ -0,0 +1,407 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/chat"
+	"disgord/ent/guildmember"
+	"disgord/ent/mention"
+	"disgord/ent/relationship"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// mentionPattern matches @username, @here and @everyone, but not the @ of an
+// email address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w])@([\w.-]*\w)`)
+
+// Notification is a mention of the user in a chat.
+type Notification struct {
+	*ent.Mention
+	Chat  *ent.Chat `json:"chat" binding:"required"`
+	Name  string    `json:"displayName" binding:"required"`
+	Color uint8     `json:"profileColorIndex" binding:"required"`
+}
+
+// GetMyMentions godoc
+//
+//	@Description	It supports latest-first paging by offset and limit, and returns in latest-first order.
+//	@Description	With unread, only the mentions not marked as read are listed.
+//	@Tags			user
+//	@Summary		list the mentions of the current user
+//	@Param			q				query	controller.GetMyMentions.Query	false	"query"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.Notification
+//	@Failure		401
+//	@Router			/users/me/mentions [get]
+func (*Controller) GetMyMentions(c *gin.Context) {
+	type Query struct {
+		Unread bool `form:"unread"`
+		Offset int  `form:"offset"`
+		Limit  int  `form:"limit"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	mentionQuery := client.Mention.
+		Query().
+		Where(mention.UserID(getCurrentUserID(c))).
+		Order(mention.ByID(sql.OrderDesc()))
+	if query.Unread {
+		mentionQuery = mentionQuery.Where(mention.ReadAtIsNil())
+	}
+	if query.Offset != 0 {
+		mentionQuery = mentionQuery.Offset(query.Offset)
+	}
+	if query.Limit != 0 {
+		mentionQuery = mentionQuery.Limit(query.Limit)
+	}
+
+	mentions, err := mentionQuery.
+		WithChat(func(cq *ent.ChatQuery) {
+			cq.WithSender(func(uq *ent.UserQuery) {
+				uq.Select(user.FieldDisplayName, user.FieldProfileColorIndex)
+			})
+		}).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	response := make([]Notification, 0, len(mentions))
+	for _, mention := range mentions {
+		response = append(response, newNotification(mention, mention.Edges.Chat))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateMyMention godoc
+//
+//	@Tags		user
+//	@Summary	mark the mention of the current user as read or unread
+//	@Param		uri				path	controller.UpdateMyMention.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Param		body			body	controller.UpdateMyMention.Body	true	"Request body"
+//	@Security	BearerAuth
+//	@Success	200	{object}	ent.Mention
+//	@Failure	401
+//	@Failure	404	"cannot find mention"
+//	@Router		/users/me/mentions/{id} [patch]
+func (*Controller) UpdateMyMention(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Read *bool `json:"read" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	mention, err := client.Mention.
+		Query().
+		Where(
+			mention.ID(uri.ID),
+			mention.UserID(getCurrentUserID(c)),
+		).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find mention",
+		})
+		return
+	}
+
+	mentionUpdate := mention.Update()
+	if *body.Read {
+		if mention.ReadAt == nil {
+			mentionUpdate = mentionUpdate.SetReadAt(time.Now())
+		}
+	} else {
+		mentionUpdate = mentionUpdate.ClearReadAt()
+	}
+
+	mention, err = mentionUpdate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, mention)
+}
+
+// ReadMyMentions godoc
+//
+//	@Description	With chatroomId, only the mentions in the chatroom are marked as read.
+//	@Tags			user
+//	@Summary		mark the mentions of the current user as read
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.ReadMyMentions.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Router			/users/me/mentions/read [post]
+func (*Controller) ReadMyMentions(c *gin.Context) {
+	type Body struct {
+		ChatroomID int `json:"chatroomId"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	mentionUpdate := client.Mention.
+		Update().
+		Where(
+			mention.UserID(getCurrentUserID(c)),
+			mention.ReadAtIsNil(),
+		)
+	if body.ChatroomID != 0 {
+		mentionUpdate = mentionUpdate.Where(mention.HasChatWith(chat.ChatroomID(body.ChatroomID)))
+	}
+
+	err := mentionUpdate.
+		SetReadAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func newNotification(mention *ent.Mention, chat *ent.Chat) Notification {
+	return Notification{
+		Mention: mention,
+		Chat:    chat,
+		Name:    chat.Edges.Sender.DisplayName,
+		Color:   chat.Edges.Sender.ProfileColorIndex,
+	}
+}
+
+// parseMentions returns the usernames mentioned in the content, and whether
+// @here or @everyone is mentioned.
+func parseMentions(content string) (usernames []string, here, everyone bool) {
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		switch match[1] {
+		case "here":
+			here = true
+		case "everyone":
+			everyone = true
+		default:
+			usernames = append(usernames, match[1])
+		}
+	}
+
+	return usernames, here, everyone
+}
+
+// saveMentions saves the mentions in the chat sent with the permissions in its
+// chatroom. @here and @everyone require the mention everyone permission, and
+// are ignored otherwise. Users who cannot see the chatroom, and users blocked
+// by or blocking the sender, are not mentioned.
+func saveMentions(client *ent.Client, chat *ent.Chat, permissions Permission) ([]*ent.Mention, error) {
+	usernames, here, everyone := parseMentions(chat.Content)
+	if !permissions.Has(PermissionMentionEveryone) {
+		here, everyone = false, false
+	}
+	if len(usernames) == 0 && !here && !everyone {
+		return nil, nil
+	}
+
+	chatroom, err := client.Chatroom.Get(ctx, chat.ChatroomID)
+	if err != nil {
+		return nil, err
+	}
+
+	audienceIDs, public, err := getRoomAudience(client, chatroom)
+	if err != nil {
+		return nil, err
+	}
+
+	inAudience := make(map[int]bool, len(audienceIDs))
+	for _, id := range audienceIDs {
+		inAudience[id] = true
+	}
+
+	types := make(map[int]mention.Type)
+	if everyone {
+		for _, id := range audienceIDs {
+			types[id] = mention.TypeEveryone
+		}
+	}
+
+	if room, ok := getRoom(chatroom.ID); ok && here {
+		for _, id := range room.userIDs() {
+			types[id] = mention.TypeHere
+		}
+	}
+
+	mentionedIDs, err := client.User.
+		Query().
+		Where(user.UsernameIn(usernames...)).
+		IDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range mentionedIDs {
+		if public || inAudience[id] {
+			types[id] = mention.TypeUser
+		}
+	}
+
+	delete(types, chat.SenderID)
+
+	userIDs := make([]int, 0, len(types))
+	for id := range types {
+		userIDs = append(userIDs, id)
+	}
+
+	blocks, err := client.Relationship.
+		Query().
+		Where(
+			relationship.TypeEQ(relationship.TypeBlocked),
+			relationship.Or(
+				relationship.And(
+					relationship.UserIDIn(userIDs...),
+					relationship.TargetID(chat.SenderID),
+				),
+				relationship.And(
+					relationship.UserID(chat.SenderID),
+					relationship.TargetIDIn(userIDs...),
+				),
+			),
+		).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range blocks {
+		delete(types, block.UserID)
+		delete(types, block.TargetID)
+	}
+
+	mentionCreates := make([]*ent.MentionCreate, 0, len(types))
+	for id, typ := range types {
+		mentionCreates = append(mentionCreates, client.Mention.
+			Create().
+			SetChatID(chat.ID).
+			SetUserID(id).
+			SetType(typ),
+		)
+	}
+
+	return client.Mention.
+		CreateBulk(mentionCreates...).
+		Save(ctx)
+}
+
+// getRoomAudience returns the IDs of the users who can see the chatroom, or
+// whether everyone can. For a chatroom everyone can see, the users who have
+// sent chats in it are returned instead.
+func getRoomAudience(client *ent.Client, chatroom *ent.Chatroom) (userIDs []int, public bool, err error) {
+	ownerID := chatroom.OwnerID
+
+	switch {
+	case chatroom.GuildID == 0 && !chatroom.IsPrivate:
+		public = true
+		userIDs, err = chatroom.
+			QueryChats().
+			Unique(true).
+			Select(chat.FieldSenderID).
+			Ints(ctx)
+
+	case chatroom.GuildID == 0:
+		userIDs, err = chatroom.
+			QueryMembers().
+			IDs(ctx)
+
+	default:
+		var guild *ent.Guild
+		guild, err = client.Guild.Get(ctx, chatroom.GuildID)
+		if err != nil {
+			return nil, false, err
+		}
+		ownerID = guild.OwnerID
+
+		userIDs, err = client.GuildMember.
+			Query().
+			Where(guildmember.GuildID(guild.ID)).
+			Select(guildmember.FieldUserID).
+			Ints(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Private channels are seen by the members of both the guild and
+		// the channel.
+		if chatroom.IsPrivate {
+			userIDs, err = chatroom.
+				QueryMembers().
+				Where(user.IDIn(userIDs...)).
+				IDs(ctx)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Archived chatrooms and guilds have no owner.
+	if ownerID != 0 {
+		userIDs = append(userIDs, ownerID)
+	}
+
+	return userIDs, public, nil
+}
+
+// deliverMentions sends MENTION to every connection of the mentioned users,
+// whether or not they are in the chatroom.
+func deliverMentions(mentions []*ent.Mention, chat *ent.Chat, name string, color uint8) {
+	for _, mention := range mentions {
+		notification := Notification{
+			Mention: mention,
+			Chat:    chat,
+			Name:    name,
+			Color:   color,
+		}
+		b, _ := json.Marshal(notification)
+
+		broadcastToUsers([]int{mention.UserID}, &Message{
+			Action:    MentionAction,
+			Content:   string(b),
+			Name:      name,
+			Color:     color,
+			CreatedAt: &chat.CreatedAt,
+			ChatID:    chat.ID,
+			senderID:  chat.SenderID,
+		})
+	}
+}
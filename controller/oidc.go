@@ -0,0 +1,404 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/identity"
+	"disgord/ent/securityevent"
+	"disgord/ent/user"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+var (
+	oidcLock     sync.Mutex
+	oidcProvider *oidc.Provider
+)
+
+// getOIDCProvider discovers the provider on first use, so that the server
+// starts even if the provider is down.
+func getOIDCProvider() (*oidc.Provider, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(ctx, config.OIDCIssuer)
+		if err != nil {
+			return nil, err
+		}
+
+		oidcProvider = provider
+	}
+
+	return oidcProvider, nil
+}
+
+func newOAuth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  config.OIDCRedirectURL,
+		Scopes:       config.OIDCScopes,
+	}
+}
+
+// oidcAudience marks the token carrying the state of the authorization
+// request in a cookie until the provider redirects back.
+const oidcAudience = "oidc-sign-in"
+
+type oidcClaims struct {
+	State      string `json:"state"`
+	Nonce      string `json:"nonce"`
+	Verifier   string `json:"verifier"`
+	DeviceName string `json:"deviceName,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// BeginOIDCSignIn godoc
+//
+//	@Description	Navigate the browser to it instead of fetching it. It redirects to the OpenID Connect provider,
+//	@Description	which redirects back to /auth/oidc/callback after the user signed in there.
+//	@Tags			auth
+//	@Summary		sign in with the OpenID Connect provider
+//	@Param			q	query	controller.BeginOIDCSignIn.Query	false	"query"
+//	@Success		302
+//	@Failure		404	"OpenID Connect not configured"
+//	@Failure		503	"cannot reach the OpenID Connect provider"
+//	@Router			/auth/oidc/login [get]
+func (*Controller) BeginOIDCSignIn(c *gin.Context) {
+	type Query struct {
+		DeviceName string `form:"deviceName"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	if config.OIDCIssuer == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "OpenID Connect not configured",
+		})
+		return
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "cannot reach the OpenID Connect provider",
+		})
+		log.Println(err)
+		return
+	}
+
+	claims := oidcClaims{
+		State:      randomToken(16),
+		Nonce:      randomToken(16),
+		Verifier:   oauth2.GenerateVerifier(),
+		DeviceName: query.DeviceName,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{oidcAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 10)),
+		},
+	}
+
+	stateToken, err := signToken(claims)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// Lax, since the provider redirects back with a top-level navigation.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("oidcState", stateToken, 60*10, "/auth/oidc", "", true, true)
+
+	c.Redirect(http.StatusFound, newOAuth2Config(provider).AuthCodeURL(
+		claims.State,
+		oidc.Nonce(claims.Nonce),
+		oauth2.S256ChallengeOption(claims.Verifier),
+	))
+}
+
+// FinishOIDCSignIn godoc
+//
+//	@Description	The OpenID Connect provider redirects the browser to it.
+//	@Description	On success, it sets the refresh token cookie and redirects to the web client, which gets an access token at /auth/refresh.
+//	@Description	If the user enabled two-factor authentication, it redirects to /sign-in/2fa?challengeToken=${challengeToken} of the web client instead.
+//	@Description	On failure, it redirects to /sign-in?error=${error} of the web client.
+//	@Tags			auth
+//	@Summary		finish signing in with the OpenID Connect provider
+//	@Param			q	query	controller.FinishOIDCSignIn.Query	true	"query"
+//	@Success		302
+//	@Router			/auth/oidc/callback [get]
+func (*Controller) FinishOIDCSignIn(c *gin.Context) {
+	type Query struct {
+		Code  string `form:"code"`
+		State string `form:"state"`
+		Error string `form:"error"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	fail := func(reason string) {
+		c.Redirect(http.StatusFound, config.AppURL+"/sign-in?"+url.Values{"error": {reason}}.Encode())
+	}
+
+	stateToken, _ := c.Cookie("oidcState")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("oidcState", "", -1, "/auth/oidc", "", true, true)
+
+	if query.Error != "" {
+		fail(query.Error)
+		return
+	}
+
+	claims, err := parseOIDCStateToken(stateToken)
+	if err != nil || subtle.ConstantTimeCompare([]byte(claims.State), []byte(query.State)) != 1 {
+		fail("invalid_state")
+		return
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		fail("provider_unavailable")
+		log.Println(err)
+		return
+	}
+
+	oauth2Token, err := newOAuth2Config(provider).Exchange(ctx, query.Code, oauth2.VerifierOption(claims.Verifier))
+	if err != nil {
+		fail("invalid_code")
+		log.Println(err)
+		return
+	}
+
+	rawIDToken, _ := oauth2Token.Extra("id_token").(string)
+	idToken, err := provider.
+		Verifier(&oidc.Config{ClientID: config.OIDCClientID}).
+		Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != claims.Nonce {
+		fail("invalid_id_token")
+		log.Println(err)
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		fail("server_error")
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, reason, err := getOIDCUser(tx, c, idToken)
+	if err != nil {
+		fail("server_error")
+		log.Println(err)
+		return
+	}
+
+	if reason != "" {
+		fail(reason)
+		return
+	}
+
+	if user.Suspended {
+		fail("suspended")
+		return
+	}
+
+	if user.TotpEnabled {
+		if err := tx.Commit(); err != nil {
+			fail("server_error")
+			log.Println(err)
+			return
+		}
+
+		challengeToken, err := issueChallengeToken(user.ID)
+		if err != nil {
+			fail("server_error")
+			log.Println(err)
+			return
+		}
+
+		c.Redirect(http.StatusFound, config.AppURL+"/sign-in/2fa?"+url.Values{"challengeToken": {challengeToken}}.Encode())
+		return
+	}
+
+	_, refreshToken, err := createSession(tx, c, user.ID, claims.DeviceName)
+	if err != nil {
+		fail("server_error")
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		fail("server_error")
+		log.Println(err)
+		return
+	}
+
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie("refreshToken", refreshToken, 60*60*24*14, "/", "", true, true)
+
+	c.Redirect(http.StatusFound, config.AppURL+"/")
+}
+
+func parseOIDCStateToken(stateToken string) (*oidcClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		stateToken,
+		&oidcClaims{},
+		verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Name}),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience(oidcAudience),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Claims.(*oidcClaims), nil
+}
+
+// getOIDCUser returns the user of the identity in the ID token. An identity
+// seen for the first time is linked to the user with the same verified email
+// address, or to a new user created from the claims. If the user cannot be
+// signed in, the reason is returned instead.
+func getOIDCUser(tx *ent.Tx, c *gin.Context, idToken *oidc.IDToken) (*ent.User, string, error) {
+	identity, err := tx.Identity.
+		Query().
+		Where(
+			identity.Issuer(idToken.Issuer),
+			identity.Subject(idToken.Subject),
+		).
+		WithUser().
+		Only(ctx)
+	if err == nil {
+		err = identity.
+			Update().
+			SetLastUsedAt(time.Now()).
+			Exec(ctx)
+		return identity.Edges.User, "", err
+	}
+	if !ent.IsNotFound(err) {
+		return nil, "", err
+	}
+
+	var claims struct {
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, "invalid_id_token", nil
+	}
+
+	var linkedUser *ent.User
+	if claims.Email != "" && claims.EmailVerified {
+		linkedUser, err = tx.User.
+			Query().
+			Where(
+				user.Email(claims.Email),
+				user.EmailVerified(true),
+				user.Bot(false),
+			).
+			Only(ctx)
+		if err != nil && !ent.IsNotFound(err) {
+			return nil, "", err
+		}
+	}
+
+	if linkedUser != nil {
+		err = newSecurityEvent(tx, c, linkedUser.ID, securityevent.TypeIdentityLinked).Exec(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		if !config.OIDCAutoProvision {
+			return nil, "not_provisioned", nil
+		}
+
+		linkedUser, err = provisionOIDCUser(tx, idToken, claims.Name, claims.Email, claims.EmailVerified)
+		if ent.IsConstraintError(err) {
+			return nil, "username_taken", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if linkedUser == nil {
+			return nil, "invalid_id_token", nil
+		}
+	}
+
+	err = tx.Identity.
+		Create().
+		SetUserID(linkedUser.ID).
+		SetIssuer(idToken.Issuer).
+		SetSubject(idToken.Subject).
+		Exec(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return linkedUser, "", nil
+}
+
+// provisionOIDCUser creates a user from the claims of the ID token, or returns
+// nil if the username claim is missing.
+func provisionOIDCUser(tx *ent.Tx, idToken *oidc.IDToken, displayName, email string, emailVerified bool) (*ent.User, error) {
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	username, _ := claims[config.OIDCUsernameClaim].(string)
+	if username == "" {
+		return nil, nil
+	}
+
+	// The user signs in only through the provider, unless a password is set
+	// later on.
+	userCreate := tx.User.
+		Create().
+		SetUsername(username).
+		SetPassword(hashPassword(randomToken(32))).
+		SetProfileColorIndex(generateProfileColorIndex(username, 4))
+	if displayName != "" {
+		userCreate = userCreate.SetDisplayName(displayName)
+	} else {
+		userCreate = userCreate.SetDisplayName(username)
+	}
+
+	if email != "" && emailVerified {
+		taken, err := tx.User.
+			Query().
+			Where(user.Email(email)).
+			Exist(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if !taken {
+			userCreate = userCreate.
+				SetEmail(email).
+				SetEmailVerified(true)
+		}
+	}
+
+	return userCreate.Save(ctx)
+}
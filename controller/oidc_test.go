@@ -0,0 +1,337 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"disgord/ent/identity"
+	"disgord/ent/user"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIssuer is an OpenID Connect provider that signs in whoever the test
+// says, as if the user had signed in at the authorization endpoint.
+type mockIssuer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	codes map[string]authorization
+}
+
+// authorization is what the authorization endpoint saw, kept by the code it
+// issued until the code is exchanged.
+type authorization struct {
+	clientID  string
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{
+		key:   key,
+		codes: make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	return issuer
+}
+
+func (p *mockIssuer) discovery(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *mockIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(p.key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(p.key.Y.FillBytes(make([]byte, 32))),
+			"kid": "mock",
+			"use": "sig",
+			"alg": "ES256",
+		}},
+	})
+}
+
+// authorize records the authorization request as if the user signed in with
+// the claims, and returns the code to redirect back with.
+func (p *mockIssuer) authorize(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %s", authURL)
+	}
+
+	code := randomToken(16)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.codes[code] = authorization{
+		clientID:  query.Get("client_id"),
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		claims:    claims,
+	}
+
+	return code
+}
+
+// token exchanges the code for an ID token, once the verifier proves that the
+// client is the one that asked for the code.
+func (p *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.lock.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.lock.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   auth.clientID,
+		"nonce": auth.nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": randomToken(16),
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+// beginOIDCSignIn returns where the browser is sent to sign in at the
+// provider, and the state cookie it keeps meanwhile.
+func beginOIDCSignIn(t *testing.T, r http.Handler) (string, *http.Cookie) {
+	t.Helper()
+
+	w := serve(r, http.MethodGet, "/auth/oidc/login", "", nil)
+	expect(t, w, http.StatusFound, nil)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "oidcState" {
+			return w.Header().Get("Location"), cookie
+		}
+	}
+
+	t.Fatal("no state cookie")
+	return "", nil
+}
+
+// finishOIDCSignIn follows the redirect back from the provider, and returns
+// where it redirects the browser to and the refresh token if signed in.
+func finishOIDCSignIn(t *testing.T, r http.Handler, authURL, code string, state *http.Cookie) (string, string) {
+	t.Helper()
+
+	u, _ := url.Parse(authURL)
+	query := url.Values{
+		"code":  {code},
+		"state": {u.Query().Get("state")},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(state)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	expect(t, w, http.StatusFound, nil)
+
+	var refreshToken string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "refreshToken" {
+			refreshToken = cookie.Value
+		}
+	}
+
+	return w.Header().Get("Location"), refreshToken
+}
+
+// signInWithOIDC signs in at the provider with the claims, and returns the
+// username of the user signed in here.
+func signInWithOIDC(t *testing.T, r http.Handler, issuer *mockIssuer, claims jwt.MapClaims) string {
+	t.Helper()
+
+	authURL, state := beginOIDCSignIn(t, r)
+	location, refreshToken := finishOIDCSignIn(t, r, authURL, issuer.authorize(t, authURL, claims), state)
+	if location != config.AppURL+"/" || refreshToken == "" {
+		t.Fatalf("redirected to %s", location)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "refreshToken", Value: refreshToken})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var token Token
+	expect(t, w, http.StatusOK, &token)
+
+	var me Profile
+	expect(t, serve(r, http.MethodGet, "/users/me", token.AccessToken, nil), http.StatusOK, &me)
+
+	return me.Username
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	issuer := newMockIssuer(t)
+
+	// Only the fields read by the handlers under test are changed, since the
+	// background checks read the others meanwhile.
+	issuerURL, clientID, clientSecret, autoProvision := config.OIDCIssuer, config.OIDCClientID, config.OIDCClientSecret, config.OIDCAutoProvision
+	config.OIDCIssuer = issuer.URL
+	config.OIDCClientID = "disgord"
+	config.OIDCClientSecret = "secret"
+	config.OIDCAutoProvision = true
+	t.Cleanup(func() {
+		config.OIDCIssuer, config.OIDCClientID, config.OIDCClientSecret, config.OIDCAutoProvision = issuerURL, clientID, clientSecret, autoProvision
+		oidcProvider = nil
+	})
+
+	r := newTestRouter()
+
+	t.Run("provision", func(t *testing.T) {
+		claims := jwt.MapClaims{
+			"sub":                "provisioned",
+			"preferred_username": "provisioned",
+		}
+		if username := signInWithOIDC(t, r, issuer, claims); username != "provisioned" {
+			t.Fatalf("signed in as %q, want a new user provisioned", username)
+		}
+
+		// The identity is known from now on, whatever the claims.
+		claims = jwt.MapClaims{"sub": "provisioned"}
+		if username := signInWithOIDC(t, r, issuer, claims); username != "provisioned" {
+			t.Fatalf("signed in as %q, want the provisioned user", username)
+		}
+	})
+
+	t.Run("PKCE", func(t *testing.T) {
+		claims := jwt.MapClaims{
+			"sub":                "intercepted",
+			"preferred_username": "intercepted",
+		}
+
+		// A code issued for another authorization request is refused, since
+		// the verifier of this one does not match its challenge.
+		authURL, state := beginOIDCSignIn(t, r)
+		otherAuthURL, _ := beginOIDCSignIn(t, r)
+		code := issuer.authorize(t, otherAuthURL, claims)
+
+		location, _ := finishOIDCSignIn(t, r, authURL, code, state)
+		if !strings.HasSuffix(location, "/sign-in?error=invalid_code") {
+			t.Fatalf("redirected to %s, want invalid_code", location)
+		}
+	})
+
+	t.Run("link by email", func(t *testing.T) {
+		signUp(t, r, "linked", "password")
+
+		err := client.User.
+			Update().
+			Where(user.Username("linked")).
+			SetEmail("linked@example.com").
+			SetEmailVerified(true).
+			Exec(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An unverified address does not link to the user.
+		claims := jwt.MapClaims{
+			"sub":                "unverified",
+			"preferred_username": "linked",
+			"email":              "linked@example.com",
+			"email_verified":     false,
+		}
+		authURL, state := beginOIDCSignIn(t, r)
+		location, _ := finishOIDCSignIn(t, r, authURL, issuer.authorize(t, authURL, claims), state)
+		if !strings.HasSuffix(location, "/sign-in?error=username_taken") {
+			t.Fatalf("redirected to %s, want username_taken", location)
+		}
+
+		claims = jwt.MapClaims{
+			"sub":            "verified",
+			"email":          "linked@example.com",
+			"email_verified": true,
+		}
+		if username := signInWithOIDC(t, r, issuer, claims); username != "linked" {
+			t.Fatalf("signed in as %q, want linked", username)
+		}
+
+		exists, err := client.Identity.
+			Query().
+			Where(
+				identity.Issuer(issuer.URL),
+				identity.Subject("verified"),
+			).
+			Exist(ctx)
+		if err != nil || !exists {
+			t.Fatalf("identity not linked: %v", err)
+		}
+	})
+}
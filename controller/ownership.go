@@ -0,0 +1,487 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/chatroom"
+	"disgord/ent/chatroomban"
+	"disgord/ent/chatroomrole"
+	"disgord/ent/guild"
+	"disgord/ent/guildmember"
+	"disgord/ent/membership"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// TransferChatroom godoc
+//
+//	@Description	The new owner is let into the chatroom if it is private, and the previous owner becomes a moderator. Channels of a guild belong to the owner of the guild, and cannot be transferred.
+//	@Tags			chatroom
+//	@Summary		transfer the ownership of the chatroom to another user
+//	@Param			uri				path	controller.TransferChatroom.Uri		true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.TransferChatroom.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Chatroom
+//	@Failure		400	"cannot transfer a guild channel"
+//	@Failure		401
+//	@Failure		403	"chatroom owner only"
+//	@Failure		404	"cannot find chatroom or user"
+//	@Failure		409	"user already the owner or banned from the chatroom"
+//	@Router			/chatrooms/{id}/transfer [post]
+func (*Controller) TransferChatroom(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		UserID int `json:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	if chatroom.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "chatroom owner only",
+		})
+		return
+	}
+
+	if chatroom.GuildID != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "cannot transfer a guild channel",
+		})
+		return
+	}
+
+	exists, err := tx.User.
+		Query().
+		Where(user.ID(body.UserID)).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	banned, err := isBannedFromRoom(tx, chatroom.ID, body.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if body.UserID == userID || banned {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "user already the owner or banned from the chatroom",
+		})
+		return
+	}
+
+	chatroom, err = transferOwnership(tx, chatroom, body.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// The previous owner stays on as a moderator.
+	err = tx.ChatroomRole.
+		Create().
+		SetChatroomID(chatroom.ID).
+		SetUserID(userID).
+		SetRole(chatroomrole.RoleModerator).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	var roles []RoomRole
+	for _, id := range []int{body.UserID, userID} {
+		role, err := getRoomRole(tx, chatroom, id)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	for _, role := range roles {
+		updateRoomRole(chatroom.ID, role)
+	}
+	roomListUpdated(chatroom.GuildID)
+
+	c.JSON(http.StatusOK, chatroom)
+}
+
+// transferOwnership makes the user the owner of the chatroom. The owner is
+// never given a ChatroomRole, and is always a member of a private chatroom.
+func transferOwnership(tx *ent.Tx, chatroom *ent.Chatroom, userID int) (*ent.Chatroom, error) {
+	_, err := tx.ChatroomRole.
+		Delete().
+		Where(
+			chatroomrole.ChatroomID(chatroom.ID),
+			chatroomrole.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chatroomUpdate := chatroom.Update().SetOwnerID(userID)
+	if chatroom.IsPrivate {
+		isMember, err := chatroom.QueryMembers().
+			Where(user.ID(userID)).
+			Exist(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isMember {
+			chatroomUpdate = chatroomUpdate.AddMemberIDs(userID)
+		}
+	}
+
+	return chatroomUpdate.Save(ctx)
+}
+
+func checkOwnerDeletionPolicy(policy string) {
+	switch policy {
+	case "transfer", "archive", "delete":
+	default:
+		log.Fatalf("unknown owner deletion policy: %s", policy)
+	}
+}
+
+// releasedChatrooms are the chatrooms and guilds of deleted users, to notify
+// the clients in them once the deletion is committed.
+type releasedChatrooms struct {
+	closedIDs []int
+	newOwners map[int]RoomRole
+
+	// updatedGuildIDs have their lists of chatrooms changed, 0 for the
+	// top-level chatrooms.
+	updatedGuildIDs map[int]bool
+
+	// closedGuildIDs are archived or deleted, along with their channels, and
+	// the members of the deleted ones are kept to tell them.
+	closedGuildIDs      []int
+	deletedGuildMembers map[int][]int
+	newGuildOwnerIDs    []int
+}
+
+// releaseChatrooms hands the chatrooms of the users over to someone else as
+// config.OwnerDeletionPolicy says, before the users are deleted.
+func releaseChatrooms(tx *ent.Tx, userIDs ...int) (releasedChatrooms, error) {
+	released := releasedChatrooms{
+		newOwners:           map[int]RoomRole{},
+		updatedGuildIDs:     map[int]bool{},
+		deletedGuildMembers: map[int][]int{},
+	}
+
+	chatrooms, err := tx.Chatroom.
+		Query().
+		Where(chatroom.OwnerIDIn(userIDs...)).
+		All(ctx)
+	if err != nil {
+		return released, err
+	}
+
+	for _, chatroom := range chatrooms {
+		released.updatedGuildIDs[chatroom.GuildID] = true
+
+		switch config.OwnerDeletionPolicy {
+		case "delete":
+			err := tx.Chatroom.
+				DeleteOne(chatroom).
+				Exec(ctx)
+			if err != nil {
+				return released, err
+			}
+
+			released.closedIDs = append(released.closedIDs, chatroom.ID)
+			continue
+
+		case "transfer":
+			successorID, err := findSuccessor(tx, chatroom, userIDs)
+			if err != nil {
+				return released, err
+			}
+
+			// Archived instead if there is no one to take over.
+			if successorID != 0 {
+				chatroom, err := transferOwnership(tx, chatroom, successorID)
+				if err != nil {
+					return released, err
+				}
+
+				role, err := getRoomRole(tx, chatroom, successorID)
+				if err != nil {
+					return released, err
+				}
+
+				released.newOwners[chatroom.ID] = role
+				continue
+			}
+		}
+
+		err := chatroom.
+			Update().
+			ClearOwnerID().
+			SetArchivedAt(time.Now()).
+			Exec(ctx)
+		if err != nil {
+			return released, err
+		}
+
+		released.closedIDs = append(released.closedIDs, chatroom.ID)
+	}
+
+	err = releaseGuilds(tx, &released, userIDs)
+	return released, err
+}
+
+// releaseGuilds does to the guilds of the users what releaseChatrooms does to
+// their chatrooms.
+func releaseGuilds(tx *ent.Tx, released *releasedChatrooms, userIDs []int) error {
+	guilds, err := tx.Guild.
+		Query().
+		Where(guild.OwnerIDIn(userIDs...)).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, guild := range guilds {
+		switch config.OwnerDeletionPolicy {
+		case "delete":
+			memberIDs, err := guild.
+				QueryMembers().
+				Where(guildmember.UserIDNotIn(userIDs...)).
+				Select(guildmember.FieldUserID).
+				Ints(ctx)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Guild.
+				DeleteOne(guild).
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+
+			released.closedGuildIDs = append(released.closedGuildIDs, guild.ID)
+			released.deletedGuildMembers[guild.ID] = memberIDs
+			continue
+
+		case "transfer":
+			successorID, err := findGuildSuccessor(tx, guild, userIDs)
+			if err != nil {
+				return err
+			}
+
+			// Archived instead if there is no one to take over.
+			if successorID != 0 {
+				err := guild.
+					Update().
+					SetOwnerID(successorID).
+					Exec(ctx)
+				if err != nil {
+					return err
+				}
+
+				released.newGuildOwnerIDs = append(released.newGuildOwnerIDs, guild.ID)
+				continue
+			}
+		}
+
+		if err := archiveGuild(tx, guild); err != nil {
+			return err
+		}
+
+		released.closedGuildIDs = append(released.closedGuildIDs, guild.ID)
+	}
+
+	return nil
+}
+
+func (released releasedChatrooms) notify() {
+	for _, id := range released.closedIDs {
+		kickAllClientsFromRoom(id)
+	}
+
+	for id, role := range released.newOwners {
+		updateRoomRole(id, role)
+	}
+
+	for guildID := range released.updatedGuildIDs {
+		roomListUpdated(guildID)
+	}
+
+	for _, id := range released.closedGuildIDs {
+		kickAllClientsFromGuild(id)
+
+		if memberIDs, ok := released.deletedGuildMembers[id]; ok {
+			broadcastToUsers(memberIDs, guildListUpdated(id))
+		} else {
+			roomListUpdated(id)
+		}
+	}
+
+	for _, id := range released.newGuildOwnerIDs {
+		refreshGuildRoles(id)
+		roomListUpdated(id)
+	}
+}
+
+// findSuccessor returns the longest-standing moderator of the chatroom, or the
+// longest-standing member if there is none, or 0 if there is no one to take
+// over. Guests, banned users and the users being deleted are passed over.
+func findSuccessor(tx *ent.Tx, chatroom *ent.Chatroom, excludedIDs []int) (int, error) {
+	bannedIDs, err := tx.ChatroomBan.
+		Query().
+		Where(
+			chatroomban.ChatroomID(chatroom.ID),
+			activeChatroomBan(),
+		).
+		Select(chatroomban.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		return 0, err
+	}
+	excludedIDs = append(excludedIDs, bannedIDs...)
+
+	moderator, err := tx.ChatroomRole.
+		Query().
+		Where(
+			chatroomrole.ChatroomID(chatroom.ID),
+			chatroomrole.RoleEQ(chatroomrole.RoleModerator),
+			chatroomrole.UserIDNotIn(excludedIDs...),
+		).
+		Order(chatroomrole.ByCreatedAt(sql.OrderAsc())).
+		First(ctx)
+	if err == nil {
+		return moderator.UserID, nil
+	}
+	if !ent.IsNotFound(err) {
+		return 0, err
+	}
+
+	// Members are either given the role explicitly, or let into the private
+	// chatroom without a role.
+	member, err := tx.ChatroomRole.
+		Query().
+		Where(
+			chatroomrole.ChatroomID(chatroom.ID),
+			chatroomrole.RoleEQ(chatroomrole.RoleMember),
+			chatroomrole.UserIDNotIn(excludedIDs...),
+		).
+		Order(chatroomrole.ByCreatedAt(sql.OrderAsc())).
+		First(ctx)
+	if err != nil && !ent.IsNotFound(err) {
+		return 0, err
+	}
+
+	roleUserIDs, err := tx.ChatroomRole.
+		Query().
+		Where(chatroomrole.ChatroomID(chatroom.ID)).
+		Select(chatroomrole.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	membership, err := tx.Membership.
+		Query().
+		Where(
+			membership.ChatroomID(chatroom.ID),
+			membership.UserIDNotIn(append(excludedIDs, roleUserIDs...)...),
+		).
+		Order(membership.ByCreatedAt(sql.OrderAsc())).
+		First(ctx)
+	if err != nil && !ent.IsNotFound(err) {
+		return 0, err
+	}
+
+	switch {
+	case member != nil && (membership == nil || !membership.CreatedAt.Before(member.CreatedAt)):
+		return member.UserID, nil
+	case membership != nil:
+		return membership.UserID, nil
+	default:
+		return 0, nil
+	}
+}
+
+// findGuildSuccessor returns the longest-standing moderator of the guild, or
+// the longest-standing member if there is none, or 0 if there is no one to
+// take over. The users being deleted are passed over.
+func findGuildSuccessor(tx *ent.Tx, guild *ent.Guild, excludedIDs []int) (int, error) {
+	for _, role := range []guildmember.Role{guildmember.RoleModerator, guildmember.RoleMember} {
+		member, err := guild.
+			QueryMembers().
+			Where(
+				guildmember.RoleEQ(role),
+				guildmember.UserIDNotIn(excludedIDs...),
+			).
+			Order(guildmember.ByCreatedAt(sql.OrderAsc())).
+			First(ctx)
+		if err == nil {
+			return member.UserID, nil
+		}
+		if !ent.IsNotFound(err) {
+			return 0, err
+		}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,505 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/passkey"
+	"disgord/ent/passkeychallenge"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var relyingParty *webauthn.WebAuthn
+
+func init() {
+	var err error
+
+	relyingParty, err = webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: "disGOrd",
+		RPOrigins:     config.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// PasskeyCeremony is returned when a registration or an assertion ceremony
+// begins. Pass options to navigator.credentials, and send the ceremony token
+// back with the result to finish the ceremony. The ceremony token can be used
+// only once.
+type PasskeyCeremony struct {
+	Options       any    `json:"options" binding:"required"`
+	CeremonyToken string `json:"ceremonyToken" binding:"required"`
+}
+
+// BeginPasskeyRegistration godoc
+//
+//	@Tags		user
+//	@Summary	begin registering a passkey for the current user
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{object}	controller.PasskeyCeremony
+//	@Failure	401
+//	@Failure	404	"cannot find user"
+//	@Router		/users/me/passkeys/begin [post]
+func (*Controller) BeginPasskeyRegistration(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	user, err := client.User.
+		Query().
+		Where(user.ID(userID)).
+		WithPasskeys().
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	webAuthnUser := newWebAuthnUser(user)
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.Edges.Passkeys))
+	for _, credential := range webAuthnUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := relyingParty.BeginRegistration(
+		webAuthnUser,
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	ceremonyToken, err := issueCeremonyToken(passkeychallenge.PurposeRegistration, userID, session)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PasskeyCeremony{
+		Options:       creation,
+		CeremonyToken: ceremonyToken,
+	})
+}
+
+// FinishPasskeyRegistration godoc
+//
+//	@Description	credential is the PublicKeyCredential created by navigator.credentials.create(), in JSON.
+//	@Tags			user
+//	@Summary		finish registering a passkey for the current user
+//	@Param			Authorization	header	string									true	"Bearer AccessToken"
+//	@Param			body			body	controller.FinishPasskeyRegistration.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.Passkey
+//	@Failure		400	"invalid credential"
+//	@Failure		401
+//	@Failure		404	"cannot find user"
+//	@Router			/users/me/passkeys/finish [post]
+func (*Controller) FinishPasskeyRegistration(c *gin.Context) {
+	type Body struct {
+		CeremonyToken string          `json:"ceremonyToken" binding:"required"`
+		Name          string          `json:"name"`
+		Credential    json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	session, err := consumeCeremonyToken(passkeychallenge.PurposeRegistration, userID, body.CeremonyToken)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	user, err := client.User.
+		Query().
+		Where(user.ID(userID)).
+		WithPasskeys().
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body.Credential))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	credential, err := relyingParty.CreateCredential(newWebAuthnUser(user), *session, parsed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	name := body.Name
+	if name == "" {
+		name = c.Request.UserAgent()
+	}
+
+	passkey, err := client.Passkey.
+		Create().
+		SetUserID(userID).
+		SetName(name).
+		SetCredentialID(credential.ID).
+		SetCredential(credential).
+		Save(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// GetMyPasskeys godoc
+//
+//	@Tags		user
+//	@Summary	list passkeys of the current user
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.Passkey
+//	@Failure	401
+//	@Router		/users/me/passkeys [get]
+func (*Controller) GetMyPasskeys(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	passkeys, err := client.Passkey.
+		Query().
+		Where(passkey.UserID(userID)).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, passkeys)
+}
+
+// DeletePasskey godoc
+//
+//	@Tags		user
+//	@Summary	delete a passkey of the current user
+//	@Param		uri				path	controller.DeletePasskey.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	404	"cannot find passkey"
+//	@Router		/users/me/passkeys/{id} [delete]
+func (*Controller) DeletePasskey(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	n, err := client.Passkey.
+		Delete().
+		Where(
+			passkey.ID(uri.ID),
+			passkey.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find passkey",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// BeginPasskeySignIn godoc
+//
+//	@Description	The user is identified by the passkey chosen in the browser, so no username is needed.
+//	@Tags			auth
+//	@Summary		begin signing in with a passkey
+//	@Success		200	{object}	controller.PasskeyCeremony
+//	@Router			/auth/passkey/begin [post]
+func (*Controller) BeginPasskeySignIn(c *gin.Context) {
+	assertion, session, err := relyingParty.BeginDiscoverableLogin()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	ceremonyToken, err := issueCeremonyToken(passkeychallenge.PurposeSignIn, 0, session)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PasskeyCeremony{
+		Options:       assertion,
+		CeremonyToken: ceremonyToken,
+	})
+}
+
+// FinishPasskeySignIn godoc
+//
+//	@Description	credential is the PublicKeyCredential returned by navigator.credentials.get(), in JSON.
+//	@Description	A passkey verifies the user by itself, so two-factor authentication is not asked.
+//	@Tags			auth
+//	@Summary		finish signing in with a passkey and receive an access token
+//	@Param			body	body		controller.FinishPasskeySignIn.Body	true	"Request body"
+//	@Success		200		{object}	controller.Token
+//	@Failure		401		"invalid credential"
+//	@Failure		403		"user suspended"
+//	@Router			/auth/passkey/finish [post]
+func (*Controller) FinishPasskeySignIn(c *gin.Context) {
+	type Body struct {
+		CeremonyToken string          `json:"ceremonyToken" binding:"required"`
+		Credential    json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+		DeviceName    string          `json:"deviceName"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	session, err := consumeCeremonyToken(passkeychallenge.PurposeSignIn, 0, body.CeremonyToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body.Credential))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	var signedIn *ent.User
+	credential, err := relyingParty.ValidateDiscoverableLogin(
+		func(_, userHandle []byte) (webauthn.User, error) {
+			userID, err := strconv.Atoi(string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+
+			signedIn, err = tx.User.
+				Query().
+				Where(user.ID(userID)).
+				WithPasskeys().
+				Only(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return newWebAuthnUser(signedIn), nil
+		},
+		*session,
+		parsed,
+	)
+	if err != nil || credential.Authenticator.CloneWarning {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid credential",
+		})
+		return
+	}
+
+	if refuseSuspended(c, signedIn) {
+		return
+	}
+
+	_, err = tx.Passkey.
+		Update().
+		Where(passkey.CredentialID(credential.ID)).
+		SetCredential(credential).
+		SetLastUsedAt(time.Now()).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	accessToken, refreshToken, err := createSession(tx, c, signedIn.ID, body.DeviceName)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie("refreshToken", refreshToken, 60*60*24*14, "/", "", true, true)
+
+	c.JSON(http.StatusOK, Token{
+		AccessToken: accessToken,
+	})
+}
+
+// webAuthnUser adapts a user, loaded with its passkeys, to webauthn.User.
+type webAuthnUser struct {
+	user *ent.User
+}
+
+func newWebAuthnUser(user *ent.User) *webAuthnUser {
+	return &webAuthnUser{user}
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.ID))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.DisplayName
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.user.Edges.Passkeys))
+	for _, passkey := range u.user.Edges.Passkeys {
+		credentials = append(credentials, *passkey.Credential)
+	}
+
+	return credentials
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// passkeyChallengeExpiry is how long a ceremony can take to finish.
+const passkeyChallengeExpiry = time.Minute * 5
+
+// issueCeremonyToken stores the state of the ceremony and returns the token to
+// finish it with. Only the hash of the token is stored. userID is 0 when
+// signing in.
+func issueCeremonyToken(purpose passkeychallenge.Purpose, userID int, session *webauthn.SessionData) (string, error) {
+	// Ceremonies that were never finished are deleted along the way.
+	_, err := client.PasskeyChallenge.
+		Delete().
+		Where(passkeychallenge.ExpiresAtLTE(time.Now())).
+		Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	token := randomToken(32)
+
+	challengeCreate := client.PasskeyChallenge.
+		Create().
+		SetPurpose(purpose).
+		SetToken(hashToken(token)).
+		SetSession(session).
+		SetExpiresAt(time.Now().Add(passkeyChallengeExpiry))
+	if userID != 0 {
+		challengeCreate = challengeCreate.SetUserID(userID)
+	}
+
+	if err := challengeCreate.Exec(ctx); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeCeremonyToken deletes the state of the ceremony so that it cannot be
+// finished again, and returns it if the token is valid for the user.
+func consumeCeremonyToken(purpose passkeychallenge.Purpose, userID int, ceremonyToken string) (*webauthn.SessionData, error) {
+	challengeQuery := client.PasskeyChallenge.
+		Query().
+		Where(
+			passkeychallenge.Token(hashToken(ceremonyToken)),
+			passkeychallenge.PurposeEQ(purpose),
+			passkeychallenge.ExpiresAtGT(time.Now()),
+		)
+	if userID != 0 {
+		challengeQuery = challengeQuery.Where(passkeychallenge.UserID(userID))
+	} else {
+		challengeQuery = challengeQuery.Where(passkeychallenge.UserIDIsNil())
+	}
+
+	challenge, err := challengeQuery.Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the request that deletes the challenge finishes the ceremony.
+	n, err := client.PasskeyChallenge.
+		Delete().
+		Where(passkeychallenge.ID(challenge.ID)).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("ceremony already finished")
+	}
+
+	return challenge.Session, nil
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// virtualAuthenticator is a software authenticator holding a single
+// discoverable credential, like a passkey in a password manager.
+type virtualAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newVirtualAuthenticator(t *testing.T) *virtualAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &virtualAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+	}
+}
+
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+func (a *virtualAuthenticator) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	a.signCount++
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func clientDataJSON(typ, origin string, challenge []byte) []byte {
+	b, _ := json.Marshal(gin.H{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return b
+}
+
+// create returns the PublicKeyCredential that navigator.credentials.create()
+// would, attested with none.
+func (a *virtualAuthenticator) create(t *testing.T, rpID, origin string, challenge, userHandle []byte) gin.H {
+	a.userHandle = userHandle
+
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(rpID, flagUserPresent|flagUserVerified|flagAttestedCredentialData, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(gin.H{
+		"clientDataJSON":    clientDataJSON("webauthn.create", origin, challenge),
+		"attestationObject": attestationObject,
+	})
+}
+
+// get returns the PublicKeyCredential that navigator.credentials.get() would.
+func (a *virtualAuthenticator) get(t *testing.T, rpID, origin string, challenge []byte) gin.H {
+	authenticatorData := a.authenticatorData(rpID, flagUserPresent|flagUserVerified, nil)
+	clientData := clientDataJSON("webauthn.get", origin, challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authenticatorData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(gin.H{
+		"clientDataJSON":    clientData,
+		"authenticatorData": authenticatorData,
+		"signature":         signature,
+		"userHandle":        a.userHandle,
+	})
+}
+
+func (a *virtualAuthenticator) credential(response gin.H) gin.H {
+	for name, value := range response {
+		response[name] = base64.RawURLEncoding.EncodeToString(value.([]byte))
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return gin.H{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	}
+}
+
+// passkeyOptions holds what the authenticator needs from the options of
+// either ceremony.
+type passkeyOptions struct {
+	Options struct {
+		PublicKey struct {
+			Challenge protocol.URLEncodedBase64 `json:"challenge"`
+			User      struct {
+				ID protocol.URLEncodedBase64 `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+	CeremonyToken string `json:"ceremonyToken"`
+}
+
+func TestPasskey(t *testing.T) {
+	r := newTestRouter()
+	authenticator := newVirtualAuthenticator(t)
+	rpID, origin := config.RPID, config.RPOrigins[0]
+
+	accessToken := signUp(t, r, "passkey", "password")
+
+	var registration passkeyOptions
+	expect(t, serve(r, http.MethodPost, "/users/me/passkeys/begin", accessToken, nil), http.StatusOK, &registration)
+
+	publicKey := registration.Options.PublicKey
+	finish := gin.H{
+		"ceremonyToken": registration.CeremonyToken,
+		"name":          "virtual",
+		"credential":    authenticator.create(t, rpID, origin, publicKey.Challenge, publicKey.User.ID),
+	}
+	expect(t, serve(r, http.MethodPost, "/users/me/passkeys/finish", accessToken, finish), http.StatusCreated, nil)
+
+	// The ceremony cannot be finished again.
+	expect(t, serve(r, http.MethodPost, "/users/me/passkeys/finish", accessToken, finish), http.StatusBadRequest, nil)
+
+	var passkeys []map[string]any
+	expect(t, serve(r, http.MethodGet, "/users/me/passkeys", accessToken, nil), http.StatusOK, &passkeys)
+	if len(passkeys) != 1 || passkeys[0]["name"] != "virtual" {
+		t.Fatalf("passkeys %v, want the virtual one", passkeys)
+	}
+
+	var signIn passkeyOptions
+	expect(t, serve(r, http.MethodPost, "/auth/passkey/begin", "", nil), http.StatusOK, &signIn)
+
+	finish = gin.H{
+		"ceremonyToken": signIn.CeremonyToken,
+		"credential":    authenticator.get(t, rpID, origin, signIn.Options.PublicKey.Challenge),
+	}
+	var token Token
+	expect(t, serve(r, http.MethodPost, "/auth/passkey/finish", "", finish), http.StatusOK, &token)
+
+	var me struct {
+		Username string `json:"username"`
+	}
+	expect(t, serve(r, http.MethodGet, "/users/me", token.AccessToken, nil), http.StatusOK, &me)
+	if me.Username != "passkey" {
+		t.Fatalf("signed in as %q, want passkey", me.Username)
+	}
+
+	// Neither can a replayed assertion sign in again.
+	finish["credential"] = authenticator.get(t, rpID, origin, signIn.Options.PublicKey.Challenge)
+	expect(t, serve(r, http.MethodPost, "/auth/passkey/finish", "", finish), http.StatusUnauthorized, nil)
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/chatroom"
+	"disgord/ent/chatroomrole"
+	"disgord/ent/guildmember"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permission is a bitset of what a role may do in a chatroom.
+type Permission uint32
+
+const (
+	PermissionSendText Permission = 1 << iota
+	PermissionSpeak
+	PermissionVideo
+	PermissionScreenShare
+	PermissionKick
+	PermissionManageChats
+	PermissionManageRoom
+	PermissionInvite
+	PermissionMentionEveryone
+
+	PermissionAll = PermissionSendText | PermissionSpeak | PermissionVideo | PermissionScreenShare |
+		PermissionKick | PermissionManageChats | PermissionManageRoom | PermissionInvite | PermissionMentionEveryone
+)
+
+func (p Permission) Has(permission Permission) bool {
+	return p&permission == permission
+}
+
+// roleOwner is the role of the owner of the chatroom, which is not stored as a
+// ChatroomRole.
+const roleOwner chatroomrole.Role = "owner"
+
+// roomRoleRanks orders the roles in a chatroom. Users may only manage the
+// roles below their own.
+var roomRoleRanks = map[chatroomrole.Role]int{
+	chatroomrole.RoleGuest:     0,
+	chatroomrole.RoleMember:    1,
+	chatroomrole.RoleModerator: 2,
+	roleOwner:                  3,
+}
+
+var rolePermissions = map[chatroomrole.Role]Permission{
+	chatroomrole.RoleGuest:     PermissionSendText,
+	chatroomrole.RoleMember:    PermissionSendText | PermissionSpeak | PermissionVideo | PermissionScreenShare,
+	chatroomrole.RoleModerator: PermissionSendText | PermissionSpeak | PermissionVideo | PermissionScreenShare | PermissionKick | PermissionManageChats | PermissionInvite | PermissionMentionEveryone,
+	roleOwner:                  PermissionAll,
+}
+
+// RoomRole is the role of a user in a chatroom and what it allows.
+type RoomRole struct {
+	UserID      int               `json:"userId" binding:"required"`
+	Role        chatroomrole.Role `json:"role" binding:"required" enums:"owner,moderator,member,guest"`
+	Permissions Permission        `json:"permissions" binding:"required"`
+}
+
+// mediaPermissions are not given in text channels, nor to the audience of
+// stage channels.
+const mediaPermissions = PermissionSpeak | PermissionVideo | PermissionScreenShare
+
+// guildModeratorPermissions are given to the moderators of a guild in its
+// channels, so that they can manage the channels as well.
+const guildModeratorPermissions = PermissionSendText | PermissionSpeak | PermissionVideo | PermissionScreenShare |
+	PermissionKick | PermissionManageChats | PermissionManageRoom | PermissionInvite | PermissionMentionEveryone
+
+// getRoomRole returns the role of the user in the chatroom. In a channel of a
+// guild, the owner of the guild is the owner, and the role in the guild
+// applies unless the user is given a role in the channel. Users banned from
+// the chatroom keep their role without any permission, and so does everyone in
+// an archived chatroom.
+func getRoomRole(tx *ent.Tx, chatroom *ent.Chatroom, userID int) (RoomRole, error) {
+	role, err := getDefaultRoomRole(tx, chatroom, userID)
+	if err != nil {
+		return RoomRole{}, err
+	}
+
+	if role.Role != roleOwner {
+		chatroomRole, err := tx.ChatroomRole.
+			Query().
+			Where(
+				chatroomrole.ChatroomID(chatroom.ID),
+				chatroomrole.UserID(userID),
+			).
+			Only(ctx)
+		// Roles in a channel are lost on leaving the guild.
+		if err == nil && role.Permissions != 0 {
+			role = newRoomRole(chatroomRole)
+		} else if err != nil && !ent.IsNotFound(err) {
+			return RoomRole{}, err
+		}
+	}
+
+	banned, err := isBannedFromRoom(tx, chatroom.ID, userID)
+	if err != nil {
+		return RoomRole{}, err
+	}
+
+	if banned || chatroom.ArchivedAt != nil {
+		role.Permissions = 0
+	}
+
+	role.Permissions &= channelPermissions(chatroom.Type, role.Role)
+
+	return role, nil
+}
+
+// channelPermissions returns the permissions the type of the channel allows
+// the role.
+func channelPermissions(channelType chatroom.Type, role chatroomrole.Role) Permission {
+	switch {
+	case channelType == chatroom.TypeText:
+		return PermissionAll &^ mediaPermissions
+	case channelType == chatroom.TypeStage && roomRoleRanks[role] < roomRoleRanks[chatroomrole.RoleModerator]:
+		return PermissionAll &^ mediaPermissions
+	default:
+		return PermissionAll
+	}
+}
+
+// getDefaultRoomRole returns the role of the user in the chatroom, before the
+// role given in the chatroom. Users outside the guild of a channel, and users
+// who have not joined a private chatroom other than its owner, have no
+// permission in it.
+func getDefaultRoomRole(tx *ent.Tx, chatroom *ent.Chatroom, userID int) (RoomRole, error) {
+	role := RoomRole{
+		UserID:      userID,
+		Role:        chatroomrole.RoleMember,
+		Permissions: rolePermissions[chatroomrole.RoleMember],
+	}
+
+	if chatroom.GuildID == 0 {
+		if chatroom.OwnerID == userID {
+			role.Role = roleOwner
+			role.Permissions = rolePermissions[roleOwner]
+		}
+	} else {
+		guildRole, err := getGuildRole(tx, chatroom.GuildID, userID)
+		if err != nil {
+			return RoomRole{}, err
+		}
+
+		switch guildRole {
+		case roleGuildOwner:
+			role.Role = roleOwner
+			role.Permissions = rolePermissions[roleOwner]
+		case guildmember.RoleModerator:
+			role.Role = chatroomrole.RoleModerator
+			role.Permissions = guildModeratorPermissions
+		case guildmember.RoleMember:
+		default:
+			role.Permissions = 0
+		}
+	}
+
+	if chatroom.IsPrivate && role.Role != roleOwner && role.Permissions != 0 {
+		isMember, err := tx.Chatroom.
+			QueryMembers(chatroom).
+			Where(user.ID(userID)).
+			Exist(ctx)
+		if err != nil {
+			return RoomRole{}, err
+		}
+
+		if !isMember {
+			role.Permissions = 0
+		}
+	}
+
+	return role, nil
+}
+
+func newRoomRole(chatroomRole *ent.ChatroomRole) RoomRole {
+	permissions := rolePermissions[chatroomRole.Role]
+	if chatroomRole.Permissions != nil {
+		permissions = Permission(*chatroomRole.Permissions)
+	}
+
+	return RoomRole{
+		UserID:      chatroomRole.UserID,
+		Role:        chatroomRole.Role,
+		Permissions: permissions,
+	}
+}
+
+// authorizeInRoom responds with 403 unless the current user has the permission
+// in the chatroom.
+func authorizeInRoom(c *gin.Context, tx *ent.Tx, chatroom *ent.Chatroom, permission Permission) (RoomRole, bool) {
+	role, err := getRoomRole(tx, chatroom, getCurrentUserID(c))
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return role, false
+	}
+
+	if !role.Permissions.Has(permission) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the chatroom",
+		})
+		return role, false
+	}
+
+	return role, true
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/personalaccesstoken"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// personalAccessTokenPrefix tells personal access tokens apart from JWTs in
+// the Authorization header.
+const personalAccessTokenPrefix = "dgp_"
+
+// CreatePersonalAccessToken godoc
+//
+//	@Description	The token is shown only once. Set "Authorization" header with the "Bearer ${token}" to authenticate requests.
+//	@Description	Scopes are chats, chatrooms, users and ws, each of which grants the routes under the path of the same name.
+//	@Description	The token never expires if expiresInDays is not provided.
+//	@Description	Personal access tokens cannot manage the account under /users/me, except reading it with GET /users/me.
+//	@Tags			token
+//	@Summary		create a personal access token for the current user
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.PersonalAccessTokenBody	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	controller.NewPersonalAccessToken
+//	@Failure		401
+//	@Router			/users/me/tokens [post]
+func (*Controller) CreatePersonalAccessToken(c *gin.Context) {
+	createPersonalAccessToken(c, getCurrentUserID(c))
+}
+
+// GetMyPersonalAccessTokens godoc
+//
+//	@Tags		token
+//	@Summary	list personal access tokens of the current user
+//	@Param		Authorization	header	string	true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.PersonalAccessToken
+//	@Failure	401
+//	@Router		/users/me/tokens [get]
+func (*Controller) GetMyPersonalAccessTokens(c *gin.Context) {
+	getPersonalAccessTokens(c, getCurrentUserID(c))
+}
+
+// DeletePersonalAccessToken godoc
+//
+//	@Tags		token
+//	@Summary	revoke a personal access token of the current user
+//	@Param		uri				path	controller.DeletePersonalAccessToken.Uri	true	"path"
+//	@Param		Authorization	header	string										true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	404	"cannot find token"
+//	@Router		/users/me/tokens/{id} [delete]
+func (*Controller) DeletePersonalAccessToken(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	deletePersonalAccessToken(c, getCurrentUserID(c), uri.ID)
+}
+
+type PersonalAccessTokenBody struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required,min=1,dive,oneof=chats chatrooms users ws"`
+	ExpiresInDays int      `json:"expiresInDays" binding:"min=0"`
+}
+
+type NewPersonalAccessToken struct {
+	*ent.PersonalAccessToken
+	Token string `json:"token" binding:"required"`
+}
+
+func createPersonalAccessToken(c *gin.Context, userID int) {
+	var body PersonalAccessTokenBody
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	token := personalAccessTokenPrefix + randomToken(32)
+
+	slices.Sort(body.Scopes)
+
+	personalAccessTokenCreate := client.PersonalAccessToken.
+		Create().
+		SetUserID(userID).
+		SetName(body.Name).
+		SetToken(hashToken(token)).
+		SetScopes(slices.Compact(body.Scopes))
+	if body.ExpiresInDays > 0 {
+		personalAccessTokenCreate = personalAccessTokenCreate.
+			SetExpiresAt(time.Now().AddDate(0, 0, body.ExpiresInDays))
+	}
+
+	personalAccessToken, err := personalAccessTokenCreate.Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, NewPersonalAccessToken{
+		PersonalAccessToken: personalAccessToken,
+		Token:               token,
+	})
+}
+
+func getPersonalAccessTokens(c *gin.Context, userID int) {
+	personalAccessTokens, err := client.PersonalAccessToken.
+		Query().
+		Where(personalaccesstoken.UserID(userID)).
+		Order(personalaccesstoken.ByCreatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, personalAccessTokens)
+}
+
+func deletePersonalAccessToken(c *gin.Context, userID, tokenID int) {
+	n, err := client.PersonalAccessToken.
+		Delete().
+		Where(
+			personalaccesstoken.ID(tokenID),
+			personalaccesstoken.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find token",
+		})
+		return
+	}
+
+	disconnectSession(personalAccessTokenSessionID(tokenID))
+
+	c.Status(http.StatusNoContent)
+}
+
+// authenticatePersonalAccessToken returns the token if it is valid, and records
+// that it was used. Tokens of bots whose owner is suspended are not valid.
+func authenticatePersonalAccessToken(token string) (*ent.PersonalAccessToken, error) {
+	personalAccessToken, err := client.PersonalAccessToken.
+		Query().
+		Where(
+			personalaccesstoken.Token(hashToken(token)),
+			personalaccesstoken.Or(
+				personalaccesstoken.ExpiresAtIsNil(),
+				personalaccesstoken.ExpiresAtGT(time.Now()),
+			),
+			// Bots stop working while their owner is suspended.
+			personalaccesstoken.Not(personalaccesstoken.HasUserWith(
+				user.HasOwnerWith(user.Suspended(true)),
+			)),
+		).
+		Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = personalAccessToken.
+		Update().
+		SetLastUsedAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return personalAccessToken, nil
+}
+
+// personalAccessTokenSessionID identifies connections made with the token in
+// place of a session ID. It is negative, so it never collides with sessions.
+func personalAccessTokenSessionID(tokenID int) int {
+	return -tokenID
+}
+
+func isPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
+
+// ScopeMiddleware lets through the requests authenticated with a session, or
+// with a personal access token granted the scope.
+func (*Controller) ScopeMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, ok := c.Get("scopes")
+		if ok && !slices.Contains(scopes.([]string), scope) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "token lacks the scope " + scope,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// SessionMiddleware lets through only the requests authenticated with a
+// session, so that personal access tokens cannot manage the account.
+func (*Controller) SessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("scopes"); ok {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "session required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
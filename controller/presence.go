@@ -0,0 +1,333 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/relationship"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Presence is how others see whether the user is around.
+type Presence struct {
+	UserID                int        `json:"userId" binding:"required"`
+	Status                string     `json:"status" binding:"required" enums:"online,idle,dnd,offline"`
+	CustomStatus          string     `json:"customStatus,omitempty"`
+	CustomStatusExpiresAt *time.Time `json:"customStatusExpiresAt,omitempty"`
+}
+
+// presences are the last presences sent to the observers of each user, so that
+// only changes are sent.
+var presences = struct {
+	sync.Mutex
+	m map[int]string
+}{
+	m: make(map[int]string),
+}
+
+// GetPresences godoc
+//
+//	@Description	Users who blocked the current user are shown offline.
+//	@Tags			user
+//	@Summary		get the presences of the users
+//	@Param			q				query	controller.GetPresences.Query	true	"query"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.Presence
+//	@Failure		401
+//	@Router			/users/presences [get]
+func (*Controller) GetPresences(c *gin.Context) {
+	type Query struct {
+		UserIDs []int `form:"userId" binding:"required,max=100"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	users, err := client.User.
+		Query().
+		Where(user.IDIn(query.UserIDs...)).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	blockerIDs, err := client.Relationship.
+		Query().
+		Where(
+			relationship.TargetID(getCurrentUserID(c)),
+			relationship.TypeEQ(relationship.TypeBlocked),
+		).
+		Select(relationship.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	response := make([]Presence, 0, len(users))
+	for _, user := range users {
+		if slices.Contains(blockerIDs, user.ID) {
+			response = append(response, offlinePresence(user.ID))
+			continue
+		}
+
+		response = append(response, getPresence(user))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateMyPresence godoc
+//
+//	@Description	Invisible users are shown offline to others. An empty customStatus clears the custom status.
+//	@Description	Friends and users in the same room receive PRESENCE_UPDATE with the presence as content.
+//	@Tags			user
+//	@Summary		set the status and custom status of the current user
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.UpdateMyPresence.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.Presence
+//	@Failure		401
+//	@Failure		404	"cannot find user"
+//	@Router			/users/me/presence [patch]
+func (*Controller) UpdateMyPresence(c *gin.Context) {
+	type Body struct {
+		Status                user.Status `json:"status" binding:"omitempty,oneof=online idle dnd invisible" enums:"online,idle,dnd,invisible"`
+		CustomStatus          *string     `json:"customStatus" binding:"omitempty,max=128"`
+		CustomStatusExpiresAt *time.Time  `json:"customStatusExpiresAt"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	userUpdate := client.User.UpdateOneID(userID)
+	if body.Status != "" {
+		userUpdate = userUpdate.SetStatus(body.Status)
+	}
+	if body.CustomStatus != nil {
+		userUpdate = userUpdate.
+			SetCustomStatus(*body.CustomStatus).
+			ClearCustomStatusExpiresAt()
+		if *body.CustomStatus != "" && body.CustomStatusExpiresAt != nil {
+			userUpdate = userUpdate.SetCustomStatusExpiresAt(*body.CustomStatusExpiresAt)
+		}
+	}
+
+	user, err := userUpdate.Save(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	updatePresence(userID)
+
+	c.JSON(http.StatusOK, getPresence(user))
+}
+
+// getPresence returns the presence of the user as others see it.
+func getPresence(subject *ent.User) Presence {
+	presence := offlinePresence(subject.ID)
+
+	connected, active := getActivity(subject.ID)
+	if !connected || subject.Status == user.StatusInvisible {
+		return presence
+	}
+
+	switch {
+	case subject.Status == user.StatusDnd:
+		presence.Status = "dnd"
+	case subject.Status == user.StatusIdle || !active:
+		presence.Status = "idle"
+	default:
+		presence.Status = "online"
+	}
+
+	expiresAt := subject.CustomStatusExpiresAt
+	if subject.CustomStatus != "" && (expiresAt == nil || expiresAt.After(time.Now())) {
+		presence.CustomStatus = subject.CustomStatus
+		presence.CustomStatusExpiresAt = expiresAt
+	}
+
+	return presence
+}
+
+func offlinePresence(userID int) Presence {
+	return Presence{
+		UserID: userID,
+		Status: "offline",
+	}
+}
+
+// getActivity reports whether the user is connected, and whether any
+// connection of the user has been active within config.IdleTimeout.
+func getActivity(userID int) (connected, active bool) {
+	idleSince := time.Now().Add(-config.IdleTimeout).UnixNano()
+
+	for _, client := range getClientsOf([]int{userID}) {
+		connected = true
+		if client.lastActive.Load() > idleSince {
+			active = true
+		}
+	}
+
+	return connected, active
+}
+
+// updatePresence sends the presence of the user to the observers if it has
+// changed since last sent.
+func updatePresence(userID int) {
+	user, err := client.User.Get(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	presence := getPresence(user)
+	b, _ := json.Marshal(presence)
+
+	presences.Lock()
+	if presences.m[userID] == string(b) {
+		presences.Unlock()
+		return
+	}
+	if presence.Status == "offline" {
+		delete(presences.m, userID)
+	} else {
+		presences.m[userID] = string(b)
+	}
+	presences.Unlock()
+
+	observerIDs, err := getPresenceObservers(userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	broadcastToUsers(observerIDs, &Message{
+		Action:  PresenceUpdateAction,
+		Content: string(b),
+	})
+}
+
+// sharePresence sends the users the presence of each other, after their
+// relationship has changed.
+func sharePresence(userID, otherID int) {
+	users, err := client.User.
+		Query().
+		Where(user.IDIn(userID, otherID)).
+		All(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, user := range users {
+		observerID := userID
+		if user.ID == userID {
+			observerID = otherID
+		}
+
+		typ, err := getRelationshipType(client, user.ID, observerID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		presence := getPresence(user)
+		if typ == relationship.TypeBlocked {
+			presence = offlinePresence(user.ID)
+		}
+
+		b, _ := json.Marshal(presence)
+		broadcastToUsers([]int{observerID}, &Message{
+			Action:  PresenceUpdateAction,
+			Content: string(b),
+		})
+	}
+}
+
+// getPresenceObservers returns the IDs of the users who see the presence of the
+// user: the user, the friends of the user, and the users in the same rooms,
+// except those the user blocked.
+func getPresenceObservers(userID int) ([]int, error) {
+	relationships, err := client.Relationship.
+		Query().
+		Where(
+			relationship.UserID(userID),
+			relationship.TypeIn(relationship.TypeFriend, relationship.TypeBlocked),
+		).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	observers := map[int]bool{userID: true}
+	blocked := map[int]bool{}
+	for _, rel := range relationships {
+		if rel.Type == relationship.TypeBlocked {
+			blocked[rel.TargetID] = true
+		} else {
+			observers[rel.TargetID] = true
+		}
+	}
+
+	for _, room := range getRooms(func(*Room) bool { return true }) {
+		userIDs := room.userIDs()
+		if !slices.Contains(userIDs, userID) {
+			continue
+		}
+
+		for _, id := range userIDs {
+			observers[id] = true
+		}
+	}
+
+	observerIDs := make([]int, 0, len(observers))
+	for id := range observers {
+		if !blocked[id] {
+			observerIDs = append(observerIDs, id)
+		}
+	}
+
+	return observerIDs, nil
+}
+
+// schedulePresenceChecks sends the presences of the connected users in the
+// background once they become idle or their custom statuses expire.
+func schedulePresenceChecks() {
+	interval := config.PresenceCheckInterval
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			userIDs := map[int]bool{}
+			for _, client := range getAllClients() {
+				userIDs[client.ID] = true
+			}
+
+			for userID := range userIDs {
+				updatePresence(userID)
+			}
+		}
+	}()
+}
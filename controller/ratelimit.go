@@ -0,0 +1,434 @@
+package controller
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attempts are the failed attempts recorded for a key, such as an IP address,
+// a username or a chatroom.
+type Attempts struct {
+	Key           string    `json:"key" binding:"required"`
+	Failures      int       `json:"failures" binding:"required"`
+	LastFailureAt time.Time `json:"lastFailureAt" binding:"required"`
+	LockedUntil   time.Time `json:"lockedUntil" binding:"required"`
+}
+
+// LimitStore keeps the failed attempts for the limiter.
+// Get returns nil without error if nothing is recorded for the key.
+// DeleteExpired deletes the attempts that last failed before lastFailureBefore
+// and are not locked out after lockedBefore.
+type LimitStore interface {
+	Get(key string) (*Attempts, error)
+	Put(attempts *Attempts) error
+	Delete(key string) error
+	DeleteExpired(lastFailureBefore, lockedBefore time.Time) error
+	List() ([]*Attempts, error)
+}
+
+// Limiter slows down guessing passwords by locking keys out with exponential
+// backoff once they failed too often.
+type Limiter struct {
+	lock         sync.Mutex
+	store        LimitStore
+	freeFailures int
+	window       time.Duration
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+}
+
+var limiter *Limiter
+
+func newLimiter(store LimitStore) *Limiter {
+	return &Limiter{
+		store:        store,
+		freeFailures: config.RateLimitFreeFailures,
+		window:       config.RateLimitWindow,
+		baseDelay:    config.RateLimitBaseDelay,
+		maxDelay:     config.RateLimitMaxDelay,
+	}
+}
+
+func newLimitStore(name string) LimitStore {
+	switch name {
+	case "memory":
+		return newMemoryLimitStore()
+	case "sqlite":
+		return newSQLiteLimitStore()
+	default:
+		log.Fatalf("unknown rate limit store: %s", name)
+		return nil
+	}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func usernameKey(username string) string {
+	return "username:" + username
+}
+
+func userKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func chatroomKey(chatroomID int) string {
+	return "chatroom:" + strconv.Itoa(chatroomID)
+}
+
+// Wait returns how long to wait before trying again with any of the keys.
+// If there is no need to wait, it records the attempt as failed right away, so
+// that concurrent attempts cannot get past the limit before any of them fails.
+// Release gives the attempt back once it succeeded. Errors of the store are
+// logged and let the attempt through.
+func (l *Limiter) Wait(keys ...string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	var wait time.Duration
+	all := make([]*Attempts, 0, len(keys))
+	for _, key := range keys {
+		attempts, err := l.store.Get(key)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if attempts != nil && attempts.LockedUntil.After(now) {
+			wait = max(wait, attempts.LockedUntil.Sub(now))
+		}
+
+		if attempts == nil || now.Sub(attempts.LastFailureAt) > l.window {
+			attempts = &Attempts{Key: key}
+		}
+		all = append(all, attempts)
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, attempts := range all {
+		attempts.Failures++
+		attempts.LastFailureAt = now
+		attempts.LockedUntil = now.Add(l.delay(attempts.Failures))
+
+		if err := l.store.Put(attempts); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return 0
+}
+
+// Release gives back the attempt with the keys that Wait recorded as failed,
+// once it succeeded.
+func (l *Limiter) Release(keys ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range keys {
+		attempts, err := l.store.Get(key)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if attempts == nil {
+			continue
+		}
+
+		attempts.Failures--
+		if attempts.Failures <= 0 {
+			err = l.store.Delete(key)
+		} else {
+			attempts.LockedUntil = attempts.LastFailureAt.Add(l.delay(attempts.Failures))
+			err = l.store.Put(attempts)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// delay returns how long the keys are locked out after the failures.
+func (l *Limiter) delay(failures int) time.Duration {
+	n := failures - l.freeFailures
+	switch {
+	case n <= 0:
+		return 0
+	case n < 32:
+		return min(l.baseDelay<<(n-1), l.maxDelay)
+	default:
+		return l.maxDelay
+	}
+}
+
+// Reset forgets the failed attempts with the keys, e.g. after a success or to
+// unlock them.
+func (l *Limiter) Reset(keys ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range keys {
+		if err := l.store.Delete(key); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Expire forgets the failed attempts that are out of the window and no longer
+// lock the keys out.
+func (l *Limiter) Expire() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	return l.store.DeleteExpired(now.Add(-l.window), now)
+}
+
+// scheduleRateLimitExpiry forgets the expired failed attempts in the
+// background, so that the store does not grow with every key ever tried.
+func scheduleRateLimitExpiry() {
+	go func() {
+		for {
+			time.Sleep(limiter.window)
+
+			if err := limiter.Expire(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// List returns the keys with failed attempts in the current window.
+func (l *Limiter) List() ([]*Attempts, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	list, err := l.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	active := make([]*Attempts, 0, len(list))
+	for _, attempts := range list {
+		if now.Sub(attempts.LastFailureAt) <= l.window || attempts.LockedUntil.After(now) {
+			active = append(active, attempts)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Key < active[j].Key
+	})
+
+	return active, nil
+}
+
+// retryLater responds with 429 and the Retry-After header.
+func retryLater(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"message": "too many failed attempts, retry later",
+	})
+}
+
+// MemoryLimitStore keeps the failed attempts until the server restarts.
+type MemoryLimitStore struct {
+	attempts map[string]Attempts
+}
+
+func newMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{
+		attempts: make(map[string]Attempts),
+	}
+}
+
+func (s *MemoryLimitStore) Get(key string) (*Attempts, error) {
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &attempts, nil
+}
+
+func (s *MemoryLimitStore) Put(attempts *Attempts) error {
+	s.attempts[attempts.Key] = *attempts
+	return nil
+}
+
+func (s *MemoryLimitStore) Delete(key string) error {
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLimitStore) DeleteExpired(lastFailureBefore, lockedBefore time.Time) error {
+	for key, attempts := range s.attempts {
+		if attempts.LastFailureAt.Before(lastFailureBefore) && !attempts.LockedUntil.After(lockedBefore) {
+			delete(s.attempts, key)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryLimitStore) List() ([]*Attempts, error) {
+	list := make([]*Attempts, 0, len(s.attempts))
+	for _, attempts := range s.attempts {
+		list = append(list, &attempts)
+	}
+
+	return list, nil
+}
+
+// SQLiteLimitStore keeps the failed attempts in the database, so that a
+// restart does not unlock them.
+type SQLiteLimitStore struct{}
+
+func newSQLiteLimitStore() *SQLiteLimitStore {
+	return &SQLiteLimitStore{}
+}
+
+func (*SQLiteLimitStore) Get(key string) (*Attempts, error) {
+	rateLimit, err := client.RateLimit.
+		Query().
+		Where(ratelimit.Key(key)).
+		Only(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newAttempts(rateLimit), nil
+}
+
+func (*SQLiteLimitStore) Put(attempts *Attempts) error {
+	n, err := client.RateLimit.
+		Update().
+		Where(ratelimit.Key(attempts.Key)).
+		SetFailures(attempts.Failures).
+		SetLastFailureAt(attempts.LastFailureAt).
+		SetLockedUntil(attempts.LockedUntil).
+		Save(ctx)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	return client.RateLimit.
+		Create().
+		SetKey(attempts.Key).
+		SetFailures(attempts.Failures).
+		SetLastFailureAt(attempts.LastFailureAt).
+		SetLockedUntil(attempts.LockedUntil).
+		Exec(ctx)
+}
+
+func (*SQLiteLimitStore) Delete(key string) error {
+	_, err := client.RateLimit.
+		Delete().
+		Where(ratelimit.Key(key)).
+		Exec(ctx)
+	return err
+}
+
+func (*SQLiteLimitStore) DeleteExpired(lastFailureBefore, lockedBefore time.Time) error {
+	_, err := client.RateLimit.
+		Delete().
+		Where(
+			ratelimit.LastFailureAtLT(lastFailureBefore),
+			ratelimit.LockedUntilLTE(lockedBefore),
+		).
+		Exec(ctx)
+	return err
+}
+
+func (*SQLiteLimitStore) List() ([]*Attempts, error) {
+	rateLimits, err := client.RateLimit.
+		Query().
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Attempts, 0, len(rateLimits))
+	for _, rateLimit := range rateLimits {
+		list = append(list, newAttempts(rateLimit))
+	}
+
+	return list, nil
+}
+
+func newAttempts(rateLimit *ent.RateLimit) *Attempts {
+	return &Attempts{
+		Key:           rateLimit.Key,
+		Failures:      rateLimit.Failures,
+		LastFailureAt: rateLimit.LastFailureAt,
+		LockedUntil:   rateLimit.LockedUntil,
+	}
+}
+
+// GetRateLimits godoc
+//
+//	@Description	Keys are formatted as ip:${ip}, username:${username}, user:${userId} or chatroom:${chatroomId}.
+//	@Tags			admin
+//	@Summary		list keys with recent failed attempts
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.Attempts
+//	@Failure		401
+//	@Failure		403	"moderator only"
+//	@Router			/admin/rate-limits [get]
+func (*Controller) GetRateLimits(c *gin.Context) {
+	list, err := limiter.List()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// UnlockRateLimit godoc
+//
+//	@Tags		admin
+//	@Summary	forget failed attempts with the key to unlock it
+//	@Param		q				query	controller.UnlockRateLimit.Query	true	"query"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"moderator only"
+//	@Router		/admin/rate-limits [delete]
+func (*Controller) UnlockRateLimit(c *gin.Context) {
+	type Query struct {
+		Key string `form:"key" binding:"required"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	limiter.Reset(query.Key)
+
+	c.Status(http.StatusNoContent)
+}
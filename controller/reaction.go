@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"disgord/ent"
+	"disgord/ent/chat"
+	"disgord/ent/reaction"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReactionCount is how many users reacted to a chat with the emoji.
+type ReactionCount struct {
+	Emoji string `json:"emoji" binding:"required"`
+	Count int    `json:"count" binding:"required"`
+	Me    bool   `json:"me" binding:"required"`
+}
+
+// GetChatReactions godoc
+//
+//	@Description	Chats in the chatrooms the current user cannot see are not found.
+//	@Tags			chat
+//	@Summary		list the users who reacted to the chat, optionally with the emoji only
+//	@Param			uri				path	controller.GetChatReactions.Uri		true	"path"
+//	@Param			q				query	controller.GetChatReactions.Query	false	"query"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.GetChatReactions.Response
+//	@Failure		401
+//	@Failure		404	"cannot find chat"
+//	@Router			/chats/{id}/reactions [get]
+func (*Controller) GetChatReactions(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Query struct {
+		Emoji string `form:"emoji"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	chat, err := client.Chat.
+		Query().
+		Where(
+			chat.ID(uri.ID),
+			chat.HasChatroomWith(visibleChatroom(getCurrentUserID(c))),
+		).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chat",
+		})
+		return
+	}
+
+	reactionQuery := chat.QueryReactions()
+	if query.Emoji != "" {
+		reactionQuery = reactionQuery.Where(reaction.Emoji(query.Emoji))
+	}
+
+	reactions, err := reactionQuery.
+		WithUser(func(uq *ent.UserQuery) {
+			uq.Select(user.FieldDisplayName, user.FieldProfileColorIndex)
+		}).
+		Order(reaction.ByID()).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	type Response struct {
+		*ent.Reaction
+		Name  string `json:"displayName"`
+		Color uint8  `json:"profileColorIndex"`
+	}
+
+	response := make([]Response, 0, len(reactions))
+	for _, reaction := range reactions {
+		response = append(response, Response{
+			Reaction: reaction,
+			Name:     reaction.Edges.User.DisplayName,
+			Color:    reaction.Edges.User.ProfileColorIndex,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// AddReaction godoc
+//
+//	@Description	The emoji is either a single unicode emoji or :name: of a custom emoji usable in the chatroom, saved as <:name:id>.
+//	@Description	Users in the chatroom receive REACTION_ADDED with the reaction as content.
+//	@Tags			chat
+//	@Summary		react to the chat with the emoji
+//	@Param			uri				path	controller.AddReaction.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Reaction
+//	@Failure		400	"invalid emoji"
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chat or emoji"
+//	@Router			/chats/{id}/reactions/{emoji} [put]
+func (*Controller) AddReaction(c *gin.Context) {
+	type Uri struct {
+		ID    int    `uri:"id" binding:"required"`
+		Emoji string `uri:"emoji" binding:"required,max=64"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chat, ok := findReactableChat(c, tx, uri.ID)
+	if !ok {
+		return
+	}
+
+	emoji := uri.Emoji
+	if !isEmoji(emoji) {
+		// Custom emojis must be given as :name: and be usable in the chatroom.
+		if !customEmojiName.MatchString(emoji) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid emoji",
+			})
+			return
+		}
+
+		emoji, err = resolveEmojis(tx.Client(), chat.ChatroomID, uri.Emoji)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if emoji == uri.Emoji {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "cannot find emoji",
+			})
+			return
+		}
+	}
+
+	reaction, err := tx.Reaction.
+		Query().
+		Where(
+			reaction.ChatID(chat.ID),
+			reaction.UserID(userID),
+			reaction.Emoji(emoji),
+		).
+		Only(ctx)
+	if err == nil {
+		c.JSON(http.StatusOK, reaction)
+		return
+	}
+	if !ent.IsNotFound(err) {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	reaction, err = tx.Reaction.
+		Create().
+		SetChatID(chat.ID).
+		SetUserID(userID).
+		SetEmoji(emoji).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	reactionUpdated(chat.ChatroomID, ReactionAddedAction, reaction)
+
+	c.JSON(http.StatusOK, reaction)
+}
+
+// RemoveReaction godoc
+//
+//	@Description	The emoji is given as it was when added, or as saved.
+//	@Description	Users in the chatroom receive REACTION_REMOVED with the reaction as content.
+//	@Tags			chat
+//	@Summary		remove the reaction of the current user with the emoji from the chat
+//	@Param			uri				path	controller.RemoveReaction.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		404	"cannot find chat or reaction"
+//	@Router			/chats/{id}/reactions/{emoji} [delete]
+func (*Controller) RemoveReaction(c *gin.Context) {
+	type Uri struct {
+		ID    int    `uri:"id" binding:"required"`
+		Emoji string `uri:"emoji" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	chat, err := client.Chat.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chat",
+		})
+		return
+	}
+
+	emoji, err := resolveEmojis(client, chat.ChatroomID, uri.Emoji)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	reaction, err := client.Reaction.
+		Query().
+		Where(
+			reaction.ChatID(chat.ID),
+			reaction.UserID(getCurrentUserID(c)),
+			reaction.Emoji(emoji),
+		).
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find reaction",
+		})
+		return
+	}
+
+	err = client.Reaction.
+		DeleteOne(reaction).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	reactionUpdated(chat.ChatroomID, ReactionRemovedAction, reaction)
+
+	c.Status(http.StatusNoContent)
+}
+
+// findReactableChat returns the chat if it is not deleted and the current user
+// may send text in its chatroom. Otherwise, it responds with an error.
+func findReactableChat(c *gin.Context, tx *ent.Tx, chatID int) (*ent.Chat, bool) {
+	chat, err := tx.Chat.
+		Query().
+		Where(
+			chat.ID(chatID),
+			chat.DeletedAtIsNil(),
+		).
+		WithChatroom().
+		Only(ctx)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chat",
+		})
+		return nil, false
+	}
+
+	if _, ok := authorizeInRoom(c, tx, chat.Edges.Chatroom, PermissionSendText); !ok {
+		return nil, false
+	}
+
+	return chat, true
+}
+
+// getReactionCounts returns the reaction counts of the chats, keyed by the chat
+// ID, in the order the emojis were first reacted with.
+func getReactionCounts(chats []*ent.Chat, userID int) (map[int][]ReactionCount, error) {
+	chatIDs := make([]int, 0, len(chats))
+	for _, chat := range chats {
+		chatIDs = append(chatIDs, chat.ID)
+	}
+
+	var counts []struct {
+		ChatID  int    `json:"chat_id"`
+		Emoji   string `json:"emoji"`
+		Count   int    `json:"count"`
+		FirstID int    `json:"min"`
+	}
+	err := client.Reaction.
+		Query().
+		Where(reaction.ChatIDIn(chatIDs...)).
+		GroupBy(reaction.FieldChatID, reaction.FieldEmoji).
+		Aggregate(
+			ent.Count(),
+			ent.Min(reaction.FieldID),
+		).
+		Scan(ctx, &counts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].FirstID < counts[j].FirstID
+	})
+
+	mine, err := client.Reaction.
+		Query().
+		Where(
+			reaction.ChatIDIn(chatIDs...),
+			reaction.UserID(userID),
+		).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		chatID int
+		emoji  string
+	}
+	reacted := make(map[key]bool, len(mine))
+	for _, reaction := range mine {
+		reacted[key{reaction.ChatID, reaction.Emoji}] = true
+	}
+
+	reactionCounts := make(map[int][]ReactionCount)
+	for _, count := range counts {
+		reactionCounts[count.ChatID] = append(reactionCounts[count.ChatID], ReactionCount{
+			Emoji: count.Emoji,
+			Count: count.Count,
+			Me:    reacted[key{count.ChatID, count.Emoji}],
+		})
+	}
+
+	return reactionCounts, nil
+}
+
+// reactionUpdated tells the users in the chatroom that the reaction has been
+// added or removed.
+func reactionUpdated(chatroomID int, action string, reaction *ent.Reaction) {
+	b, _ := json.Marshal(reaction)
+
+	broadcastToRoom(chatroomID, &Message{
+		Action:   action,
+		Content:  string(b),
+		ChatID:   reaction.ChatID,
+		senderID: reaction.UserID,
+	})
+}
@@ -0,0 +1,390 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/chat"
+	"disgord/ent/chatroom"
+	"disgord/ent/guild"
+	"disgord/ent/guildmember"
+	"disgord/ent/mention"
+	"disgord/ent/predicate"
+	"disgord/ent/readstate"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// RoomReadState is how far the user has read the chatroom, and what is left
+// unread after it.
+type RoomReadState struct {
+	ChatroomID     int `json:"chatroomId" binding:"required"`
+	LastReadChatID int `json:"lastReadChatId" binding:"required"`
+	UnreadCount    int `json:"unreadCount" binding:"required"`
+	MentionCount   int `json:"mentionCount" binding:"required"`
+}
+
+// MarkChatroomRead godoc
+//
+//	@Description	Without chatId, the chatroom is read up to the latest chat. The read state never moves backward.
+//	@Description	The mentions of the current user up to the chat are marked as read as well.
+//	@Description	The other connections of the current user receive READ_STATE_UPDATED with the read state as content.
+//	@Tags			chatroom
+//	@Summary		mark the chatroom as read up to the chat
+//	@Param			uri				path	controller.MarkChatroomRead.Uri		true	"path"
+//	@Param			Authorization	header	string								true	"Bearer AccessToken"
+//	@Param			body			body	controller.MarkChatroomRead.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.RoomReadState
+//	@Failure		401
+//	@Failure		403	"not allowed in the chatroom"
+//	@Failure		404	"cannot find chatroom or chat"
+//	@Router			/chatrooms/{id}/read [post]
+func (*Controller) MarkChatroomRead(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		ChatID int `json:"chatId"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	chatroom, err := client.Chatroom.Get(ctx, uri.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find chatroom",
+		})
+		return
+	}
+
+	canSee, err := canSeeRoom(chatroom, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if !canSee {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "not allowed in the chatroom",
+		})
+		return
+	}
+
+	chatID := body.ChatID
+	if chatID == 0 {
+		chatIDs, err := chatroom.
+			QueryChats().
+			Order(chat.ByID(sql.OrderDesc())).
+			Limit(1).
+			IDs(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if len(chatIDs) != 0 {
+			chatID = chatIDs[0]
+		}
+	} else {
+		exists, err := chatroom.
+			QueryChats().
+			Where(chat.ID(chatID)).
+			Exist(ctx)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "cannot find chat",
+			})
+			return
+		}
+	}
+
+	readState, changed, err := markRead(userID, chatroom.ID, chatID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if changed {
+		readStateUpdated(userID, getCurrentSessionID(c), readState)
+	}
+
+	c.JSON(http.StatusOK, readState)
+}
+
+// canSeeRoom returns whether the user can see the chatroom.
+func canSeeRoom(chatroom *ent.Chatroom, userID int) (bool, error) {
+	audienceIDs, public, err := getRoomAudience(client, chatroom)
+	if err != nil {
+		return false, err
+	}
+
+	return public || slices.Contains(audienceIDs, userID), nil
+}
+
+// visibleChatroom matches the chatrooms the user can see, the same as
+// canSeeRoom.
+func visibleChatroom(userID int) predicate.Chatroom {
+	isMember := chatroom.Or(
+		chatroom.IsPrivate(false),
+		chatroom.HasMembersWith(user.ID(userID)),
+	)
+
+	return chatroom.Or(
+		chatroom.And(
+			chatroom.GuildIDIsNil(),
+			chatroom.Or(isMember, chatroom.OwnerID(userID)),
+		),
+		chatroom.HasGuildWith(guild.OwnerID(userID)),
+		chatroom.And(
+			chatroom.HasGuildWith(guild.HasMembersWith(guildmember.UserID(userID))),
+			isMember,
+		),
+	)
+}
+
+// markRead moves the read state of the user in the chatroom forward to the
+// chat, and marks the mentions of the user up to the chat as read. It returns
+// whether the read state has changed.
+func markRead(userID, chatroomID, chatID int) (*RoomReadState, bool, error) {
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	current, err := tx.ReadState.
+		Query().
+		Where(
+			readstate.UserID(userID),
+			readstate.ChatroomID(chatroomID),
+		).
+		Only(ctx)
+	if err != nil && !ent.IsNotFound(err) {
+		return nil, false, err
+	}
+
+	changed := current == nil || current.LastReadChatID < chatID
+	if changed {
+		if current == nil {
+			err = tx.ReadState.
+				Create().
+				SetUserID(userID).
+				SetChatroomID(chatroomID).
+				SetLastReadChatID(chatID).
+				Exec(ctx)
+		} else {
+			err = current.
+				Update().
+				SetLastReadChatID(chatID).
+				Exec(ctx)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		err = tx.Mention.
+			Update().
+			Where(
+				mention.UserID(userID),
+				mention.ReadAtIsNil(),
+				mention.HasChatWith(
+					chat.ChatroomID(chatroomID),
+					chat.IDLTE(chatID),
+				),
+			).
+			SetReadAt(time.Now()).
+			Exec(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	readStates, err := getRoomReadStates(userID, []int{chatroomID})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return readStates[chatroomID], changed, nil
+}
+
+// markReadFromClient marks the chatroom of the chat sent with MARK_READ as
+// read up to the chat for the client.
+func markReadFromClient(sender *Client, message *Message) {
+	chat, err := client.Chat.
+		Query().
+		Where(chat.ID(message.ChatID)).
+		WithChatroom().
+		Only(ctx)
+	if err != nil {
+		sender.deliver(&Message{
+			Action:  InvalidAction,
+			Content: message.Action,
+		})
+		return
+	}
+
+	canSee, err := canSeeRoom(chat.Edges.Chatroom, sender.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !canSee {
+		sender.deliver(&Message{
+			Action:  ForbiddenAction,
+			Content: message.Action,
+		})
+		return
+	}
+
+	readState, changed, err := markRead(sender.ID, chat.ChatroomID, chat.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if changed {
+		readStateUpdated(sender.ID, sender.sessionID, readState)
+	}
+}
+
+// getRoomReadStates returns the read states of the user in the chatrooms,
+// keyed by the chatroom ID. In chatrooms the user has never marked as read,
+// every chat is unread. Thread replies, the user's own chats and chats of users the
+// user blocked are not counted as unread.
+func getRoomReadStates(userID int, chatroomIDs []int) (map[int]*RoomReadState, error) {
+	readStates, err := client.ReadState.
+		Query().
+		Where(
+			readstate.UserID(userID),
+			readstate.ChatroomIDIn(chatroomIDs...),
+		).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	roomReadStates := make(map[int]*RoomReadState, len(chatroomIDs))
+	if len(chatroomIDs) == 0 {
+		return roomReadStates, nil
+	}
+
+	for _, chatroomID := range chatroomIDs {
+		roomReadStates[chatroomID] = &RoomReadState{
+			ChatroomID: chatroomID,
+		}
+	}
+
+	afterLastRead := make([]predicate.Chat, 0, len(readStates)+1)
+	for _, readState := range readStates {
+		roomReadStates[readState.ChatroomID].LastReadChatID = readState.LastReadChatID
+		afterLastRead = append(afterLastRead, chat.And(
+			chat.ChatroomID(readState.ChatroomID),
+			chat.IDGT(readState.LastReadChatID),
+		))
+	}
+
+	var neverReadIDs []int
+	for _, chatroomID := range chatroomIDs {
+		if roomReadStates[chatroomID].LastReadChatID == 0 {
+			neverReadIDs = append(neverReadIDs, chatroomID)
+		}
+	}
+	if len(neverReadIDs) != 0 {
+		afterLastRead = append(afterLastRead, chat.ChatroomIDIn(neverReadIDs...))
+	}
+
+	blockedIDs, err := getBlockedIDs(client, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		ChatroomID int `json:"chatroom_id"`
+		Count      int `json:"count"`
+	}
+	err = client.Chat.
+		Query().
+		Where(
+			chat.Or(afterLastRead...),
+			chat.ParentIDIsNil(),
+			chat.DeletedAtIsNil(),
+			chat.SenderIDNEQ(userID),
+			chat.SenderIDNotIn(blockedIDs...),
+		).
+		GroupBy(chat.FieldChatroomID).
+		Aggregate(ent.Count()).
+		Scan(ctx, &counts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, count := range counts {
+		roomReadStates[count.ChatroomID].UnreadCount = count.Count
+	}
+
+	mentionedIn, err := client.Mention.
+		Query().
+		Where(
+			mention.UserID(userID),
+			mention.ReadAtIsNil(),
+		).
+		QueryChat().
+		Where(chat.ChatroomIDIn(chatroomIDs...)).
+		Select(chat.FieldChatroomID).
+		Ints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chatroomID := range mentionedIn {
+		roomReadStates[chatroomID].MentionCount++
+	}
+
+	return roomReadStates, nil
+}
+
+// readStateUpdated tells the other connections of the user than the session
+// that the read state has changed, so that every device shows the same unread
+// counts.
+func readStateUpdated(userID, sessionID int, readState *RoomReadState) {
+	b, _ := json.Marshal(readState)
+
+	message := &Message{
+		Action:  ReadStateUpdatedAction,
+		Content: string(b),
+		ChatID:  readState.LastReadChatID,
+	}
+	for _, client := range getClientsOf([]int{userID}) {
+		if client.sessionID != sessionID {
+			client.deliver(message)
+		}
+	}
+}
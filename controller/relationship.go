@@ -0,0 +1,499 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"disgord/ent"
+	"disgord/ent/relationship"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RelatedUser is a user with what the user is to the current user, if
+// anything.
+type RelatedUser struct {
+	*ent.User
+	Relationship relationship.Type `json:"relationship,omitempty" enums:"friend,outgoing,incoming,blocked"`
+}
+
+// GetMyRelationships godoc
+//
+//	@Tags		user
+//	@Summary	list the friends, friend requests and blocked users of the current user
+//	@Param		q				query	controller.GetMyRelationships.Query	true	"query"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.Relationship
+//	@Failure	401
+//	@Router		/users/me/relationships [get]
+func (*Controller) GetMyRelationships(c *gin.Context) {
+	type Query struct {
+		Type relationship.Type `form:"type" binding:"omitempty,oneof=friend outgoing incoming blocked" enums:"friend,outgoing,incoming,blocked"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	relationshipQuery := client.Relationship.
+		Query().
+		Where(relationship.UserID(getCurrentUserID(c)))
+	if query.Type != "" {
+		relationshipQuery = relationshipQuery.Where(relationship.TypeEQ(query.Type))
+	}
+
+	relationships, err := relationshipQuery.All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, relationships)
+}
+
+// AddFriend godoc
+//
+//	@Description	It sends a friend request to the user, or accepts the friend request from the user if there is one.
+//	@Description	Both users receive RELATIONSHIP_UPDATED with the ID of the other user as content.
+//	@Tags			user
+//	@Summary		send or accept a friend request
+//	@Param			uri				path	controller.AddFriend.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Relationship
+//	@Failure		400	"cannot befriend yourself"
+//	@Failure		401
+//	@Failure		403	"cannot send a friend request to the user"
+//	@Failure		404	"cannot find user"
+//	@Failure		409	"already friends, friend request already sent, or user blocked"
+//	@Router			/users/me/friends/{userId} [put]
+func (*Controller) AddFriend(c *gin.Context) {
+	type Uri struct {
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+	if uri.UserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "cannot befriend yourself",
+		})
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !findRelatedUser(c, tx, uri.UserID) {
+		return
+	}
+
+	mine, err := getRelationshipType(tx.Client(), userID, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	theirs, err := getRelationshipType(tx.Client(), uri.UserID, userID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	switch {
+	case mine == relationship.TypeFriend:
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "already friends",
+		})
+		return
+	case mine == relationship.TypeOutgoing:
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "friend request already sent",
+		})
+		return
+	case mine == relationship.TypeBlocked:
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "user blocked, unblock the user first",
+		})
+		return
+	case theirs == relationship.TypeBlocked:
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot send a friend request to the user",
+		})
+		return
+	}
+
+	mineNext, theirsNext := relationship.TypeOutgoing, relationship.TypeIncoming
+	if mine == relationship.TypeIncoming {
+		mineNext, theirsNext = relationship.TypeFriend, relationship.TypeFriend
+	}
+
+	relationship, err := setRelationship(tx, userID, uri.UserID, mineNext)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if _, err := setRelationship(tx, uri.UserID, userID, theirsNext); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	relationshipUpdated(userID, uri.UserID)
+	go sharePresence(userID, uri.UserID)
+
+	c.JSON(http.StatusOK, relationship)
+}
+
+// RemoveFriend godoc
+//
+//	@Description	It declines the friend request from the user, cancels the friend request to the user, or removes the user from the friends.
+//	@Description	Both users receive RELATIONSHIP_UPDATED with the ID of the other user as content.
+//	@Tags			user
+//	@Summary		decline, cancel or remove a friend
+//	@Param			uri				path	controller.RemoveFriend.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		404	"cannot find friend or friend request"
+//	@Router			/users/me/friends/{userId} [delete]
+func (*Controller) RemoveFriend(c *gin.Context) {
+	type Uri struct {
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	mine, err := getRelationshipType(tx.Client(), userID, uri.UserID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if mine == "" || mine == relationship.TypeBlocked {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find friend or friend request",
+		})
+		return
+	}
+
+	if err := unfriend(tx, userID, uri.UserID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	relationshipUpdated(userID, uri.UserID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// BlockUser godoc
+//
+//	@Description	It removes the user from the friends, along with any friend request between the two.
+//	@Description	The blocked user cannot send friend requests or direct messages to the current user, and the messages of the blocked user are left out of the chat history and WebSocket of the current user.
+//	@Tags			user
+//	@Summary		block a user
+//	@Param			uri				path	controller.BlockUser.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	ent.Relationship
+//	@Failure		400	"cannot block yourself"
+//	@Failure		401
+//	@Failure		404	"cannot find user"
+//	@Router			/users/me/blocks/{userId} [put]
+func (*Controller) BlockUser(c *gin.Context) {
+	type Uri struct {
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+	if uri.UserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "cannot block yourself",
+		})
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !findRelatedUser(c, tx, uri.UserID) {
+		return
+	}
+
+	if err := unfriend(tx, userID, uri.UserID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	relationship, err := setRelationship(tx, userID, uri.UserID, relationship.TypeBlocked)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	setBlocked(userID, uri.UserID, true)
+	relationshipUpdated(userID, uri.UserID)
+	go sharePresence(userID, uri.UserID)
+
+	c.JSON(http.StatusOK, relationship)
+}
+
+// UnblockUser godoc
+//
+//	@Tags		user
+//	@Summary	unblock a user
+//	@Param		uri				path	controller.UnblockUser.Uri	true	"path"
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	404	"user not blocked"
+//	@Router		/users/me/blocks/{userId} [delete]
+func (*Controller) UnblockUser(c *gin.Context) {
+	type Uri struct {
+		UserID int `uri:"userId" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	n, err := client.Relationship.
+		Delete().
+		Where(
+			relationship.UserID(userID),
+			relationship.TargetID(uri.UserID),
+			relationship.TypeEQ(relationship.TypeBlocked),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "user not blocked",
+		})
+		return
+	}
+
+	setBlocked(userID, uri.UserID, false)
+	relationshipUpdated(userID, uri.UserID)
+	go sharePresence(userID, uri.UserID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// findRelatedUser responds with 404 unless the user exists.
+func findRelatedUser(c *gin.Context, tx *ent.Tx, userID int) bool {
+	exists, err := tx.User.
+		Query().
+		Where(user.ID(userID)).
+		Exist(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return false
+	}
+
+	return true
+}
+
+// getRelationshipType returns what the target is to the user, or "" if
+// nothing.
+func getRelationshipType(client *ent.Client, userID, targetID int) (relationship.Type, error) {
+	relationship, err := client.Relationship.
+		Query().
+		Where(
+			relationship.UserID(userID),
+			relationship.TargetID(targetID),
+		).
+		Only(ctx)
+	if ent.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return relationship.Type, nil
+}
+
+// setRelationship replaces what the target is to the user.
+func setRelationship(tx *ent.Tx, userID, targetID int, typ relationship.Type) (*ent.Relationship, error) {
+	_, err := tx.Relationship.
+		Delete().
+		Where(
+			relationship.UserID(userID),
+			relationship.TargetID(targetID),
+		).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Relationship.
+		Create().
+		SetUserID(userID).
+		SetTargetID(targetID).
+		SetType(typ).
+		Save(ctx)
+}
+
+// unfriend removes the friendship or the friend request between the users, on
+// both sides. Blocks are kept.
+func unfriend(tx *ent.Tx, userID, targetID int) error {
+	_, err := tx.Relationship.
+		Delete().
+		Where(
+			relationship.Or(
+				relationship.And(relationship.UserID(userID), relationship.TargetID(targetID)),
+				relationship.And(relationship.UserID(targetID), relationship.TargetID(userID)),
+			),
+			relationship.TypeNEQ(relationship.TypeBlocked),
+		).
+		Exec(ctx)
+	return err
+}
+
+// getBlockedIDs returns the IDs of the users blocked by the user.
+func getBlockedIDs(client *ent.Client, userID int) ([]int, error) {
+	return client.Relationship.
+		Query().
+		Where(
+			relationship.UserID(userID),
+			relationship.TypeEQ(relationship.TypeBlocked),
+		).
+		Select(relationship.FieldTargetID).
+		Ints(ctx)
+}
+
+// isBlocked reports whether the user has blocked, or is blocked by, any of the
+// other users.
+func isBlocked(client *ent.Client, userID int, otherIDs ...int) (bool, error) {
+	return client.Relationship.
+		Query().
+		Where(
+			relationship.TypeEQ(relationship.TypeBlocked),
+			relationship.Or(
+				relationship.And(relationship.UserID(userID), relationship.TargetIDIn(otherIDs...)),
+				relationship.And(relationship.UserIDIn(otherIDs...), relationship.TargetID(userID)),
+			),
+		).
+		Exist(ctx)
+}
+
+// getRelatedUsers returns the users with what each of them is to the user.
+func getRelatedUsers(client *ent.Client, userID int, users ...*ent.User) ([]RelatedUser, error) {
+	relationships, err := client.Relationship.
+		Query().
+		Where(relationship.UserID(userID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[int]relationship.Type, len(relationships))
+	for _, relationship := range relationships {
+		types[relationship.TargetID] = relationship.Type
+	}
+
+	relatedUsers := make([]RelatedUser, 0, len(users))
+	for _, user := range users {
+		relatedUsers = append(relatedUsers, RelatedUser{
+			User:         user,
+			Relationship: types[user.ID],
+		})
+	}
+
+	return relatedUsers, nil
+}
+
+// relationshipUpdated tells both users that their relationship has changed.
+func relationshipUpdated(userID, targetID int) {
+	broadcastToUsers([]int{userID}, &Message{
+		Action:  RelationshipUpdatedAction,
+		Content: strconv.Itoa(targetID),
+	})
+	broadcastToUsers([]int{targetID}, &Message{
+		Action:  RelationshipUpdatedAction,
+		Content: strconv.Itoa(userID),
+	})
+}
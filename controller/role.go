@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roleRanks orders the server roles, each of which can do what the roles
+// below it can do.
+var roleRanks = map[user.Role]int{
+	user.RoleMember:    0,
+	user.RoleModerator: 1,
+	user.RoleAdmin:     2,
+}
+
+// hasRole reports whether the role is at least the required one.
+func hasRole(role, required user.Role) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// outranks reports whether the role may moderate users with the target role.
+// Admins may moderate each other, moderators only members.
+func outranks(role, target user.Role) bool {
+	return role == user.RoleAdmin || roleRanks[role] > roleRanks[target]
+}
+
+// getCurrentUser returns the current user, loaded once per request. Roles can
+// change at any time, so they are not carried in the tokens.
+func getCurrentUser(c *gin.Context) (*ent.User, error) {
+	if currentUser, ok := c.Get("user"); ok {
+		return currentUser.(*ent.User), nil
+	}
+
+	currentUser, err := client.User.Get(ctx, getCurrentUserID(c))
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set("user", currentUser)
+
+	return currentUser, nil
+}
+
+// authorize responds with 403 unless the current user has at least the
+// required server role.
+func authorize(c *gin.Context, required user.Role) bool {
+	currentUser, err := getCurrentUser(c)
+	if ent.IsNotFound(err) {
+		c.Status(http.StatusUnauthorized)
+		return false
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return false
+	}
+
+	if !hasRole(currentUser.Role, required) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": string(required) + " only",
+		})
+		return false
+	}
+
+	return true
+}
+
+// RoleMiddleware lets through the requests of users with at least the
+// required server role.
+func (*Controller) RoleMiddleware(required string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, user.Role(required)) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
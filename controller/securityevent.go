@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/securityevent"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetMySecurityEvents godoc
+//
+//	@Description	A security event is recorded, e.g. when a reused refresh token revokes its session.
+//	@Tags			user
+//	@Summary		list security events of the current user, latest first
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	ent.SecurityEvent
+//	@Failure		401
+//	@Router			/users/me/security-events [get]
+func (*Controller) GetMySecurityEvents(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	securityEvents, err := client.SecurityEvent.
+		Query().
+		Where(securityevent.UserID(userID)).
+		Order(securityevent.ByCreatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, securityEvents)
+}
+
+// newSecurityEvent prepares a security event of the user, stamped with the
+// client of the request.
+func newSecurityEvent(tx *ent.Tx, c *gin.Context, userID int, typ securityevent.Type) *ent.SecurityEventCreate {
+	return tx.SecurityEvent.
+		Create().
+		SetUserID(userID).
+		SetType(typ).
+		SetUserAgent(c.Request.UserAgent()).
+		SetIPAddress(c.ClientIP())
+}
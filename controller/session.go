@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"disgord/ent"
+	"disgord/ent/session"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// GetMySessions godoc
+//
+//	@Description	Each sign-in creates a session, so the user can stay signed in on several devices at once.
+//	@Tags			session
+//	@Summary		list active sessions of the current user
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{array}	controller.GetMySessions.Response
+//	@Failure		401
+//	@Router			/users/me/sessions [get]
+func (*Controller) GetMySessions(c *gin.Context) {
+	userID := getCurrentUserID(c)
+	sessionID := getCurrentSessionID(c)
+
+	sessions, err := client.Session.
+		Query().
+		Where(session.UserID(userID)).
+		Order(session.ByLastUsedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	type Response struct {
+		*ent.Session
+		Current bool `json:"current"`
+	}
+
+	response := make([]Response, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, Response{
+			Session: session,
+			Current: session.ID == sessionID,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeSession godoc
+//
+//	@Description	The device signed in with the session is disconnected from the WebSocket immediately.
+//	@Tags			session
+//	@Summary		revoke a session of the current user
+//	@Param			uri				path	controller.RevokeSession.Uri	true	"path"
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		404	"cannot find session"
+//	@Router			/users/me/sessions/{id} [delete]
+func (*Controller) RevokeSession(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	n, err := client.Session.
+		Delete().
+		Where(
+			session.ID(uri.ID),
+			session.UserID(userID),
+		).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find session",
+		})
+		return
+	}
+
+	disconnectSession(uri.ID)
+
+	if uri.ID == getCurrentSessionID(c) {
+		c.SetSameSite(http.SameSiteNoneMode)
+		c.SetCookie("refreshToken", "", -1, "/", "", true, true)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeAllSessions godoc
+//
+//	@Description	Every device of the current user, including this one, is signed out and disconnected from the WebSocket.
+//	@Tags			session
+//	@Summary		revoke all sessions of the current user
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Router			/users/me/sessions [delete]
+func (*Controller) RevokeAllSessions(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	_, err := client.Session.
+		Delete().
+		Where(session.UserID(userID)).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	disconnect(userID)
+
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie("refreshToken", "", -1, "/", "", true, true)
+
+	c.Status(http.StatusNoContent)
+}
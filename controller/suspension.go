@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"disgord/ent/predicate"
+	"disgord/ent/suspension"
+	"disgord/ent/user"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/gin-gonic/gin"
+)
+
+// SuspendUser godoc
+//
+//	@Description	The user is kicked from every chatroom, signed out of every device and cannot sign in until the suspension is lifted.
+//	@Description	The suspension is lifted automatically at expiresAt. Without expiresAt, the user is banned until unsuspended.
+//	@Description	The chats of the user are kept.
+//	@Tags			admin
+//	@Summary		suspend or ban a user
+//	@Param			uri				path	controller.SuspendUser.Uri	true	"path"
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Param			body			body	controller.SuspendUser.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		201	{object}	ent.Suspension
+//	@Failure		401
+//	@Failure		403	"cannot moderate the user"
+//	@Failure		404	"cannot find user"
+//	@Router			/admin/users/{id}/suspensions [post]
+func (*Controller) SuspendUser(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	type Body struct {
+		Reason    string     `json:"reason" binding:"required"`
+		ExpiresAt *time.Time `json:"expiresAt" binding:"omitempty,gt"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	target, ok := getModeratedUser(c, tx, uri.ID)
+	if !ok {
+		return
+	}
+
+	suspension, err := tx.Suspension.
+		Create().
+		SetUserID(target.ID).
+		SetIssuerID(getCurrentUserID(c)).
+		SetReason(body.Reason).
+		SetNillableExpiresAt(body.ExpiresAt).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = target.
+		Update().
+		SetSuspended(true).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := signOutEverywhere(tx, target.ID); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	botIDs, err := target.
+		QueryBots().
+		IDs(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	kickUser(target.ID)
+	for _, botID := range botIDs {
+		kickUser(botID)
+	}
+
+	c.JSON(http.StatusCreated, suspension)
+}
+
+// GetUserSuspensions godoc
+//
+//	@Tags		admin
+//	@Summary	list suspensions of a user, including lifted ones
+//	@Param		uri				path	controller.GetUserSuspensions.Uri	true	"path"
+//	@Param		Authorization	header	string								true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	200	{array}	ent.Suspension
+//	@Failure	401
+//	@Failure	403	"moderator only"
+//	@Router		/admin/users/{id}/suspensions [get]
+func (*Controller) GetUserSuspensions(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	suspensions, err := client.Suspension.
+		Query().
+		Where(suspension.UserID(uri.ID)).
+		Order(suspension.ByCreatedAt(sql.OrderDesc())).
+		All(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, suspensions)
+}
+
+// UnsuspendUser godoc
+//
+//	@Tags		admin
+//	@Summary	lift every active suspension of a user
+//	@Param		uri				path	controller.UnsuspendUser.Uri	true	"path"
+//	@Param		Authorization	header	string							true	"Bearer AccessToken"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"cannot moderate the user"
+//	@Failure	404	"cannot find user"
+//	@Router		/admin/users/{id}/suspensions [delete]
+func (*Controller) UnsuspendUser(c *gin.Context) {
+	type Uri struct {
+		ID int `uri:"id" binding:"required"`
+	}
+
+	var uri Uri
+	if err := c.BindUri(&uri); err != nil {
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	target, ok := getModeratedUser(c, tx, uri.ID)
+	if !ok {
+		return
+	}
+
+	_, err = tx.Suspension.
+		Update().
+		Where(
+			suspension.UserID(target.ID),
+			activeSuspension(),
+		).
+		SetLiftedAt(time.Now()).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = target.
+		Update().
+		SetSuspended(false).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func activeSuspension() predicate.Suspension {
+	return suspension.And(
+		suspension.LiftedAtIsNil(),
+		suspension.Or(
+			suspension.ExpiresAtIsNil(),
+			suspension.ExpiresAtGT(time.Now()),
+		),
+	)
+}
+
+// scheduleSuspensionExpiry lifts the suspensions in the background once they
+// expire.
+func scheduleSuspensionExpiry() {
+	interval := config.SuspensionCheckInterval
+
+	go func() {
+		for {
+			if err := liftExpiredSuspensions(); err != nil {
+				log.Println(err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func liftExpiredSuspensions() error {
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	_, err = tx.Suspension.
+		Update().
+		Where(
+			suspension.LiftedAtIsNil(),
+			suspension.ExpiresAtLTE(now),
+		).
+		SetLiftedAt(now).
+		Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Users may still have another suspension running.
+	_, err = tx.User.
+		Update().
+		Where(
+			user.Suspended(true),
+			user.Not(user.HasSuspensionsWith(activeSuspension())),
+		).
+		SetSuspended(false).
+		Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"disgord/ent/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ticketExpiry = time.Second * 30
+
+// ticket lets a client open a WebSocket without putting its access token in
+// the URL, where proxies and browsers would log it.
+type ticket struct {
+	userID    int
+	sessionID int
+	origin    string
+	expiresAt time.Time
+}
+
+var tickets = struct {
+	sync.Mutex
+	m map[string]ticket
+}{
+	m: make(map[string]ticket),
+}
+
+// IssueWebsocketTicket godoc
+//
+//	@Description	The ticket can be used once within 30 seconds, from the same origin, to connect to /ws.
+//	@Tags			websocket
+//	@Summary		issue a ticket to establish a WebSocket connection
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		201	{object}	controller.IssueWebsocketTicket.Response
+//	@Failure		401
+//	@Router			/ws/ticket [post]
+func (*Controller) IssueWebsocketTicket(c *gin.Context) {
+	userID := getCurrentUserID(c)
+	sessionID := getCurrentSessionID(c)
+
+	// Access tokens outlive their sessions, so make sure a revoked device
+	// cannot come back through the WebSocket. Personal access tokens are
+	// checked on every request already.
+	if _, ok := c.Get("scopes"); !ok {
+		exists, err := client.Session.
+			Query().
+			Where(
+				session.ID(sessionID),
+				session.UserID(userID),
+			).
+			Exist(ctx)
+		if err != nil || !exists {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	value := randomToken(32)
+
+	tickets.Lock()
+	now := time.Now()
+	for key, ticket := range tickets.m {
+		if now.After(ticket.expiresAt) {
+			delete(tickets.m, key)
+		}
+	}
+	tickets.m[hashToken(value)] = ticket{
+		userID:    userID,
+		sessionID: sessionID,
+		origin:    c.GetHeader("Origin"),
+		expiresAt: now.Add(ticketExpiry),
+	}
+	tickets.Unlock()
+
+	type Response struct {
+		Ticket string `json:"ticket" binding:"required"`
+	}
+
+	c.JSON(http.StatusCreated, Response{
+		Ticket: value,
+	})
+}
+
+// redeemTicket returns the ticket if it is valid for the request, and removes
+// it so that it cannot be used again.
+func redeemTicket(r *http.Request, value string) (ticket, bool) {
+	tickets.Lock()
+	defer tickets.Unlock()
+
+	key := hashToken(value)
+	ticket, ok := tickets.m[key]
+	if !ok {
+		return ticket, false
+	}
+
+	delete(tickets.m, key)
+
+	if time.Now().After(ticket.expiresAt) || ticket.origin != r.Header.Get("Origin") {
+		return ticket, false
+	}
+
+	return ticket, true
+}
+
+// checkOrigin lets browsers connect only from the allowed origins. Clients
+// other than browsers send no Origin header.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range config.WSOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// issueTicket issues a ticket to the user from the origin, or from a client
+// other than a browser if origin is empty.
+func issueTicket(t *testing.T, r http.Handler, accessToken, origin string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/ws/ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var response struct {
+		Ticket string `json:"ticket"`
+	}
+	expect(t, w, http.StatusCreated, &response)
+
+	return response.Ticket
+}
+
+// connect opens a WebSocket to the server with the ticket from the origin, and
+// returns the status of the handshake.
+func connect(t *testing.T, server *httptest.Server, ticket, origin string) int {
+	t.Helper()
+
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?ticket=" + ticket
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode
+}
+
+func TestWebsocketTicket(t *testing.T) {
+	r := newTestRouter()
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	accessToken := signUp(t, r, "ticket", "password")
+	origin := config.WSOrigins[0]
+
+	t.Run("single use", func(t *testing.T) {
+		ticket := issueTicket(t, r, accessToken, origin)
+
+		if status := connect(t, server, ticket, origin); status != http.StatusSwitchingProtocols {
+			t.Fatalf("status %d, want connected", status)
+		}
+		if status := connect(t, server, ticket, origin); status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want the ticket used up", status)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		ticket := issueTicket(t, r, accessToken, origin)
+
+		tickets.Lock()
+		issued := tickets.m[hashToken(ticket)]
+		issued.expiresAt = time.Now().Add(-time.Second)
+		tickets.m[hashToken(ticket)] = issued
+		tickets.Unlock()
+
+		if status := connect(t, server, ticket, origin); status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want the ticket expired", status)
+		}
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		// A ticket issued to a browser is not redeemed elsewhere, and the
+		// other way around.
+		ticket := issueTicket(t, r, accessToken, origin)
+		if status := connect(t, server, ticket, ""); status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want the ticket bound to %s", status, origin)
+		}
+
+		ticket = issueTicket(t, r, accessToken, "")
+		if status := connect(t, server, ticket, origin); status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want the ticket bound to no origin", status)
+		}
+
+		ticket = issueTicket(t, r, accessToken, "")
+		if status := connect(t, server, ticket, ""); status != http.StatusSwitchingProtocols {
+			t.Fatalf("status %d, want connected", status)
+		}
+	})
+
+	t.Run("allowlist", func(t *testing.T) {
+		// A page elsewhere cannot connect, even with a ticket of its own.
+		ticket := issueTicket(t, r, accessToken, "https://evil.example")
+		if status := connect(t, server, ticket, "https://evil.example"); status != http.StatusForbidden {
+			t.Fatalf("status %d, want the origin refused", status)
+		}
+	})
+}
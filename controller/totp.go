@@ -0,0 +1,526 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/recoverycode"
+	"disgord/ent/securityevent"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// TOTP parameters of RFC 6238, which every authenticator app supports.
+	totpPeriod = 30
+	totpDigits = 6
+	// Number of periods before and after the current one to tolerate clock skew.
+	totpSkew = 1
+
+	totpIssuer = "disGOrd"
+
+	recoveryCodeCount = 10
+)
+
+// EnrollTOTP godoc
+//
+//	@Description	Register the secret to an authenticator app, e.g. by rendering otpauthUri as a QR code.
+//	@Description	Two-factor authentication is not enabled until a code is confirmed at /users/me/2fa/confirm.
+//	@Tags			user
+//	@Summary		start enrolling TOTP two-factor authentication
+//	@Param			Authorization	header	string	true	"Bearer AccessToken"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.EnrollTOTP.Response
+//	@Failure		401
+//	@Failure		404	"cannot find user"
+//	@Failure		409	"two-factor authentication already enabled"
+//	@Router			/users/me/2fa [post]
+func (*Controller) EnrollTOTP(c *gin.Context) {
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	if user.TotpEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication already enabled",
+		})
+		return
+	}
+
+	secret := generateTOTPSecret()
+
+	_, err = user.Update().
+		SetTotpSecret(secret).
+		ClearTotpLastStep().
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	type Response struct {
+		Secret     string `json:"secret" binding:"required"`
+		OtpauthURI string `json:"otpauthUri" binding:"required"`
+	}
+
+	c.JSON(http.StatusOK, Response{
+		Secret:     secret,
+		OtpauthURI: otpauthURI(user.Username, secret),
+	})
+}
+
+// ConfirmTOTP godoc
+//
+//	@Description	The recovery codes are shown only once. Each of them can be used once instead of a code.
+//	@Tags			user
+//	@Summary		enable TOTP two-factor authentication with a code from the authenticator app
+//	@Param			Authorization	header	string						true	"Bearer AccessToken"
+//	@Param			body			body	controller.ConfirmTOTP.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.ConfirmTOTP.Response
+//	@Failure		401
+//	@Failure		403	"incorrect code"
+//	@Failure		404	"cannot find user"
+//	@Failure		409	"two-factor authentication not enrolled or already enabled"
+//	@Router			/users/me/2fa/confirm [post]
+func (*Controller) ConfirmTOTP(c *gin.Context) {
+	type Body struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	if user.TotpSecret == "" || user.TotpEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication not enrolled or already enabled",
+		})
+		return
+	}
+
+	step, ok := validateTOTP(user.TotpSecret, body.Code, user.TotpLastStep)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "incorrect code",
+		})
+		return
+	}
+
+	_, err = user.Update().
+		SetTotpEnabled(true).
+		SetTotpLastStep(step).
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	recoveryCodeCreates := make([]*ent.RecoveryCodeCreate, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code := generateRecoveryCode()
+		codes = append(codes, code)
+		recoveryCodeCreates = append(recoveryCodeCreates, tx.RecoveryCode.
+			Create().
+			SetUserID(userID).
+			SetCode(hashPassword(code)))
+	}
+
+	err = tx.RecoveryCode.
+		CreateBulk(recoveryCodeCreates...).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = newSecurityEvent(tx, c, userID, securityevent.TypeTotpEnabled).Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	type Response struct {
+		RecoveryCodes []string `json:"recoveryCodes" binding:"required"`
+	}
+
+	c.JSON(http.StatusOK, Response{
+		RecoveryCodes: codes,
+	})
+}
+
+// DisableTOTP godoc
+//
+//	@Tags		user
+//	@Summary	disable TOTP two-factor authentication with a code or a recovery code
+//	@Param		Authorization	header	string						true	"Bearer AccessToken"
+//	@Param		body			body	controller.DisableTOTP.Body	true	"Request body"
+//	@Security	BearerAuth
+//	@Success	204
+//	@Failure	401
+//	@Failure	403	"incorrect code"
+//	@Failure	404	"cannot find user"
+//	@Failure	409	"two-factor authentication not enabled"
+//	@Failure	429	"too many failed attempts, retry later"
+//	@Router		/users/me/2fa [delete]
+func (*Controller) DisableTOTP(c *gin.Context) {
+	type Body struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID := getCurrentUserID(c)
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	if !user.TotpEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication not enabled",
+		})
+		return
+	}
+
+	if wait := limiter.Wait(userKey(userID)); wait > 0 {
+		retryLater(c, wait)
+		return
+	}
+
+	ok, err := verifySecondFactor(tx, c, user, body.Code)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "incorrect code",
+		})
+		return
+	}
+
+	limiter.Release(userKey(userID))
+
+	_, err = user.Update().
+		SetTotpEnabled(false).
+		ClearTotpSecret().
+		ClearTotpLastStep().
+		Save(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	_, err = tx.RecoveryCode.
+		Delete().
+		Where(recoverycode.UserID(userID)).
+		Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	err = newSecurityEvent(tx, c, userID, securityevent.TypeTotpDisabled).Exec(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SignInWithTOTP godoc
+//
+//	@Description	Exchange the challenge token from /auth/sign-in with a code from the authenticator app, or a recovery code.
+//	@Tags			auth
+//	@Summary		complete signing in with two-factor authentication
+//	@Param			body	body		controller.SignInWithTOTP.Body	true	"Request body"
+//	@Success		200		{object}	controller.Token
+//	@Failure		401		"invalid challenge token or code"
+//	@Failure		403		"user suspended"
+//	@Failure		429		"too many failed attempts, retry later"
+//	@Router			/auth/sign-in/2fa [post]
+func (*Controller) SignInWithTOTP(c *gin.Context) {
+	type Body struct {
+		ChallengeToken string `json:"challengeToken" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+		DeviceName     string `json:"deviceName"`
+	}
+
+	var body Body
+	if err := c.Bind(&body); err != nil {
+		return
+	}
+
+	userID, err := parseChallengeToken(body.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid challenge token or code",
+		})
+		return
+	}
+
+	keys := []string{ipKey(c.ClientIP()), userKey(userID)}
+	if wait := limiter.Wait(keys...); wait > 0 {
+		retryLater(c, wait)
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil || !user.TotpEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid challenge token or code",
+		})
+		return
+	}
+
+	if refuseSuspended(c, user) {
+		return
+	}
+
+	ok, err := verifySecondFactor(tx, c, user, body.Code)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid challenge token or code",
+		})
+		return
+	}
+
+	limiter.Release(ipKey(c.ClientIP()))
+	limiter.Reset(userKey(userID))
+
+	accessToken, refreshToken, err := createSession(tx, c, user.ID, body.DeviceName)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie("refreshToken", refreshToken, 60*60*24*14, "/", "", true, true)
+
+	c.JSON(http.StatusOK, Token{
+		AccessToken: accessToken,
+	})
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code of
+// the user, and consumes it so that it cannot be replayed.
+func verifySecondFactor(tx *ent.Tx, c *gin.Context, user *ent.User, code string) (bool, error) {
+	if step, ok := validateTOTP(user.TotpSecret, code, user.TotpLastStep); ok {
+		err := tx.User.
+			UpdateOneID(user.ID).
+			SetTotpLastStep(step).
+			Exec(ctx)
+		return err == nil, err
+	}
+
+	recoveryCodes, err := tx.RecoveryCode.
+		Query().
+		Where(recoverycode.UserID(user.ID)).
+		All(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, recoveryCode := range recoveryCodes {
+		if !verifyPassword(recoveryCode.Code, code) {
+			continue
+		}
+
+		err := tx.RecoveryCode.
+			DeleteOne(recoveryCode).
+			Exec(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		err = newSecurityEvent(tx, c, user.ID, securityevent.TypeRecoveryCodeUsed).Exec(ctx)
+		return err == nil, err
+	}
+
+	return false, nil
+}
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+func generateRecoveryCode() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	return code[:8] + "-" + code[8:]
+}
+
+func otpauthURI(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// validateTOTP reports whether the code is valid around the current time, and
+// returns its time step. Steps up to lastStep were already used and rejected.
+func validateTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if hmac.Equal([]byte(generateTOTP(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func generateTOTP(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation of RFC 4226.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"encoding/base32"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// totpCode returns the code the authenticator app shows for the secret, the
+// given number of periods from now.
+func totpCode(t *testing.T, secret string, periods int64) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return generateTOTP(key, time.Now().Unix()/totpPeriod+periods)
+}
+
+func TestGenerateTOTP(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to six digits.
+	key := []byte("12345678901234567890")
+	for step, want := range map[int64]string{
+		59 / totpPeriod:         "287082",
+		1111111109 / totpPeriod: "081804",
+		1234567890 / totpPeriod: "005924",
+		2000000000 / totpPeriod: "279037",
+	} {
+		if code := generateTOTP(key, step); code != want {
+			t.Errorf("step %d: code %s, want %s", step, code, want)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	r := newTestRouter()
+	accessToken := signUp(t, r, "totp", "password")
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	expect(t, serve(r, http.MethodPost, "/users/me/2fa", accessToken, nil), http.StatusOK, &enrollment)
+
+	body := gin.H{"code": "000000"}
+	if totpCode(t, enrollment.Secret, 0) == "000000" {
+		body["code"] = "111111"
+	}
+	expect(t, serve(r, http.MethodPost, "/users/me/2fa/confirm", accessToken, body), http.StatusForbidden, nil)
+
+	var confirmation struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	body = gin.H{"code": totpCode(t, enrollment.Secret, 0)}
+	expect(t, serve(r, http.MethodPost, "/users/me/2fa/confirm", accessToken, body), http.StatusOK, &confirmation)
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes, want %d", len(confirmation.RecoveryCodes), recoveryCodeCount)
+	}
+
+	// The password alone only gets a challenge now.
+	challenge := func() string {
+		t.Helper()
+
+		var challenge Challenge
+		body := gin.H{"username": "totp", "password": "password"}
+		expect(t, serve(r, http.MethodPost, "/auth/sign-in", "", body), http.StatusAccepted, &challenge)
+
+		return challenge.ChallengeToken
+	}
+
+	// The code used to confirm cannot sign in, and neither can any code
+	// before it.
+	for _, periods := range []int64{0, -1} {
+		body = gin.H{"challengeToken": challenge(), "code": totpCode(t, enrollment.Secret, periods)}
+		expect(t, serve(r, http.MethodPost, "/auth/sign-in/2fa", "", body), http.StatusUnauthorized, nil)
+	}
+
+	// The next code does, but only once.
+	code := totpCode(t, enrollment.Secret, 1)
+
+	var token Token
+	body = gin.H{"challengeToken": challenge(), "code": code}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in/2fa", "", body), http.StatusOK, &token)
+	expect(t, serve(r, http.MethodGet, "/users/me", token.AccessToken, nil), http.StatusOK, nil)
+
+	body = gin.H{"challengeToken": challenge(), "code": code}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in/2fa", "", body), http.StatusUnauthorized, nil)
+
+	// So does a recovery code.
+	body = gin.H{"challengeToken": challenge(), "code": confirmation.RecoveryCodes[0]}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in/2fa", "", body), http.StatusOK, nil)
+
+	body = gin.H{"challengeToken": challenge(), "code": confirmation.RecoveryCodes[0]}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in/2fa", "", body), http.StatusUnauthorized, nil)
+
+	// The challenge is no access token.
+	expect(t, serve(r, http.MethodGet, "/users/me", challenge(), nil), http.StatusUnauthorized, nil)
+
+	// Disabling takes a code as well, and the password alone signs in again.
+	body = gin.H{"code": confirmation.RecoveryCodes[1]}
+	expect(t, serve(r, http.MethodDelete, "/users/me/2fa", accessToken, body), http.StatusNoContent, nil)
+
+	body = gin.H{"username": "totp", "password": "password"}
+	expect(t, serve(r, http.MethodPost, "/auth/sign-in", "", body), http.StatusOK, nil)
+}
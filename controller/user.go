@@ -3,6 +3,10 @@ package controller
 import (
 	"log"
 	"net/http"
+	"time"
+
+	"disgord/ent"
+	"disgord/ent/user"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,10 +14,10 @@ import (
 // GetAllUsers godoc
 //
 //	@Tags		user
-//	@Summary	list all users
+//	@Summary	list all users, with what each of them is to the current user
 //	@Param		Authorization	header	string	true	"Bearer AccessToken"
 //	@Security	BearerAuth
-//	@Success	200	{array}	ent.User
+//	@Success	200	{array}	controller.RelatedUser
 //	@Failure	401
 //	@Router		/users [get]
 func (*Controller) GetAllUsers(c *gin.Context) {
@@ -26,17 +30,24 @@ func (*Controller) GetAllUsers(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, users)
+	relatedUsers, err := getRelatedUsers(client, getCurrentUserID(c), users...)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, relatedUsers)
 }
 
 // GetUserByID godoc
 //
 //	@Tags		user
-//	@Summary	get a single user by id
+//	@Summary	get a single user by id, with what the user is to the current user
 //	@Param		uri				path	controller.GetUserByID.Uri	true	"path"
 //	@Param		Authorization	header	string						true	"Bearer AccessToken"
 //	@Security	BearerAuth
-//	@Success	200	{object}	ent.User
+//	@Success	200	{object}	controller.RelatedUser
 //	@Failure	401
 //	@Failure	404	"cannot find user"
 //	@Router		/users/{id} [get]
@@ -58,7 +69,35 @@ func (*Controller) GetUserByID(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	relatedUsers, err := getRelatedUsers(client, getCurrentUserID(c), user)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, relatedUsers[0])
+}
+
+// Profile is the user with the fields only the user can see.
+type Profile struct {
+	*ent.User
+	Email                 string      `json:"email,omitempty"`
+	EmailVerified         bool        `json:"emailVerified"`
+	Status                user.Status `json:"status" enums:"online,idle,dnd,invisible"`
+	CustomStatus          string      `json:"customStatus,omitempty"`
+	CustomStatusExpiresAt *time.Time  `json:"customStatusExpiresAt,omitempty"`
+}
+
+func newProfile(user *ent.User) Profile {
+	return Profile{
+		User:                  user,
+		Email:                 user.Email,
+		EmailVerified:         user.EmailVerified,
+		Status:                user.Status,
+		CustomStatus:          user.CustomStatus,
+		CustomStatusExpiresAt: user.CustomStatusExpiresAt,
+	}
 }
 
 // GetMyProfile godoc
@@ -67,7 +106,7 @@ func (*Controller) GetUserByID(c *gin.Context) {
 //	@Summary	get the current user
 //	@Param		Authorization	header	string	true	"Bearer AccessToken"
 //	@Security	BearerAuth
-//	@Success	200	{object}	ent.User
+//	@Success	200	{object}	controller.Profile
 //	@Failure	401
 //	@Failure	404	"cannot find user"
 //	@Router		/users/me [get]
@@ -82,24 +121,27 @@ func (*Controller) GetMyProfile(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, newProfile(user))
 }
 
 // UpdateMyProfile godoc
 //
-//	@Tags		user
-//	@Summary	update the current user
-//	@Param		Authorization	header	string							true	"Bearer AccessToken"
-//	@Param		body			body	controller.UpdateMyProfile.Body	false	"Request body"
-//	@Security	BearerAuth
-//	@Success	200	{object}	ent.User
-//	@Failure	401
-//	@Failure	404	"cannot find user"
-//	@Router		/users/me [patch]
+//	@Description	If email is changed, a verification link is mailed to the new address.
+//	@Tags			user
+//	@Summary		update the current user
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.UpdateMyProfile.Body	false	"Request body"
+//	@Security		BearerAuth
+//	@Success		200	{object}	controller.Profile
+//	@Failure		401
+//	@Failure		404	"cannot find user"
+//	@Failure		409	"email already exists"
+//	@Router			/users/me [patch]
 func (*Controller) UpdateMyProfile(c *gin.Context) {
 	type Body struct {
 		Password    string `json:"password"`
 		DisplayName string `json:"displayName"`
+		Email       string `json:"email" binding:"omitempty,email"`
 	}
 
 	var body Body
@@ -117,45 +159,75 @@ func (*Controller) UpdateMyProfile(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	userUpdate := tx.User.UpdateOneID(userID)
+	user, err := tx.User.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "cannot find user",
+		})
+		return
+	}
+
+	emailChanged := body.Email != "" && body.Email != user.Email
+
+	userUpdate := user.Update()
 	if body.Password != "" {
 		userUpdate = userUpdate.SetPassword(hashPassword(body.Password))
 	}
 	if body.DisplayName != "" {
 		userUpdate = userUpdate.SetDisplayName(body.DisplayName)
 	}
+	if emailChanged {
+		userUpdate = userUpdate.
+			SetEmail(body.Email).
+			SetEmailVerified(false)
+	}
 
-	user, err := userUpdate.Save(ctx)
+	user, err = userUpdate.Save(ctx)
+	if ent.IsConstraintError(err) {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "email already exists",
+		})
+		return
+	}
 	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
+	if emailChanged {
+		err = sendEmailVerification(tx, user)
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
 		c.Status(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, newProfile(user))
 }
 
 // CancelAccount godoc
 //
-//	@Tags		user
-//	@Summary	cancel the current user account and delete all related data
-//	@Param		Authorization	header	string							true	"Bearer AccessToken"
-//	@Param		body			body	controller.CancelAccount.Body	true	"Request body"
-//	@Security	BearerAuth
-//	@Success	204
-//	@Failure	401
-//	@Failure	403	"incorrect password"
-//	@Failure	404	"cannot find user"
-//	@Router		/users/me [delete]
+//	@Description	If two-factor authentication is enabled, a code or a recovery code is required as well.
+//	@Description	The chatrooms of the user are transferred, archived or deleted, as the server is configured to.
+//	@Tags			user
+//	@Summary		cancel the current user account and delete all related data
+//	@Param			Authorization	header	string							true	"Bearer AccessToken"
+//	@Param			body			body	controller.CancelAccount.Body	true	"Request body"
+//	@Security		BearerAuth
+//	@Success		204
+//	@Failure		401
+//	@Failure		403	"incorrect password or code"
+//	@Failure		404	"cannot find user"
+//	@Failure		429	"too many failed attempts, retry later"
+//	@Router			/users/me [delete]
 func (*Controller) CancelAccount(c *gin.Context) {
 	type Body struct {
 		Password string `json:"password" binding:"required"`
+		Code     string `json:"code"`
 	}
 
 	var body Body
@@ -181,6 +253,11 @@ func (*Controller) CancelAccount(c *gin.Context) {
 		return
 	}
 
+	if wait := limiter.Wait(userKey(userID)); wait > 0 {
+		retryLater(c, wait)
+		return
+	}
+
 	if !verifyPassword(user.Password, body.Password) {
 		c.JSON(http.StatusForbidden, gin.H{
 			"message": "incorrect password",
@@ -188,6 +265,41 @@ func (*Controller) CancelAccount(c *gin.Context) {
 		return
 	}
 
+	if user.TotpEnabled {
+		ok, err := verifySecondFactor(tx, c, user, body.Code)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "incorrect code",
+			})
+			return
+		}
+	}
+
+	limiter.Release(userKey(userID))
+
+	// Bots of the user are deleted along with it.
+	botIDs, err := user.
+		QueryBots().
+		IDs(ctx)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	released, err := releaseChatrooms(tx, append(botIDs, userID)...)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
 	err = tx.User.
 		DeleteOneID(userID).
 		Exec(ctx)
@@ -204,5 +316,11 @@ func (*Controller) CancelAccount(c *gin.Context) {
 		return
 	}
 
+	disconnect(userID)
+	for _, botID := range botIDs {
+		disconnect(botID)
+	}
+	released.notify()
+
 	c.Status(http.StatusNoContent)
 }
@@ -50,8 +50,9 @@ func (room *Room) signalPeerConnections() {
 	attemptSync := func() (tryAgain bool) {
 		for _, client := range room.clients {
 			if client.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
-				room.unregister <- client
-				return true // We modified the slice, start from the beginning
+				// The room goroutine may be waiting for the lock held here.
+				go room.leave(client)
+				continue
 			}
 
 			// map of sender we already are seanding, so we don't double send
@@ -104,10 +105,10 @@ func (room *Room) signalPeerConnections() {
 				return true
 			}
 
-			client.send <- &Message{
+			client.deliver(&Message{
 				Action:  OfferAction,
 				Content: string(offerString),
-			}
+			})
 		}
 
 		return
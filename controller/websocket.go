@@ -4,11 +4,16 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"slices"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"disgord/ent"
+	"disgord/ent/chatroomrole"
+	"disgord/ent/guildmember"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -18,44 +23,75 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	CheckOrigin:     checkOrigin,
 }
 
 // ConnectWebsocket godoc
 //
 //	@Description	Use the ws:// scheme instead of the http:// scheme to establish a WebSocket connection.
-//	@Description	And append the access token to the URL as a query parameter, e.g. "ws://localhost:8080/ws?access_token=${accessToken}".
+//	@Description	And append a ticket from /ws/ticket to the URL as a query parameter, e.g. "ws://localhost:8080/ws?ticket=${ticket}".
 //	@Description
 //	@Description	Send and receive messages in JSON format.
 //	@Description
 //	@Description	When you send a message to the server:
-//	@Description	You can use action types: LIST_USERS, LEAVE_ROOM, SEND_TEXT, MUTE, UNMUTE, TURN_ON_CAM, TURN_OFF_CAM.
-//	@Description	Especially, SEND_TEXT should contain the content field.
+//	@Description	You can use action types: LIST_USERS, LEAVE_ROOM, SEND_TEXT, SEND_THREAD_REPLY, MUTE, UNMUTE, TURN_ON_CAM, TURN_OFF_CAM, START_SCREEN_SHARE, STOP_SCREEN_SHARE, KICK, BAN.
+//	@Description	Send HEARTBEAT periodically while the user is active, even out of a room, or the user will be shown idle.
+//	@Description	Send MARK_READ with chatId, even out of a room, to mark the chatroom of the chat as read up to the chat, as with POST /chatrooms/{id}/read.
+//	@Description	Especially, SEND_TEXT should contain the content field, and replyToId to reply to a chat.
+//	@Description	Users mentioned in the content with @username, @here or @everyone receive MENTION, as with POST /chats.
+//	@Description	To send into the thread of a chat, send SEND_THREAD_REPLY with the content and parentId fields.
+//	@Description	With the kick permission, send KICK with {"userId": userId} or BAN with {"userId": userId, "reason": reason, "expiresAt": expiresAt} as content.
 //	@Description
 //	@Description	When you receive a message from the server:
 //	@Description	If you send LIST_USERS, you will receive LIST_USERS with a list of users in the chatroom.
-//	@Description	If any user sends SEND_TEXT, you will receive the same message.
+//	@Description	If any user sends SEND_TEXT or SEND_THREAD_REPLY, you will receive the same message with the chat ID.
 //	@Description	If any user sends other action messages, you will receive LIST_USERS with a list of users in the chatroom.
-//	@Description	If you receive KICKED, you should know that you are kicked from the chatroom.
-//	@Description	If you receive ROOM_LIST_UPDATED, you should update chatroom list with the API.
+//	@Description	If you receive REACTION_ADDED or REACTION_REMOVED with the reaction as content, a user in the chatroom reacted to a chat or took it back.
+//	@Description	If you receive MENTION with the notification as content, you are mentioned in a chat, whether or not you are in the chatroom.
+//	@Description	If you receive KICKED, you should know that you are kicked from the chatroom, with the reason as content if any.
+//	@Description	If you receive ROOM_LIST_UPDATED, you should update chatroom list with the API, or the channel list of the guild if its ID is the content.
+//	@Description	If you receive GUILD_LIST_UPDATED with the guild ID as content, you should update the guild with the API.
+//	@Description	If you receive DIRECT_MESSAGE, a message was sent to one of your conversations, with the message as content.
+//	@Description	If you receive CONVERSATION_LIST_UPDATED with the conversation ID as content, you should update the conversation with the API.
+//	@Description	If you receive CALL with the conversation ID as content, someone is calling you in the conversation.
+//	@Description	If you receive RELATIONSHIP_UPDATED with the user ID as content, your relationship with the user has changed.
+//	@Description	If you receive READ_STATE_UPDATED with the read state as content, you marked a chatroom as read on another device.
+//	@Description	If you receive PRESENCE_UPDATE, the presence of a friend, a user in your chatroom or yourself has changed, with the presence as content.
+//	@Description	Messages from the users you blocked are not sent to you.
 //	@Description	If you receive INVALID, you should know that the message you sent is invalid.
+//	@Description	If you receive FORBIDDEN with the action as content, your role in the chatroom does not allow the action.
 //	@Description
 //	@Description	To connect WebRTC, if you receive OFFER with offer content, you should send ANSWER with answer content.
 //	@Description	Then, if you send CANDIDATE with candidate content, you will receive CANDIDATE with candidate content.
 //	@Tags			websocket
 //	@Summary		establish a WebSocket connection
-//	@Param			access_token	query	string	true	"access token"
-//	@Security		BearerAuth
+//	@Param			q	query	controller.ConnectWebsocket.Query	true	"query"
 //	@Success		101
-//	@Failure		401
+//	@Failure		401		"invalid or expired ticket"
+//	@Failure		403		"origin not allowed or user suspended"
 //	@Failure		404		"cannot find user"
 //	@Response		1000	{object}	controller.Message				"SEND_TEXT message format"
 //	@Response		1001	{object}	controller.ListClients.Response	"LIST_USERS content format"
 //	@Router			/ws [get]
 func (*Controller) ConnectWebsocket(c *gin.Context) {
-	userID := getCurrentUserID(c)
+	type Query struct {
+		Ticket string `form:"ticket" binding:"required"`
+	}
+
+	var query Query
+	if err := c.BindQuery(&query); err != nil {
+		return
+	}
+
+	ticket, ok := redeemTicket(c.Request, query.Ticket)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "invalid or expired ticket",
+		})
+		return
+	}
 
-	user, err := client.User.Get(ctx, userID)
+	user, err := client.User.Get(ctx, ticket.userID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"message": "cannot find user",
@@ -63,13 +99,24 @@ func (*Controller) ConnectWebsocket(c *gin.Context) {
 		return
 	}
 
+	if refuseSuspended(c, user) {
+		return
+	}
+
+	blockedIDs, err := getBlockedIDs(client, user.ID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	client := newClient(conn, user)
+	client := newClient(conn, user, ticket.sessionID, blockedIDs)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -78,10 +125,19 @@ func (*Controller) ConnectWebsocket(c *gin.Context) {
 }
 
 type Hub struct {
-	rooms      map[int]*Room
+	rooms map[int]*Room
+	// calls are the rooms of voice/video calls in conversations, keyed by
+	// conversation ID.
+	calls map[int]*Room
+	// clients are keyed by session ID, so a user may be connected from
+	// several devices at once. Clients connected with a personal access token
+	// are keyed by personalAccessTokenSessionID.
 	clients    map[int]*Client
 	register   chan *Client
 	unregister chan *Client
+	// commands are run on the hub goroutine, the only one that touches the
+	// maps above.
+	commands chan func()
 }
 
 var hub *Hub
@@ -89,16 +145,18 @@ var hub *Hub
 func init() {
 	hub = &Hub{
 		rooms:      make(map[int]*Room),
+		calls:      make(map[int]*Room),
 		clients:    make(map[int]*Client),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		commands:   make(chan func()),
 	}
 
 	go hub.run()
 
 	go func() {
 		for range time.NewTicker(time.Second * 3).C {
-			for _, room := range hub.rooms {
+			for _, room := range getRooms(func(*Room) bool { return true }) {
 				go room.dispatchKeyFrame()
 			}
 		}
@@ -109,57 +167,261 @@ func (hub *Hub) run() {
 	for {
 		select {
 		case client := <-hub.register:
-			if _, ok := hub.clients[client.ID]; ok {
-				close(client.send)
+			if _, ok := hub.clients[client.sessionID]; ok {
+				close(client.done)
 				continue
 			}
 
-			hub.clients[client.ID] = client
+			hub.clients[client.sessionID] = client
+			go updatePresence(client.ID)
 
 		case client := <-hub.unregister:
-			if client.room != nil {
-				client.room.unregister <- client
+			hub.remove(client)
+
+		case command := <-hub.commands:
+			command()
+		}
+	}
+}
+
+// remove unregisters the client on the hub goroutine.
+func (hub *Hub) remove(client *Client) {
+	// The room may be waiting for the hub to close itself, so the client
+	// leaves it on another goroutine.
+	if room := client.room; room != nil {
+		go room.leave(client)
+	}
+
+	if client == hub.clients[client.sessionID] {
+		delete(hub.clients, client.sessionID)
+		close(client.done)
+		go updatePresence(client.ID)
+	}
+}
+
+// do runs the command on the hub goroutine and waits for it. The command must
+// not wait for a room or a client, which may be waiting for the hub.
+func (hub *Hub) do(command func()) {
+	done := make(chan struct{})
+	hub.commands <- func() {
+		command()
+		close(done)
+	}
+	<-done
+}
+
+// getAllClients returns every connected client at the moment.
+func getAllClients() []*Client {
+	var clients []*Client
+	hub.do(func() {
+		clients = make([]*Client, 0, len(hub.clients))
+		for _, client := range hub.clients {
+			clients = append(clients, client)
+		}
+	})
+
+	return clients
+}
+
+// getClientsOf returns the connections of the users at the moment.
+func getClientsOf(userIDs []int) []*Client {
+	var clients []*Client
+	hub.do(func() {
+		for _, client := range hub.clients {
+			if slices.Contains(userIDs, client.ID) {
+				clients = append(clients, client)
 			}
+		}
+	})
+
+	return clients
+}
+
+// getRoom returns the room of the chatroom if anyone is in it.
+func getRoom(roomID int) (*Room, bool) {
+	var room *Room
+	var ok bool
+	hub.do(func() {
+		room, ok = hub.rooms[roomID]
+	})
 
-			if client == hub.clients[client.ID] {
-				delete(hub.clients, client.ID)
-				close(client.send)
+	return room, ok
+}
+
+// getRooms returns the open rooms and calls the filter accepts.
+func getRooms(filter func(room *Room) bool) []*Room {
+	var rooms []*Room
+	hub.do(func() {
+		for _, room := range hub.rooms {
+			if filter(room) {
+				rooms = append(rooms, room)
 			}
 		}
-	}
+		for _, room := range hub.calls {
+			if filter(room) {
+				rooms = append(rooms, room)
+			}
+		}
+	})
+
+	return rooms
 }
 
 func broadcastToAll(message *Message) {
-	for _, client := range hub.clients {
-		client.send <- message
+	for _, client := range getAllClients() {
+		client.deliver(message)
+	}
+}
+
+// broadcastToUsers sends the message to every connection of the users, except
+// those who blocked the sender.
+func broadcastToUsers(userIDs []int, message *Message) {
+	for _, client := range getClientsOf(userIDs) {
+		if !client.hasBlocked(message.senderID) {
+			client.deliver(message)
+		}
+	}
+}
+
+// setBlocked applies the block or unblock to every connection of the user at
+// once.
+func setBlocked(userID, targetID int, blocked bool) {
+	for _, client := range getClientsOf([]int{userID}) {
+		client.blockLock.Lock()
+		if blocked {
+			client.blocked[targetID] = true
+		} else {
+			delete(client.blocked, targetID)
+		}
+		client.blockLock.Unlock()
+	}
+}
+
+func (client *Client) hasBlocked(userID int) bool {
+	client.blockLock.RLock()
+	defer client.blockLock.RUnlock()
+
+	return client.blocked[userID]
+}
+
+// broadcastToRoom sends the message to the clients in the chatroom, if anyone
+// is in it.
+func broadcastToRoom(roomID int, message *Message) {
+	room, ok := getRoom(roomID)
+	if !ok {
+		return
+	}
+
+	room.send(message)
+}
+
+// broadcastToGuild sends the message to the members of the guild.
+func broadcastToGuild(guildID int, message *Message) {
+	memberIDs, err := client.GuildMember.
+		Query().
+		Where(guildmember.GuildID(guildID)).
+		Select(guildmember.FieldUserID).
+		Ints(ctx)
+	if err != nil {
+		log.Println(err)
+		return
 	}
+
+	broadcastToUsers(memberIDs, message)
+}
+
+// roomListUpdated tells the clients that the chatrooms have changed, either
+// the top-level chatrooms if guildID is 0, or the channels of the guild to its
+// members.
+func roomListUpdated(guildID int) {
+	if guildID == 0 {
+		broadcastToAll(&Message{Action: RoomListUpdatedAction})
+		return
+	}
+
+	broadcastToGuild(guildID, &Message{
+		Action:  RoomListUpdatedAction,
+		Content: strconv.Itoa(guildID),
+	})
+}
+
+func guildListUpdated(guildID int) *Message {
+	return &Message{
+		Action:  GuildListUpdatedAction,
+		Content: strconv.Itoa(guildID),
+	}
+}
+
+// disconnect closes every connection of the user.
+func disconnect(userID int) {
+	for _, client := range getClientsOf([]int{userID}) {
+		hub.unregister <- client
+	}
+}
+
+// kickUser kicks the user from the rooms, then closes every connection of the
+// user.
+func kickUser(userID int) {
+	hub.do(func() {
+		for _, client := range hub.clients {
+			if client.ID != userID {
+				continue
+			}
+
+			if client.room != nil {
+				client.deliver(&Message{Action: KickedAction})
+			}
+			hub.remove(client)
+		}
+	})
 }
 
-func disconnect(clientID int) {
-	client, ok := hub.clients[clientID]
+// disconnectSession closes the connection established with the session.
+func disconnectSession(sessionID int) {
+	var client *Client
+	var ok bool
+	hub.do(func() {
+		client, ok = hub.clients[sessionID]
+	})
+
 	if ok {
 		hub.unregister <- client
 	}
 }
 
 type Room struct {
-	id          int
-	clients     map[int]*Client
-	register    chan *Client
-	unregister  chan *Client
-	broadcast   chan *Message
+	id int
+	// guildID is 0 for top-level chatrooms.
+	guildID int
+	// Calls are keyed by the ID of the conversation instead of a chatroom.
+	isCall bool
+	// clients are changed only by the room goroutine, under listLock so that
+	// other goroutines can read them.
+	clients    map[int]*Client
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan *Message
+	kick       chan kickRequest
+	roles      chan RoomRole
+	// done is closed once the room is empty and removed from the hub.
+	done        chan struct{}
 	listLock    sync.RWMutex
 	trackLocals map[string]*webrtc.TrackLocalStaticRTP
 	sidTable    map[int]string
 }
 
-func newRoom(id int) *Room {
+func newRoom(id, guildID int, isCall bool) *Room {
 	room := &Room{
 		id:          id,
+		guildID:     guildID,
+		isCall:      isCall,
 		clients:     make(map[int]*Client),
 		register:    make(chan *Client),
 		unregister:  make(chan *Client),
 		broadcast:   make(chan *Message, 256),
+		kick:        make(chan kickRequest),
+		roles:       make(chan RoomRole),
+		done:        make(chan struct{}),
 		listLock:    sync.RWMutex{},
 		trackLocals: map[string]*webrtc.TrackLocalStaticRTP{},
 		sidTable:    map[int]string{},
@@ -174,67 +436,403 @@ func (room *Room) run() {
 	for {
 		select {
 		case client := <-room.register:
-			room.clients[client.ID] = client
+			// The same user joining from another device takes over the seat.
+			if other, ok := room.clients[client.ID]; ok && other != client {
+				other.deliver(&Message{Action: KickedAction})
+				other.room = nil
+
+				other.pc.Close()
+				other.pc = nil
+			}
+
+			room.setClient(client.ID, client)
 			client.room = room
 			client.connectToPeers(room)
 
-			room.broadcast <- room.ListClients()
+			room.sendToClients(room.ListClients())
 
 		case client := <-room.unregister:
-			delete(room.clients, client.ID)
-			client.room = nil
+			// The client may have been taken over or dropped already.
+			if room.clients[client.ID] != client {
+				continue
+			}
 
-			client.pc.Close()
-			client.pc = nil
+			room.remove(client)
 
 			if len(room.clients) == 0 {
-				delete(hub.rooms, room.id)
+				room.close()
 				return
 			}
 
-			room.broadcast <- room.ListClients()
+			room.sendToClients(room.ListClients())
 
-		case message := <-room.broadcast:
+		case kick := <-room.kick:
+			kicked := false
 			for _, client := range room.clients {
-				select {
-				case client.send <- message:
-				default:
-					delete(room.clients, client.ID)
+				if kick.userID != 0 && client.ID != kick.userID {
+					continue
 				}
+
+				client.deliver(&Message{
+					Action:  KickedAction,
+					Content: kick.reason,
+				})
+				room.remove(client)
+				kicked = true
+			}
+			kick.kicked <- kicked
+
+			if len(room.clients) == 0 {
+				room.close()
+				return
+			}
+
+			if kicked {
+				room.sendToClients(room.ListClients())
+			}
+
+		case role := <-room.roles:
+			client, ok := room.clients[role.UserID]
+			if !ok {
+				continue
 			}
+
+			client.setRole(role)
+			room.sendToClients(room.ListClients())
+
+		case message := <-room.broadcast:
+			room.sendToClients(message)
 		}
 	}
 }
 
-func joinRoom(roomID, clientID int, muted, camOn bool) {
-	room, ok := hub.rooms[roomID]
-	if !ok {
-		room = newRoom(roomID)
-		hub.rooms[roomID] = room
+// kickRequest asks the room goroutine to kick the user, or everyone if userID
+// is 0, telling the reason if any.
+type kickRequest struct {
+	userID int
+	reason string
+	// kicked is sent whether anyone was kicked.
+	kicked chan bool
+}
+
+// remove takes the client out of the room and hangs up its peer connection.
+func (room *Room) remove(client *Client) {
+	room.setClient(client.ID, nil)
+	client.room = nil
+
+	client.pc.Close()
+	client.pc = nil
+}
+
+// setClient puts the client in the room, or takes the user out if nil.
+func (room *Room) setClient(userID int, client *Client) {
+	room.listLock.Lock()
+	defer room.listLock.Unlock()
+
+	if client == nil {
+		delete(room.clients, userID)
+	} else {
+		room.clients[userID] = client
+	}
+}
+
+// sendToClients sends the message to the clients in the room, except those who
+// blocked the sender, and drops the clients that are too far behind.
+func (room *Room) sendToClients(message *Message) {
+	for _, client := range room.clients {
+		if client.hasBlocked(message.senderID) {
+			continue
+		}
+
+		if !client.deliver(message) {
+			room.setClient(client.ID, nil)
+		}
 	}
+}
 
-	client, ok := hub.clients[clientID]
+// close removes the room from the hub, then lets those waiting for the room
+// know that it is gone.
+func (room *Room) close() {
+	hub.do(func() {
+		rooms := hub.rooms
+		if room.isCall {
+			rooms = hub.calls
+		}
+
+		if rooms[room.id] == room {
+			delete(rooms, room.id)
+		}
+	})
+
+	close(room.done)
+}
+
+// enter puts the client in the room, and reports false if the room has been
+// closed meanwhile.
+func (room *Room) enter(client *Client) bool {
+	select {
+	case room.register <- client:
+		return true
+	case <-room.done:
+		return false
+	}
+}
+
+// leave takes the client out of the room, if the room is still open.
+func (room *Room) leave(client *Client) {
+	select {
+	case room.unregister <- client:
+	case <-room.done:
+	}
+}
+
+// send broadcasts the message to the room, if the room is still open.
+func (room *Room) send(message *Message) {
+	select {
+	case room.broadcast <- message:
+	case <-room.done:
+	}
+}
+
+// userIDs returns the IDs of the users in the room at the moment.
+func (room *Room) userIDs() []int {
+	room.listLock.RLock()
+	defer room.listLock.RUnlock()
+
+	userIDs := make([]int, 0, len(room.clients))
+	for id := range room.clients {
+		userIDs = append(userIDs, id)
+	}
+
+	return userIDs
+}
+
+func joinRoom(roomID, guildID, sessionID int, muted, camOn bool, role RoomRole) {
+	for {
+		room, client, _ := openRoom(roomID, guildID, false, sessionID)
+		if client == nil || enterRoom(room, client, muted, camOn, role) {
+			return
+		}
+	}
+}
+
+// joinCall joins the call of the conversation, and reports whether the call
+// has just started.
+func joinCall(conversationID, sessionID int, muted, camOn bool, role RoomRole) bool {
+	for {
+		room, client, opened := openRoom(conversationID, 0, true, sessionID)
+		if client == nil {
+			return false
+		}
+
+		if enterRoom(room, client, muted, camOn, role) {
+			return opened
+		}
+	}
+}
+
+// openRoom returns the client of the session and the room or call of the ID,
+// opening the room if no one is in it yet. The room is not opened if the
+// session is not connected.
+func openRoom(id, guildID int, isCall bool, sessionID int) (room *Room, client *Client, opened bool) {
+	hub.do(func() {
+		client = hub.clients[sessionID]
+		if client == nil {
+			return
+		}
+
+		rooms := hub.rooms
+		if isCall {
+			rooms = hub.calls
+		}
+
+		room = rooms[id]
+		if room == nil {
+			room = newRoom(id, guildID, isCall)
+			rooms[id] = room
+			opened = true
+		}
+	})
+
+	return room, client, opened
+}
+
+// enterRoom puts the client in the room with the role, and reports false if
+// the room has been closed meanwhile.
+func enterRoom(room *Room, client *Client, muted, camOn bool, role RoomRole) bool {
+	client.Muted = muted
+	client.CamOn = camOn
+	client.ScreenSharing = false
+	client.setRole(role)
+
+	return room.enter(client)
+}
+
+// updateRoomRole applies the new role to the user in the room at once.
+func updateRoomRole(roomID int, role RoomRole) {
+	room, ok := getRoom(roomID)
 	if ok {
-		client.Muted = muted
-		client.CamOn = camOn
-		room.register <- client
+		room.applyRole(role)
 	}
 }
 
+// applyRole applies the role to the user in the room through the room
+// goroutine, if the room is still open.
+func (room *Room) applyRole(role RoomRole) {
+	select {
+	case room.roles <- role:
+	case <-room.done:
+	}
+}
+
+// refreshRoomRoles looks up the roles of the users in the rooms again, after
+// something they depend on has changed.
+func refreshRoomRoles(roomIDs ...int) {
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, roomID := range roomIDs {
+		room, ok := getRoom(roomID)
+		if !ok {
+			continue
+		}
+
+		chatroom, err := tx.Chatroom.Get(ctx, roomID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, userID := range room.userIDs() {
+			role, err := getRoomRole(tx, chatroom, userID)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			room.applyRole(role)
+		}
+	}
+}
+
+// refreshGuildRoles looks up the roles of the users in the channels of the
+// guild again.
+func refreshGuildRoles(guildID int) {
+	roomIDs := make([]int, 0)
+	for _, room := range getGuildRooms(guildID) {
+		roomIDs = append(roomIDs, room.id)
+	}
+
+	refreshRoomRoles(roomIDs...)
+}
+
+// setRole turns off what the role does not allow.
+func (client *Client) setRole(role RoomRole) {
+	client.Role = role.Role
+	client.permissions.Store(uint32(role.Permissions))
+
+	if !role.Permissions.Has(PermissionSpeak) {
+		client.Muted = true
+	}
+	if !role.Permissions.Has(PermissionVideo) {
+		client.CamOn = false
+	}
+	if !role.Permissions.Has(PermissionScreenShare) {
+		client.ScreenSharing = false
+	}
+}
+
+// getPermissions returns the permissions of the role, which the goroutines
+// forwarding the media of the client read meanwhile.
+func (client *Client) getPermissions() Permission {
+	return Permission(client.permissions.Load())
+}
+
+// allow tells the client if the role does not allow the action.
+func (client *Client) allow(permission Permission, message *Message) bool {
+	if client.getPermissions().Has(permission) {
+		return true
+	}
+
+	client.deliver(&Message{
+		Action:  ForbiddenAction,
+		Content: message.Action,
+	})
+	return false
+}
+
 func kickAllClientsFromRoom(roomID int) {
-	room, ok := hub.rooms[roomID]
+	room, ok := getRoom(roomID)
+	if ok {
+		room.expel(0, "")
+	}
+}
+
+// kickAllClientsFromGuild kicks everyone out of the channels of the guild.
+func kickAllClientsFromGuild(guildID int) {
+	for _, room := range getGuildRooms(guildID) {
+		room.expel(0, "")
+	}
+}
+
+// kickFromGuild kicks the user out of the channels of the guild.
+func kickFromGuild(guildID, userID int) {
+	for _, room := range getGuildRooms(guildID) {
+		room.expel(userID, "")
+	}
+}
+
+// getGuildRooms returns the open rooms of the channels of the guild.
+func getGuildRooms(guildID int) []*Room {
+	return getRooms(func(room *Room) bool {
+		return !room.isCall && room.guildID == guildID
+	})
+}
+
+// kickFromRoom kicks the user out of the room, telling the reason if any, and
+// reports whether the user was in the room.
+func kickFromRoom(roomID, userID int, reason string) bool {
+	room, ok := getRoom(roomID)
 	if !ok {
-		return
+		return false
 	}
 
-	message := &Message{Action: KickedAction}
-	for _, client := range room.clients {
-		client.send <- message
-		room.unregister <- client
+	return room.expel(userID, reason)
+}
+
+// kickFromCall kicks the user out of the call of the conversation.
+func kickFromCall(conversationID, userID int) {
+	var room *Room
+	var ok bool
+	hub.do(func() {
+		room, ok = hub.calls[conversationID]
+	})
+
+	if ok {
+		room.expel(userID, "")
+	}
+}
+
+// expel kicks the user, or everyone if userID is 0, out of the room through
+// the room goroutine, and reports whether anyone was kicked.
+func (room *Room) expel(userID int, reason string) bool {
+	kicked := make(chan bool, 1)
+	select {
+	case room.kick <- kickRequest{userID: userID, reason: reason, kicked: kicked}:
+		return <-kicked
+	case <-room.done:
+		return false
 	}
 }
 
 func (room *Room) ListClients() *Message {
+	room.listLock.RLock()
+	defer room.listLock.RUnlock()
+
 	keys := make([]int, 0, len(room.clients))
 	for k := range room.clients {
 		keys = append(keys, k)
@@ -265,7 +863,13 @@ const (
 	JoinRoomAction  = "JOIN_ROOM"
 	LeaveRoomAction = "LEAVE_ROOM"
 
-	SendTextAction = "SEND_TEXT"
+	SendTextAction        = "SEND_TEXT"
+	SendThreadReplyAction = "SEND_THREAD_REPLY"
+
+	ReactionAddedAction   = "REACTION_ADDED"
+	ReactionRemovedAction = "REACTION_REMOVED"
+
+	MentionAction = "MENTION"
 
 	MuteAction   = "MUTE"
 	UnmuteAction = "UNMUTE"
@@ -273,15 +877,34 @@ const (
 	TurnOnCamAction  = "TURN_ON_CAM"
 	TurnOffCamAction = "TURN_OFF_CAM"
 
+	StartScreenShareAction = "START_SCREEN_SHARE"
+	StopScreenShareAction  = "STOP_SCREEN_SHARE"
+
+	KickAction   = "KICK"
+	BanAction    = "BAN"
 	KickedAction = "KICKED"
 
-	RoomListUpdatedAction = "ROOM_LIST_UPDATED"
+	RoomListUpdatedAction  = "ROOM_LIST_UPDATED"
+	GuildListUpdatedAction = "GUILD_LIST_UPDATED"
+
+	DirectMessageAction           = "DIRECT_MESSAGE"
+	ConversationListUpdatedAction = "CONVERSATION_LIST_UPDATED"
+	CallAction                    = "CALL"
+
+	RelationshipUpdatedAction = "RELATIONSHIP_UPDATED"
+
+	HeartbeatAction      = "HEARTBEAT"
+	PresenceUpdateAction = "PRESENCE_UPDATE"
+
+	MarkReadAction         = "MARK_READ"
+	ReadStateUpdatedAction = "READ_STATE_UPDATED"
 
 	OfferAction     = "OFFER"
 	AnswerAction    = "ANSWER"
 	CandidateAction = "CANDIDATE"
 
-	InvalidAction = "INVALID"
+	InvalidAction   = "INVALID"
+	ForbiddenAction = "FORBIDDEN"
 )
 
 type Message struct {
@@ -290,6 +913,11 @@ type Message struct {
 	Name      string     `json:"displayName,omitempty"`
 	Color     uint8      `json:"profileColorIndex,omitempty"`
 	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	ChatID    int        `json:"chatId,omitempty"`
+	ParentID  int        `json:"parentId,omitempty"`
+	ReplyToID int        `json:"replyToId,omitempty"`
+	// senderID is 0 for messages from the server.
+	senderID int
 }
 
 const (
@@ -307,40 +935,161 @@ const (
 )
 
 type Client struct {
-	ID    int                    `json:"userId" binding:"required"`
-	conn  *websocket.Conn        `json:"-"`
-	send  chan *Message          `json:"-"`
-	room  *Room                  `json:"-"`
-	pc    *webrtc.PeerConnection `json:"-"`
-	Name  string                 `json:"displayName" binding:"required"`
-	Color uint8                  `json:"profileColorIndex" binding:"required"`
-	Muted bool                   `json:"muted" binding:"required"`
-	CamOn bool                   `json:"camOn" binding:"required"`
-}
-
-func newClient(conn *websocket.Conn, user *ent.User) *Client {
+	ID        int             `json:"userId" binding:"required"`
+	sessionID int             `json:"-"`
+	conn      *websocket.Conn `json:"-"`
+	// send is never closed, as anyone may send to it. done is closed instead
+	// once the hub unregisters the client.
+	send          chan *Message          `json:"-"`
+	done          chan struct{}          `json:"-"`
+	room          *Room                  `json:"-"`
+	pc            *webrtc.PeerConnection `json:"-"`
+	permissions   atomic.Uint32          `json:"-"`
+	blocked       map[int]bool           `json:"-"`
+	blockLock     sync.RWMutex           `json:"-"`
+	lastActive    atomic.Int64           `json:"-"`
+	Name          string                 `json:"displayName" binding:"required"`
+	Color         uint8                  `json:"profileColorIndex" binding:"required"`
+	Role          chatroomrole.Role      `json:"role" binding:"required"`
+	Muted         bool                   `json:"muted" binding:"required"`
+	CamOn         bool                   `json:"camOn" binding:"required"`
+	ScreenSharing bool                   `json:"screenSharing" binding:"required"`
+}
+
+func newClient(conn *websocket.Conn, user *ent.User, sessionID int, blockedIDs []int) *Client {
+	blocked := make(map[int]bool, len(blockedIDs))
+	for _, id := range blockedIDs {
+		blocked[id] = true
+	}
+
 	client := &Client{
-		ID:    user.ID,
-		conn:  conn,
-		send:  make(chan *Message, 256),
-		Name:  user.DisplayName,
-		Color: user.ProfileColorIndex,
-		Muted: false,
-		CamOn: false,
+		ID:        user.ID,
+		sessionID: sessionID,
+		conn:      conn,
+		send:      make(chan *Message, 256),
+		done:      make(chan struct{}),
+		blocked:   blocked,
+		Name:      user.DisplayName,
+		Color:     user.ProfileColorIndex,
+		Muted:     false,
+		CamOn:     false,
 	}
+	client.lastActive.Store(time.Now().UnixNano())
 
 	hub.register <- client
 
 	return client
 }
 
-func saveChat(chatroomID, senderID int, content string) {
-	client.Chat.
-		Create().
-		SetChatroomID(chatroomID).
-		SetSenderID(senderID).
-		SetContent(content).
-		Save(ctx)
+// deliver queues the message for the client without waiting, and reports false
+// if the message is dropped because the client is unregistered or too far
+// behind.
+func (client *Client) deliver(message *Message) bool {
+	select {
+	case <-client.done:
+		return false
+	default:
+	}
+
+	select {
+	case client.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// moderate kicks or bans the user in the content of the message out of the
+// room of the moderator, as KickFromChatroom and BanFromChatroom do.
+func moderate(moderator *Client, room *Room, message *Message) {
+	var content struct {
+		UserID    int        `json:"userId"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	err := json.Unmarshal([]byte(message.Content), &content)
+	if err != nil || content.UserID == 0 || content.ExpiresAt != nil && content.ExpiresAt.Before(time.Now()) {
+		moderator.deliver(&Message{
+			Action:  InvalidAction,
+			Content: message.Content,
+		})
+		return
+	}
+
+	tx, err := client.Tx(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tx.Rollback()
+
+	chatroom, err := tx.Chatroom.Get(ctx, room.id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	target, err := getRoomRole(tx, chatroom, content.UserID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	current := RoomRole{UserID: moderator.ID, Role: moderator.Role, Permissions: moderator.getPermissions()}
+	if !outranksInRoom(current, target.Role) {
+		moderator.deliver(&Message{
+			Action:  ForbiddenAction,
+			Content: message.Action,
+		})
+		return
+	}
+
+	if message.Action == BanAction {
+		_, err := banFromRoom(tx, room.id, content.UserID, moderator.ID, content.Reason, content.ExpiresAt)
+		if err != nil {
+			moderator.deliver(&Message{
+				Action:  InvalidAction,
+				Content: message.Content,
+			})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	kickFromRoom(room.id, content.UserID, content.Reason)
+}
+
+// sendTextInRoom saves the text sent in the room as a chat, and broadcasts it
+// with the chat ID and the custom emojis resolved to the room.
+func sendTextInRoom(room *Room, sender *Client, message *Message) {
+	chat, err := saveChat(client, room.id, sender.ID, message.Content, message.ParentID, message.ReplyToID)
+	if ent.IsNotFound(err) {
+		sender.deliver(&Message{
+			Action:  InvalidAction,
+			Content: message.Action,
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	message.ChatID = chat.ID
+	message.Content = chat.Content
+	room.send(message)
+
+	mentions, err := saveMentions(client, chat, sender.getPermissions())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	deliverMentions(mentions, chat, sender.Name, sender.Color)
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -372,12 +1121,24 @@ func (client *Client) readPump() {
 
 		message.Name = client.Name
 		message.Color = client.Color
+		message.senderID = client.ID
 		message.CreatedAt = &time.Time{}
 		*message.CreatedAt = time.Now()
 
 		pretty, _ := json.MarshalIndent(message, "", "  ")
 		log.Println(string(pretty))
 
+		client.lastActive.Store(message.CreatedAt.UnixNano())
+		if message.Action == HeartbeatAction {
+			go updatePresence(client.ID)
+			continue
+		}
+
+		if message.Action == MarkReadAction {
+			markReadFromClient(client, message)
+			continue
+		}
+
 		if client.room == nil {
 			log.Println("the client is not in a room, message ignored")
 			continue
@@ -386,30 +1147,81 @@ func (client *Client) readPump() {
 
 		switch message.Action {
 		case ListUsersAction:
-			client.send <- room.ListClients()
+			client.deliver(room.ListClients())
 
 		case LeaveRoomAction:
-			room.unregister <- client
+			room.leave(client)
 
 		case SendTextAction:
-			saveChat(room.id, client.ID, message.Content)
-			room.broadcast <- message
+			if !client.allow(PermissionSendText, message) {
+				continue
+			}
+
+			if room.isCall {
+				sendTextInCall(room.id, client, message.Content)
+				continue
+			}
+
+			message.ParentID = 0
+			sendTextInRoom(room, client, message)
+
+		case SendThreadReplyAction:
+			if !client.allow(PermissionSendText, message) {
+				continue
+			}
+
+			if room.isCall || message.ParentID == 0 {
+				client.deliver(&Message{
+					Action:  InvalidAction,
+					Content: string(pretty),
+				})
+				continue
+			}
+
+			sendTextInRoom(room, client, message)
 
 		case MuteAction:
 			client.Muted = true
-			room.broadcast <- room.ListClients()
+			room.send(room.ListClients())
 
 		case UnmuteAction:
+			if !client.allow(PermissionSpeak, message) {
+				continue
+			}
+
 			client.Muted = false
-			room.broadcast <- room.ListClients()
+			room.send(room.ListClients())
 
 		case TurnOnCamAction:
+			if !client.allow(PermissionVideo, message) {
+				continue
+			}
+
 			client.CamOn = true
-			room.broadcast <- room.ListClients()
+			room.send(room.ListClients())
 
 		case TurnOffCamAction:
 			client.CamOn = false
-			room.broadcast <- room.ListClients()
+			room.send(room.ListClients())
+
+		case StartScreenShareAction:
+			if !client.allow(PermissionScreenShare, message) {
+				continue
+			}
+
+			client.ScreenSharing = true
+			room.send(room.ListClients())
+
+		case StopScreenShareAction:
+			client.ScreenSharing = false
+			room.send(room.ListClients())
+
+		case KickAction, BanAction:
+			if !client.allow(PermissionKick, message) {
+				continue
+			}
+
+			moderate(client, room, message)
 
 		case AnswerAction:
 			answer := webrtc.SessionDescription{}
@@ -422,10 +1234,10 @@ func (client *Client) readPump() {
 			client.pc.AddICECandidate(candidate)
 
 		default:
-			client.send <- &Message{
+			client.deliver(&Message{
 				Action:  InvalidAction,
 				Content: string(pretty),
-			}
+			})
 		}
 	}
 }
@@ -443,28 +1255,22 @@ func (client *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-client.send:
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := client.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+		case message := <-client.send:
+			if err := client.write(message); err != nil {
 				return
 			}
 
-			p, err := json.Marshal(message)
-			if err != nil {
-				return
+		case <-client.done:
+			// Write what was queued before the hub unregistered the client.
+			for len(client.send) > 0 {
+				if err := client.write(<-client.send); err != nil {
+					return
+				}
 			}
-			w.Write(p)
 
-			if err := w.Close(); err != nil {
-				return
-			}
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
 		case <-ticker.C:
 			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -475,6 +1281,23 @@ func (client *Client) writePump() {
 	}
 }
 
+func (client *Client) write(message *Message) error {
+	client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	w, err := client.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+
+	p, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	w.Write(p)
+
+	return w.Close()
+}
+
 func (client *Client) connectToPeers(room *Room) {
 	// Create new PeerConnection
 	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
@@ -507,10 +1330,10 @@ func (client *Client) connectToPeers(room *Room) {
 			return
 		}
 
-		client.send <- &Message{
+		client.deliver(&Message{
 			Action:  CandidateAction,
 			Content: string(candidateString),
-		}
+		})
 	})
 
 	// If PeerConnection is closed remove it from global list
@@ -529,9 +1352,15 @@ func (client *Client) connectToPeers(room *Room) {
 	pc.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
 		// Create a track to fan out our incoming video to all peers
 		trackLocal := room.addTrack(t, client.ID)
-		room.broadcast <- room.ListClients()
+		room.send(room.ListClients())
 		defer room.removeTrack(trackLocal, client.ID)
 
+		// Media the role does not allow is dropped, whatever the client does.
+		allowed := PermissionSpeak
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			allowed = PermissionVideo | PermissionScreenShare
+		}
+
 		buf := make([]byte, 1500)
 		for {
 			i, _, err := t.Read(buf)
@@ -539,6 +1368,10 @@ func (client *Client) connectToPeers(room *Room) {
 				return
 			}
 
+			if client.getPermissions()&allowed == 0 {
+				continue
+			}
+
 			if _, err = trackLocal.Write(buf[:i]); err != nil {
 				return
 			}
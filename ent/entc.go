@@ -22,6 +22,10 @@ func main() {
 						n.Annotations.Set(tag.Name(), tag)
 
 						for _, f := range n.Fields {
+							if f.StructTag == `json:"-"` {
+								continue
+							}
+
 							f.StructTag = fmt.Sprintf(`json:"%s,omitempty"`, camel(f.Name))
 						}
 					}
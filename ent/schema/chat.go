@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
 	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
 )
@@ -22,6 +23,21 @@ func (Chat) Fields() []ent.Field {
 
 		field.String("content"),
 
+		// parent_id is the chat that started the thread the chat is in.
+		field.Int("parent_id").
+			Optional().
+			Nillable(),
+
+		field.Int("reply_to_id").
+			Optional().
+			Nillable(),
+
+		// deleted_at is set instead of deleting the chat if other chats
+		// depend on it, leaving a tombstone without the content.
+		field.Time("deleted_at").
+			Optional().
+			Nillable(),
+
 		field.Time("created_at").
 			Default(time.Now).
 			Immutable(),
@@ -46,5 +62,23 @@ func (Chat) Edges() []ent.Edge {
 			Field("sender_id").
 			Unique().
 			Required(),
+
+		edge.To("thread_replies", Chat.Type).
+			From("parent").
+			Field("parent_id").
+			Unique().
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("reactions", Reaction.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("mentions", Mention.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("replies", Chat.Type).
+			From("reply_to").
+			Field("reply_to_id").
+			Unique().
+			Annotations(entsql.OnDelete(entsql.SetNull)),
 	}
 }
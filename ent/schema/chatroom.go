@@ -26,11 +26,31 @@ func (Chatroom) Fields() []ent.Field {
 			Optional().
 			Sensitive(),
 
-		field.Int("owner_id"),
+		// Archived chatrooms have no owner.
+		field.Int("owner_id").
+			Optional(),
 
 		field.Uint8("profile_color_index").
 			Immutable(),
 
+		// Chatrooms in a guild are its channels, the others are top-level.
+		field.Int("guild_id").
+			Optional().
+			Immutable(),
+
+		field.Int("category_id").
+			Optional(),
+
+		// Text channels have no media, and only moderators speak in stage
+		// channels.
+		field.Enum("type").
+			Values("text", "voice", "stage").
+			Default("voice"),
+
+		// Channels are listed in ascending order of position.
+		field.Int("position").
+			Default(0),
+
 		field.Time("created_at").
 			Default(time.Now).
 			Immutable(),
@@ -38,6 +58,11 @@ func (Chatroom) Fields() []ent.Field {
 		field.Time("updated_at").
 			Default(time.Now).
 			UpdateDefault(time.Now),
+
+		// Archived chatrooms are kept read-only.
+		field.Time("archived_at").
+			Optional().
+			Nillable(),
 	}
 }
 
@@ -47,13 +72,39 @@ func (Chatroom) Edges() []ent.Edge {
 		edge.From("owner", User.Type).
 			Ref("chatrooms").
 			Field("owner_id").
+			Unique(),
+
+		edge.From("guild", Guild.Type).
+			Ref("channels").
+			Field("guild_id").
 			Unique().
-			Required(),
+			Immutable(),
+
+		edge.From("category", GuildCategory.Type).
+			Ref("channels").
+			Field("category_id").
+			Unique(),
 
 		edge.From("members", User.Type).
-			Ref("allowed_chatrooms"),
+			Ref("allowed_chatrooms").
+			Through("memberships", Membership.Type),
 
 		edge.To("chats", Chat.Type).
 			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("emojis", CustomEmoji.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("read_states", ReadState.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("roles", ChatroomRole.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("bans", ChatroomBan.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("invites", Invite.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
 	}
 }
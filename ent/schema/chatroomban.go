@@ -0,0 +1,70 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// ChatroomBan holds the schema definition for the ChatroomBan entity. A ban
+// without expiry lasts until it is lifted.
+type ChatroomBan struct {
+	ent.Schema
+}
+
+// Fields of the ChatroomBan.
+func (ChatroomBan) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("chatroom_id"),
+
+		field.Int("user_id"),
+
+		// The moderator who issued the ban, if still around.
+		field.Int("issuer_id").
+			Optional(),
+
+		field.String("reason").
+			Optional(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("expires_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the ChatroomBan.
+func (ChatroomBan) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chatroom", Chatroom.Type).
+			Ref("bans").
+			Field("chatroom_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("chatroom_bans").
+			Field("user_id").
+			Unique().
+			Required(),
+
+		edge.From("issuer", User.Type).
+			Ref("issued_chatroom_bans").
+			Field("issuer_id").
+			Unique(),
+	}
+}
+
+// Indexes of the ChatroomBan.
+func (ChatroomBan) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("chatroom_id", "user_id").
+			Unique(),
+	}
+}
@@ -0,0 +1,67 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// ChatroomRole holds the schema definition for the ChatroomRole entity, the
+// role of a user in a chatroom. Users without one are members, and the owner
+// of the chatroom is never given one.
+type ChatroomRole struct {
+	ent.Schema
+}
+
+// Fields of the ChatroomRole.
+func (ChatroomRole) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("chatroom_id"),
+
+		field.Int("user_id"),
+
+		field.Enum("role").
+			Values("moderator", "member", "guest"),
+
+		// Overrides the permissions of the role for the user, if set.
+		field.Uint32("permissions").
+			Optional().
+			Nillable(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("updated_at").
+			Default(time.Now).
+			UpdateDefault(time.Now),
+	}
+}
+
+// Edges of the ChatroomRole.
+func (ChatroomRole) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chatroom", Chatroom.Type).
+			Ref("roles").
+			Field("chatroom_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("chatroom_roles").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the ChatroomRole.
+func (ChatroomRole) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("chatroom_id", "user_id").
+			Unique(),
+	}
+}
@@ -0,0 +1,58 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// Conversation holds the schema definition for the Conversation entity, a
+// direct message between two users or a group of users.
+type Conversation struct {
+	ent.Schema
+}
+
+// Fields of the Conversation.
+func (Conversation) Fields() []ent.Field {
+	return []ent.Field{
+		// Only group conversations have a name.
+		field.String("name").
+			Optional(),
+
+		field.Bool("is_group").
+			Default(false).
+			Immutable(),
+
+		// The user who started the group, who may remove the others.
+		field.Int("owner_id").
+			Optional(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		// Bumped on every message, so that the latest conversations come first.
+		field.Time("updated_at").
+			Default(time.Now).
+			UpdateDefault(time.Now),
+	}
+}
+
+// Edges of the Conversation.
+func (Conversation) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("owned_conversations").
+			Field("owner_id").
+			Unique(),
+
+		edge.To("participants", ConversationParticipant.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("messages", DirectMessage.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+	}
+}
@@ -0,0 +1,54 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// ConversationParticipant holds the schema definition for the
+// ConversationParticipant entity, a user in a conversation.
+type ConversationParticipant struct {
+	ent.Schema
+}
+
+// Fields of the ConversationParticipant.
+func (ConversationParticipant) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("conversation_id"),
+
+		field.Int("user_id"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the ConversationParticipant.
+func (ConversationParticipant) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("conversation", Conversation.Type).
+			Ref("participants").
+			Field("conversation_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("conversation_participants").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the ConversationParticipant.
+func (ConversationParticipant) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("conversation_id", "user_id").
+			Unique(),
+	}
+}
@@ -0,0 +1,83 @@
+package schema
+
+import (
+	"regexp"
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// CustomEmoji holds the schema definition for the CustomEmoji entity, an image
+// uploaded to a chatroom or a guild to be used as :name: in chats and
+// reactions.
+type CustomEmoji struct {
+	ent.Schema
+}
+
+// Fields of the CustomEmoji.
+func (CustomEmoji) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("name").
+			Match(regexp.MustCompile(`^\w{2,32}$`)),
+
+		// Either chatroom_id or guild_id is set.
+		field.Int("chatroom_id").
+			Optional().
+			Immutable(),
+
+		field.Int("guild_id").
+			Optional().
+			Immutable(),
+
+		field.Int("uploader_id").
+			Optional(),
+
+		// file_name is the name of the image in the file storage.
+		field.String("file_name").
+			Immutable().
+			StructTag(`json:"-"`),
+
+		field.Int("size").
+			Immutable(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the CustomEmoji.
+func (CustomEmoji) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chatroom", Chatroom.Type).
+			Ref("emojis").
+			Field("chatroom_id").
+			Unique().
+			Immutable(),
+
+		edge.From("guild", Guild.Type).
+			Ref("emojis").
+			Field("guild_id").
+			Unique().
+			Immutable(),
+
+		edge.From("uploader", User.Type).
+			Ref("uploaded_emojis").
+			Field("uploader_id").
+			Unique(),
+	}
+}
+
+// Indexes of the CustomEmoji.
+func (CustomEmoji) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("chatroom_id", "name").
+			Unique(),
+
+		index.Fields("guild_id", "name").
+			Unique(),
+	}
+}
@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// DirectMessage holds the schema definition for the DirectMessage entity, a
+// chat in a conversation.
+type DirectMessage struct {
+	ent.Schema
+}
+
+// Fields of the DirectMessage.
+func (DirectMessage) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("conversation_id"),
+
+		field.Int("sender_id"),
+
+		field.String("content"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("updated_at").
+			Default(time.Now).
+			UpdateDefault(time.Now),
+	}
+}
+
+// Edges of the DirectMessage.
+func (DirectMessage) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("conversation", Conversation.Type).
+			Ref("messages").
+			Field("conversation_id").
+			Unique().
+			Required(),
+
+		edge.From("sender", User.Type).
+			Ref("direct_messages").
+			Field("sender_id").
+			Unique().
+			Required(),
+	}
+}
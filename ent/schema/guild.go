@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// Guild holds the schema definition for the Guild entity, a server of
+// chatrooms as its channels.
+type Guild struct {
+	ent.Schema
+}
+
+// Fields of the Guild.
+func (Guild) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("name"),
+
+		// Archived guilds have no owner.
+		field.Int("owner_id").
+			Optional(),
+
+		field.Uint8("profile_color_index").
+			Immutable(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("updated_at").
+			Default(time.Now).
+			UpdateDefault(time.Now),
+
+		field.Time("archived_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the Guild.
+func (Guild) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("guilds").
+			Field("owner_id").
+			Unique(),
+
+		edge.To("members", GuildMember.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("categories", GuildCategory.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("channels", Chatroom.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("emojis", CustomEmoji.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+	}
+}
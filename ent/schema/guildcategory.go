@@ -0,0 +1,47 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// GuildCategory holds the schema definition for the GuildCategory entity,
+// which groups the channels of a guild.
+type GuildCategory struct {
+	ent.Schema
+}
+
+// Fields of the GuildCategory.
+func (GuildCategory) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("guild_id"),
+
+		field.String("name"),
+
+		field.Int("position").
+			Default(0),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the GuildCategory.
+func (GuildCategory) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("guild", Guild.Type).
+			Ref("categories").
+			Field("guild_id").
+			Unique().
+			Required(),
+
+		// Channels of a deleted category are left uncategorized.
+		edge.To("channels", Chatroom.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+	}
+}
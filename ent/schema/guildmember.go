@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// GuildMember holds the schema definition for the GuildMember entity, a user
+// who joined a guild, with the role in it.
+type GuildMember struct {
+	ent.Schema
+}
+
+// Fields of the GuildMember.
+func (GuildMember) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("guild_id"),
+
+		field.Int("user_id"),
+
+		// The owner of the guild is a member as well, whatever the role.
+		field.Enum("role").
+			Values("moderator", "member").
+			Default("member"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the GuildMember.
+func (GuildMember) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("guild", Guild.Type).
+			Ref("members").
+			Field("guild_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("guild_memberships").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the GuildMember.
+func (GuildMember) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("guild_id", "user_id").
+			Unique(),
+	}
+}
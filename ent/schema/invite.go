@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// Invite holds the schema definition for the Invite entity, a code letting
+// users into a chatroom without its password.
+type Invite struct {
+	ent.Schema
+}
+
+// Fields of the Invite.
+func (Invite) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("code").
+			Unique().
+			Immutable(),
+
+		field.Int("chatroom_id"),
+
+		// The user who created the invite, if still around.
+		field.Int("creator_id").
+			Optional(),
+
+		// Only the target user may accept the invite, if set.
+		field.Int("target_user_id").
+			Optional().
+			Nillable(),
+
+		// The invite may be accepted any number of times, if not set.
+		field.Int("max_uses").
+			Optional().
+			Nillable(),
+
+		field.Int("uses").
+			Default(0),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("expires_at").
+			Optional().
+			Nillable(),
+
+		field.Time("revoked_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the Invite.
+func (Invite) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chatroom", Chatroom.Type).
+			Ref("invites").
+			Field("chatroom_id").
+			Unique().
+			Required(),
+
+		edge.From("creator", User.Type).
+			Ref("created_invites").
+			Field("creator_id").
+			Unique(),
+
+		edge.From("target_user", User.Type).
+			Ref("targeted_invites").
+			Field("target_user_id").
+			Unique(),
+
+		edge.To("redemptions", InviteRedemption.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+	}
+}
@@ -0,0 +1,45 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// InviteRedemption holds the schema definition for the InviteRedemption
+// entity, a user who joined a chatroom through an invite.
+type InviteRedemption struct {
+	ent.Schema
+}
+
+// Fields of the InviteRedemption.
+func (InviteRedemption) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("invite_id"),
+
+		field.Int("user_id"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the InviteRedemption.
+func (InviteRedemption) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("invite", Invite.Type).
+			Ref("redemptions").
+			Field("invite_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("invite_redemptions").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Mention holds the schema definition for the Mention entity, a notification
+// of a user mentioned in a chat.
+type Mention struct {
+	ent.Schema
+}
+
+// Fields of the Mention.
+func (Mention) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("chat_id"),
+
+		field.Int("user_id"),
+
+		// How the user was mentioned, by the username, @here or @everyone.
+		field.Enum("type").
+			Values("user", "here", "everyone"),
+
+		field.Time("read_at").
+			Optional().
+			Nillable(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the Mention.
+func (Mention) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chat", Chat.Type).
+			Ref("mentions").
+			Field("chat_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("mentions").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the Mention.
+func (Mention) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("chat_id", "user_id").
+			Unique(),
+
+		index.Fields("user_id", "read_at"),
+	}
+}
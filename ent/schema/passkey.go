@@ -0,0 +1,50 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkey holds the schema definition for the Passkey entity, a WebAuthn
+// credential registered by the user.
+type Passkey struct {
+	ent.Schema
+}
+
+// Fields of the Passkey.
+func (Passkey) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.String("name"),
+
+		field.Bytes("credential_id").
+			Unique(),
+
+		field.JSON("credential", &webauthn.Credential{}).
+			StructTag(`json:"-"`),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("last_used_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the Passkey.
+func (Passkey) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("passkeys").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
@@ -0,0 +1,54 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyChallenge holds the schema definition for the PasskeyChallenge
+// entity, the state of a WebAuthn ceremony between its begin and finish
+// requests. It is consumed when the ceremony finishes, so that it cannot be
+// replayed.
+type PasskeyChallenge struct {
+	ent.Schema
+}
+
+// Fields of the PasskeyChallenge.
+func (PasskeyChallenge) Fields() []ent.Field {
+	return []ent.Field{
+		// user_id is the user registering a passkey, and is not set when
+		// signing in, since the passkey tells the user.
+		field.Int("user_id").
+			Optional(),
+
+		field.Enum("purpose").
+			Values("registration", "sign_in"),
+
+		field.String("token").
+			Unique().
+			Sensitive(),
+
+		field.JSON("session", &webauthn.SessionData{}).
+			StructTag(`json:"-"`),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("expires_at"),
+	}
+}
+
+// Edges of the PasskeyChallenge.
+func (PasskeyChallenge) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("passkey_challenges").
+			Field("user_id").
+			Unique(),
+	}
+}
@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// PersonalAccessToken holds the schema definition for the PersonalAccessToken
+// entity, a long-lived token for integrations limited to some scopes.
+type PersonalAccessToken struct {
+	ent.Schema
+}
+
+// Fields of the PersonalAccessToken.
+func (PersonalAccessToken) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.String("name"),
+
+		field.String("token").
+			Unique().
+			Sensitive(),
+
+		field.Strings("scopes"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("last_used_at").
+			Optional().
+			Nillable(),
+
+		field.Time("expires_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the PersonalAccessToken.
+func (PersonalAccessToken) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("personal_access_tokens").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
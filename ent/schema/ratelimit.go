@@ -0,0 +1,31 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+)
+
+// RateLimit holds the schema definition for the RateLimit entity, failed
+// attempts recorded by the SQLite store of the rate limiter.
+type RateLimit struct {
+	ent.Schema
+}
+
+// Fields of the RateLimit.
+func (RateLimit) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("key").
+			Unique(),
+
+		field.Int("failures"),
+
+		field.Time("last_failure_at"),
+
+		field.Time("locked_until"),
+	}
+}
+
+// Edges of the RateLimit.
+func (RateLimit) Edges() []ent.Edge {
+	return nil
+}
@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Reaction holds the schema definition for the Reaction entity, an emoji a
+// user reacted to a chat with.
+type Reaction struct {
+	ent.Schema
+}
+
+// Fields of the Reaction.
+func (Reaction) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("chat_id"),
+
+		field.Int("user_id"),
+
+		// emoji is either a unicode emoji or <:name:id> of a custom emoji.
+		field.String("emoji").
+			NotEmpty().
+			MaxLen(64),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the Reaction.
+func (Reaction) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("chat", Chat.Type).
+			Ref("reactions").
+			Field("chat_id").
+			Unique().
+			Required(),
+
+		edge.From("user", User.Type).
+			Ref("reactions").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the Reaction.
+func (Reaction) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("chat_id", "user_id", "emoji").
+			Unique(),
+	}
+}
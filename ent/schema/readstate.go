@@ -0,0 +1,58 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// ReadState holds the schema definition for the ReadState entity, how far a
+// user has read a chatroom.
+type ReadState struct {
+	ent.Schema
+}
+
+// Fields of the ReadState.
+func (ReadState) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.Int("chatroom_id"),
+
+		// last_read_chat_id is kept even if the chat is deleted, as the chats
+		// after it are still unread.
+		field.Int("last_read_chat_id"),
+
+		field.Time("updated_at").
+			Default(time.Now).
+			UpdateDefault(time.Now),
+	}
+}
+
+// Edges of the ReadState.
+func (ReadState) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("read_states").
+			Field("user_id").
+			Unique().
+			Required(),
+
+		edge.From("chatroom", Chatroom.Type).
+			Ref("read_states").
+			Field("chatroom_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the ReadState.
+func (ReadState) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("user_id", "chatroom_id").
+			Unique(),
+	}
+}
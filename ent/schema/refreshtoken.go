@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// RefreshToken holds the schema definition for the RefreshToken entity.
+// Tokens issued to the same session form a family, linked by their parents.
+type RefreshToken struct {
+	ent.Schema
+}
+
+// Fields of the RefreshToken.
+func (RefreshToken) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("session_id"),
+
+		field.Int("parent_id").
+			Optional(),
+
+		field.String("token").
+			Unique().
+			Sensitive(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("rotated_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the RefreshToken.
+func (RefreshToken) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("session", Session.Type).
+			Ref("refresh_tokens").
+			Field("session_id").
+			Unique().
+			Required(),
+
+		edge.To("children", RefreshToken.Type).
+			From("parent").
+			Field("parent_id").
+			Unique(),
+	}
+}
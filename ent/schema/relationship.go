@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Relationship holds the schema definition for the Relationship entity, what
+// a user is to another user. Friendships and friend requests are kept on both
+// sides, while a block is only kept on the side of the user who blocked.
+type Relationship struct {
+	ent.Schema
+}
+
+// Fields of the Relationship.
+func (Relationship) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.Int("target_id"),
+
+		// Outgoing and incoming are the two sides of a friend request.
+		field.Enum("type").
+			Values("friend", "outgoing", "incoming", "blocked"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the Relationship.
+func (Relationship) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("relationships").
+			Field("user_id").
+			Unique().
+			Required(),
+
+		edge.From("target", User.Type).
+			Ref("targeted_relationships").
+			Field("target_id").
+			Unique().
+			Required(),
+	}
+}
+
+// Indexes of the Relationship.
+func (Relationship) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("user_id", "target_id").
+			Unique(),
+	}
+}
@@ -0,0 +1,55 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// SecurityEvent holds the schema definition for the SecurityEvent entity.
+type SecurityEvent struct {
+	ent.Schema
+}
+
+// Fields of the SecurityEvent.
+func (SecurityEvent) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.Enum("type").
+			Values(
+				"refresh_token_reuse",
+				"totp_enabled",
+				"totp_disabled",
+				"recovery_code_used",
+				"password_reset",
+				"identity_linked",
+			),
+
+		field.Int("session_id").
+			Optional(),
+
+		field.String("user_agent").
+			Optional(),
+
+		field.String("ip_address").
+			Optional(),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+	}
+}
+
+// Edges of the SecurityEvent.
+func (SecurityEvent) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("security_events").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// Suspension holds the schema definition for the Suspension entity. A
+// suspension without expiry is a permanent ban.
+type Suspension struct {
+	ent.Schema
+}
+
+// Fields of the Suspension.
+func (Suspension) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		// The moderator who issued the suspension, if still around.
+		field.Int("issuer_id").
+			Optional(),
+
+		field.String("reason"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("expires_at").
+			Optional().
+			Nillable(),
+
+		field.Time("lifted_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Edges of the Suspension.
+func (Suspension) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("suspensions").
+			Field("user_id").
+			Unique().
+			Required(),
+
+		edge.From("issuer", User.Type).
+			Ref("issued_suspensions").
+			Field("issuer_id").
+			Unique(),
+	}
+}
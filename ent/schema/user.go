@@ -23,11 +23,59 @@ func (User) Fields() []ent.Field {
 		field.String("password").
 			Sensitive(),
 
-		field.String("refresh_token").
+		field.String("display_name"),
+
+		field.String("email").
 			Optional().
+			Unique().
 			Sensitive(),
 
-		field.String("display_name"),
+		field.Bool("email_verified").
+			Default(false).
+			StructTag(`json:"-"`),
+
+		field.String("totp_secret").
+			Optional().
+			Sensitive(),
+
+		field.Bool("totp_enabled").
+			Default(false),
+
+		field.Int64("totp_last_step").
+			Optional().
+			StructTag(`json:"-"`),
+
+		field.Enum("role").
+			Values("admin", "moderator", "member").
+			Default("member"),
+
+		// Whether the user has an active suspension, kept for quick checks.
+		field.Bool("suspended").
+			Default(false),
+
+		field.Bool("bot").
+			Default(false).
+			Immutable(),
+
+		// The status chosen by the user, which others only see through the
+		// presence of the user.
+		field.Enum("status").
+			Values("online", "idle", "dnd", "invisible").
+			Default("online").
+			StructTag(`json:"-"`),
+
+		field.String("custom_status").
+			Optional().
+			StructTag(`json:"-"`),
+
+		field.Time("custom_status_expires_at").
+			Optional().
+			Nillable().
+			StructTag(`json:"-"`),
+
+		// Bots are owned by the user who created them.
+		field.Int("owner_id").
+			Optional(),
 
 		field.Uint8("profile_color_index").
 			Immutable(),
@@ -45,12 +93,102 @@ func (User) Fields() []ent.Field {
 // Edges of the User.
 func (User) Edges() []ent.Edge {
 	return []ent.Edge{
+		// What becomes of the chatrooms is up to the owner deletion policy.
 		edge.To("chatrooms", Chatroom.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		// What becomes of the guilds is up to the owner deletion policy.
+		edge.To("guilds", Guild.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("guild_memberships", GuildMember.Type).
 			Annotations(entsql.OnDelete(entsql.Cascade)),
 
-		edge.To("allowed_chatrooms", Chatroom.Type),
+		edge.To("allowed_chatrooms", Chatroom.Type).
+			Through("memberships", Membership.Type),
 
 		edge.To("chats", Chat.Type).
 			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("reactions", Reaction.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("mentions", Mention.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("read_states", ReadState.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("uploaded_emojis", CustomEmoji.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("owned_conversations", Conversation.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("conversation_participants", ConversationParticipant.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("direct_messages", DirectMessage.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("relationships", Relationship.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("targeted_relationships", Relationship.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("sessions", Session.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("security_events", SecurityEvent.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("recovery_codes", RecoveryCode.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("passkeys", Passkey.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("passkey_challenges", PasskeyChallenge.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("verification_tokens", VerificationToken.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("personal_access_tokens", PersonalAccessToken.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("chatroom_roles", ChatroomRole.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("chatroom_bans", ChatroomBan.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("issued_chatroom_bans", ChatroomBan.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("created_invites", Invite.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("targeted_invites", Invite.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("invite_redemptions", InviteRedemption.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("identities", Identity.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("suspensions", Suspension.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)),
+
+		edge.To("issued_suspensions", Suspension.Type).
+			Annotations(entsql.OnDelete(entsql.SetNull)),
+
+		edge.To("bots", User.Type).
+			Annotations(entsql.OnDelete(entsql.Cascade)).
+			From("owner").
+			Field("owner_id").
+			Unique(),
 	}
 }
@@ -0,0 +1,50 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// VerificationToken holds the schema definition for the VerificationToken
+// entity, a single-use token mailed to the user.
+type VerificationToken struct {
+	ent.Schema
+}
+
+// Fields of the VerificationToken.
+func (VerificationToken) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("user_id"),
+
+		field.Enum("purpose").
+			Values("password_reset", "email_verification"),
+
+		field.String("token").
+			Unique().
+			Sensitive(),
+
+		// email is the address the token was mailed to, which is verified
+		// only if it is still the address of the user.
+		field.String("email"),
+
+		field.Time("created_at").
+			Default(time.Now).
+			Immutable(),
+
+		field.Time("expires_at"),
+	}
+}
+
+// Edges of the VerificationToken.
+func (VerificationToken) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).
+			Ref("verification_tokens").
+			Field("user_id").
+			Unique().
+			Required(),
+	}
+}
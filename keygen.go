@@ -1,5 +1,11 @@
 //go:build ignore
 
+// keygen manages the key ring used to sign tokens.
+//
+//	go run keygen.go [add]        generate a new key and sign with it
+//	go run keygen.go list         list keys, marking the active one
+//	go run keygen.go activate KID sign with the key KID
+//	go run keygen.go retire KID   remove the key KID, once its tokens expired
 package main
 
 import (
@@ -8,18 +14,62 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+const keyDir = "keys"
+
 func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"add"}
+	}
+
+	var err error
+	switch {
+	case args[0] == "add" && len(args) == 1:
+		err = add()
+	case args[0] == "list" && len(args) == 1:
+		err = list()
+	case args[0] == "activate" && len(args) == 2:
+		err = activate(args[1])
+	case args[0] == "retire" && len(args) == 2:
+		err = retire(args[1])
+	default:
+		err = errors.New("usage: go run keygen.go [add | list | activate KID | retire KID]")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func add() error {
+	if err := os.MkdirAll(keyDir, 0o700); err != nil {
+		return err
+	}
+
+	// Keep the key used before the key ring, so that its tokens stay valid.
+	if _, err := os.Stat("disgord.pem"); err == nil {
+		if err := os.Rename("disgord.pem", filepath.Join(keyDir, "disgord.pem")); err != nil {
+			return err
+		}
+	}
+
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	der, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	block := &pem.Block{
@@ -27,13 +77,102 @@ func main() {
 		Bytes: der,
 	}
 
-	file, err := os.Create("disgord.pem")
+	kid := time.Now().UTC().Format("20060102150405")
+
+	file, err := os.OpenFile(filepath.Join(keyDir, kid+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 
 	if err := pem.Encode(file, block); err != nil {
-		panic(err)
+		return err
+	}
+
+	fmt.Println("added", kid)
+
+	return activate(kid)
+}
+
+func list() error {
+	kids, err := kids()
+	if err != nil {
+		return err
+	}
+
+	active, err := active()
+	if err != nil {
+		return err
+	}
+
+	for _, kid := range kids {
+		if kid == active {
+			fmt.Println(kid, "(active)")
+		} else {
+			fmt.Println(kid)
+		}
+	}
+
+	return nil
+}
+
+func activate(kid string) error {
+	if _, err := os.Stat(filepath.Join(keyDir, kid+".pem")); err != nil {
+		return err
 	}
+
+	if err := os.WriteFile(filepath.Join(keyDir, "active"), []byte(kid+"\n"), 0o600); err != nil {
+		return err
+	}
+
+	fmt.Println("activated", kid)
+
+	return nil
+}
+
+func retire(kid string) error {
+	active, err := active()
+	if err != nil {
+		return err
+	}
+
+	if kid == active {
+		return errors.New("cannot retire the active key, activate another key first")
+	}
+
+	if err := os.Remove(filepath.Join(keyDir, kid+".pem")); err != nil {
+		return err
+	}
+
+	fmt.Println("retired", kid)
+
+	return nil
+}
+
+func kids() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(keyDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	kids := make([]string, 0, len(paths))
+	for _, path := range paths {
+		kids = append(kids, strings.TrimSuffix(filepath.Base(path), ".pem"))
+	}
+	sort.Strings(kids)
+
+	return kids, nil
+}
+
+func active() (string, error) {
+	b, err := os.ReadFile(filepath.Join(keyDir, "active"))
+	if errors.Is(err, os.ErrNotExist) {
+		// Same as the server, no key is active unless chosen explicitly.
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
 }
@@ -27,6 +27,7 @@ func main() {
 	r.Use(cors.New(config))
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	r.GET("/.well-known/jwks.json", c.GetJWKS)
 
 	public := r.Group("")
 	{
@@ -34,6 +35,14 @@ func main() {
 		{
 			auth.POST("/sign-up", c.SignUp)
 			auth.POST("/sign-in", c.SignIn)
+			auth.POST("/sign-in/2fa", c.SignInWithTOTP)
+			auth.POST("/passkey/begin", c.BeginPasskeySignIn)
+			auth.POST("/passkey/finish", c.FinishPasskeySignIn)
+			auth.GET("/oidc/login", c.BeginOIDCSignIn)
+			auth.GET("/oidc/callback", c.FinishOIDCSignIn)
+			auth.POST("/password-reset", c.RequestPasswordReset)
+			auth.POST("/password-reset/confirm", c.ResetPassword)
+			auth.POST("/verify-email", c.VerifyEmail)
 			auth.POST("/refresh", c.Refresh)
 			auth.POST("/sign-out", c.SignOut)
 		}
@@ -42,41 +51,170 @@ func main() {
 		{
 			chatroom.GET("", c.GetAllChatrooms)
 		}
+
+		emoji := public.Group("/emojis")
+		{
+			emoji.GET("/:id/image", c.GetEmojiImage)
+		}
+
+		ws := public.Group("/ws")
+		{
+			ws.GET("", c.ConnectWebsocket)
+		}
 	}
 
 	private := r.Group("")
 	private.Use(c.JWTAuthMiddleware())
 	{
 		user := private.Group("/users")
+		user.Use(c.ScopeMiddleware("users"))
 		{
 			user.GET("", c.GetAllUsers)
 			user.GET("/:id", c.GetUserByID)
 			user.GET("/me", c.GetMyProfile)
-			user.PATCH("/me", c.UpdateMyProfile)
-			user.DELETE("/me", c.CancelAccount)
+			user.GET("/presences", c.GetPresences)
+		}
+
+		me := user.Group("/me")
+		me.Use(c.SessionMiddleware())
+		{
+			me.PATCH("", c.UpdateMyProfile)
+			me.DELETE("", c.CancelAccount)
+			me.GET("/sessions", c.GetMySessions)
+			me.DELETE("/sessions", c.RevokeAllSessions)
+			me.DELETE("/sessions/:id", c.RevokeSession)
+			me.GET("/security-events", c.GetMySecurityEvents)
+			me.GET("/relationships", c.GetMyRelationships)
+			me.PUT("/friends/:userId", c.AddFriend)
+			me.DELETE("/friends/:userId", c.RemoveFriend)
+			me.PUT("/blocks/:userId", c.BlockUser)
+			me.DELETE("/blocks/:userId", c.UnblockUser)
+			me.PATCH("/presence", c.UpdateMyPresence)
+			me.GET("/mentions", c.GetMyMentions)
+			me.POST("/mentions/read", c.ReadMyMentions)
+			me.PATCH("/mentions/:id", c.UpdateMyMention)
+			me.POST("/2fa", c.EnrollTOTP)
+			me.POST("/2fa/confirm", c.ConfirmTOTP)
+			me.DELETE("/2fa", c.DisableTOTP)
+			me.GET("/passkeys", c.GetMyPasskeys)
+			me.POST("/passkeys/begin", c.BeginPasskeyRegistration)
+			me.POST("/passkeys/finish", c.FinishPasskeyRegistration)
+			me.DELETE("/passkeys/:id", c.DeletePasskey)
+			me.POST("/email/verification", c.SendEmailVerification)
+			me.GET("/tokens", c.GetMyPersonalAccessTokens)
+			me.POST("/tokens", c.CreatePersonalAccessToken)
+			me.DELETE("/tokens/:id", c.DeletePersonalAccessToken)
+			me.GET("/bots", c.GetMyBots)
+			me.POST("/bots", c.CreateBot)
+			me.DELETE("/bots/:id", c.DeleteBot)
+			me.GET("/bots/:id/tokens", c.GetBotTokens)
+			me.POST("/bots/:id/tokens", c.CreateBotToken)
+			me.DELETE("/bots/:id/tokens/:tokenId", c.DeleteBotToken)
 		}
 
 		chatroom := private.Group("/chatrooms")
+		chatroom.Use(c.ScopeMiddleware("chatrooms"))
 		{
 			chatroom.GET("/:id", c.GetChatroomByID)
 			chatroom.POST("", c.CreateChatroom)
 			chatroom.PATCH("/:id", c.UpdateChatroom)
 			chatroom.DELETE("/:id", c.DeleteChatroom)
 			chatroom.POST("/:id/join", c.JoinChatroom)
+			chatroom.POST("/:id/read", c.MarkChatroomRead)
+			chatroom.POST("/:id/transfer", c.TransferChatroom)
+			chatroom.GET("/:id/roles", c.GetChatroomRoles)
+			chatroom.GET("/:id/roles/:userId", c.GetChatroomRole)
+			chatroom.PUT("/:id/roles/:userId", c.UpdateChatroomRole)
+			chatroom.DELETE("/:id/roles/:userId", c.DeleteChatroomRole)
+			chatroom.POST("/:id/kick", c.KickFromChatroom)
+			chatroom.GET("/:id/bans", c.GetChatroomBans)
+			chatroom.PUT("/:id/bans/:userId", c.BanFromChatroom)
+			chatroom.DELETE("/:id/bans/:userId", c.UnbanFromChatroom)
+			chatroom.GET("/:id/invites", c.GetChatroomInvites)
+			chatroom.POST("/:id/invites", c.CreateInvite)
+			chatroom.DELETE("/:id/invites/:inviteId", c.RevokeInvite)
+			chatroom.GET("/:id/emojis", c.GetChatroomEmojis)
+			chatroom.POST("/:id/emojis", c.CreateChatroomEmoji)
+			chatroom.DELETE("/:id/emojis/:emojiId", c.DeleteChatroomEmoji)
+		}
+
+		guild := private.Group("/guilds")
+		guild.Use(c.ScopeMiddleware("chatrooms"))
+		{
+			guild.GET("", c.GetAllGuilds)
+			guild.GET("/:id", c.GetGuildByID)
+			guild.POST("", c.CreateGuild)
+			guild.PATCH("/:id", c.UpdateGuild)
+			guild.DELETE("/:id", c.DeleteGuild)
+			guild.POST("/:id/join", c.JoinGuild)
+			guild.POST("/:id/leave", c.LeaveGuild)
+			guild.POST("/:id/transfer", c.TransferGuild)
+			guild.GET("/:id/channels", c.GetGuildChannels)
+			guild.POST("/:id/channels", c.CreateGuildChannel)
+			guild.POST("/:id/categories", c.CreateGuildCategory)
+			guild.PATCH("/:id/categories/:categoryId", c.UpdateGuildCategory)
+			guild.DELETE("/:id/categories/:categoryId", c.DeleteGuildCategory)
+			guild.GET("/:id/members", c.GetGuildMembers)
+			guild.PUT("/:id/members/:userId", c.UpdateGuildMemberRole)
+			guild.DELETE("/:id/members/:userId", c.DeleteGuildMember)
+			guild.GET("/:id/emojis", c.GetGuildEmojis)
+			guild.POST("/:id/emojis", c.CreateGuildEmoji)
+			guild.DELETE("/:id/emojis/:emojiId", c.DeleteGuildEmoji)
+		}
+
+		conversation := private.Group("/conversations")
+		conversation.Use(c.ScopeMiddleware("chats"))
+		{
+			conversation.GET("", c.GetAllConversations)
+			conversation.GET("/:id", c.GetConversationByID)
+			conversation.POST("", c.CreateConversation)
+			conversation.PATCH("/:id", c.UpdateConversation)
+			conversation.PUT("/:id/participants/:userId", c.AddConversationParticipant)
+			conversation.DELETE("/:id/participants/:userId", c.RemoveConversationParticipant)
+			conversation.GET("/:id/messages", c.GetDirectMessages)
+			conversation.POST("/:id/messages", c.SendDirectMessage)
+			conversation.DELETE("/:id/messages/:messageId", c.DeleteDirectMessage)
+			conversation.POST("/:id/call", c.JoinCall)
+		}
+
+		invite := private.Group("/invites")
+		invite.Use(c.ScopeMiddleware("chatrooms"))
+		{
+			invite.POST("/:code/accept", c.AcceptInvite)
 		}
 
 		chat := private.Group("/chats")
+		chat.Use(c.ScopeMiddleware("chats"))
 		{
 			chat.GET("", c.GetAllChats)
 			chat.GET("/:id", c.GetChatByID)
 			chat.POST("", c.CreateChat)
 			chat.PATCH("/:id", c.UpdateChat)
 			chat.DELETE("/:id", c.DeleteChat)
+			chat.GET("/:id/reactions", c.GetChatReactions)
+			chat.PUT("/:id/reactions/:emoji", c.AddReaction)
+			chat.DELETE("/:id/reactions/:emoji", c.RemoveReaction)
 		}
 
 		ws := private.Group("/ws")
+		ws.Use(c.ScopeMiddleware("ws"))
 		{
-			ws.GET("", c.ConnectWebsocket)
+			ws.POST("/ticket", c.IssueWebsocketTicket)
+		}
+
+		admin := private.Group("/admin")
+		admin.Use(c.SessionMiddleware(), c.RoleMiddleware("moderator"))
+		{
+			admin.GET("/users", c.GetAllUsersAsAdmin)
+			admin.PUT("/users/:id/role", c.UpdateUserRole)
+			admin.GET("/users/:id/suspensions", c.GetUserSuspensions)
+			admin.POST("/users/:id/suspensions", c.SuspendUser)
+			admin.DELETE("/users/:id/suspensions", c.UnsuspendUser)
+			admin.POST("/users/:id/sign-out", c.SignOutUser)
+			admin.DELETE("/users/:id", c.DeleteUser)
+			admin.DELETE("/chatrooms/:id", c.ForceDeleteChatroom)
+			admin.GET("/rate-limits", c.GetRateLimits)
+			admin.DELETE("/rate-limits", c.UnlockRateLimit)
 		}
 	}
 